@@ -0,0 +1,41 @@
+package bloodlabnet
+
+import (
+	"net"
+	"sync"
+
+	"github.com/blutspende/go-bloodlab-net/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// deferAcknowledgement lets the result of DataReceived decide about the acknowledgement of the protocol,
+// see protocol.Acknowledger. It is false if the protocol can not pass the result to the peer.
+func deferAcknowledgement(lowLevelProtocol protocol.Implementation) bool {
+	if acknowledger, ok := lowLevelProtocol.(protocol.Acknowledger); ok {
+		return acknowledger.DeferAcknowledgement()
+	}
+	return false
+}
+
+// acknowledge passes the result of DataReceived to the peer if the acknowledgement is deferred. It returns
+// true if the peer was told that the message is refused. An error of the handler that was not passed to the
+// peer is reported to Handler.Error. sendMutex is held during the acknowledgement, e.g. MLLP sends a message.
+func acknowledge(lowLevelProtocol protocol.Implementation, deferred bool, conn net.Conn, sendMutex sync.Locker,
+	handler Handler, session Session, handlerErr error) bool {
+
+	refused := false
+	if deferred {
+		var err error
+		sendMutex.Lock()
+		refused, err = lowLevelProtocol.(protocol.Acknowledger).Acknowledge(conn, handlerErr)
+		sendMutex.Unlock()
+		if err != nil {
+			remoteIP, _ := session.RemoteAddress()
+			log.Warn().Err(err).Str("ip", remoteIP).Msg("the result of the handler was not passed to the peer")
+		}
+	}
+	if handlerErr != nil && !refused {
+		handler.Error(session, ErrorDataReceived, handlerErr)
+	}
+	return refused
+}
@@ -0,0 +1,314 @@
+package bloodlabnet
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SessionInfo describes an active session of a TCP server, see AdminHandler
+type SessionInfo struct {
+	ID            uint64    `json:"id"`
+	RemoteAddress string    `json:"remoteAddress"`
+	LocalAddress  string    `json:"localAddress,omitempty"`
+	ProxySource   string    `json:"proxySource,omitempty"`
+	Protocol      string    `json:"protocol"`
+	ConnectTime   time.Time `json:"connectTime"`
+	BytesIn       int64     `json:"bytesIn"`
+	BytesOut      int64     `json:"bytesOut"`
+	MessagesIn    int64     `json:"messagesIn"`
+	MessagesOut   int64     `json:"messagesOut"`
+	LastActivity  time.Time `json:"lastActivity"`
+}
+
+// sessionStats counts the traffic of a session, the methods may be called on nil
+type sessionStats struct {
+	bytesIn      int64
+	bytesOut     int64
+	messagesIn   int64
+	messagesOut  int64
+	lastActivity int64 // unix nanoseconds
+	lastMessage  int64 // unix nanoseconds
+}
+
+func (s *sessionStats) bytesReceived(n int) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.bytesIn, int64(n))
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *sessionStats) bytesSent(n int) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.bytesOut, int64(n))
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// touch marks activity without traffic
+func (s *sessionStats) touch() {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// lastActivityTime is the time of the last traffic, since if there was none
+func (s *sessionStats) lastActivityTime(since time.Time) time.Time {
+	if s == nil {
+		return since
+	}
+	if lastActivity := atomic.LoadInt64(&s.lastActivity); lastActivity != 0 {
+		return time.Unix(0, lastActivity)
+	}
+	return since
+}
+
+func (s *sessionStats) messageReceived() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.messagesIn, 1)
+	atomic.StoreInt64(&s.lastMessage, time.Now().UnixNano())
+}
+
+func (s *sessionStats) messageSent() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.messagesOut, 1)
+	atomic.StoreInt64(&s.lastMessage, time.Now().UnixNano())
+}
+
+// lastMessageTime is the time of the last message sent or received, since if there was none
+func (s *sessionStats) lastMessageTime(since time.Time) time.Time {
+	if s == nil {
+		return since
+	}
+	if lastMessage := atomic.LoadInt64(&s.lastMessage); lastMessage != 0 {
+		return time.Unix(0, lastMessage)
+	}
+	return since
+}
+
+func (session *tcpServerSession) info() SessionInfo {
+	info := SessionInfo{
+		ID:            session.id,
+		RemoteAddress: session.remoteAddr,
+		Protocol:      protocolName(session.lowLevelProtocol),
+		ConnectTime:   session.connectTime,
+		BytesIn:       atomic.LoadInt64(&session.stats.bytesIn),
+		BytesOut:      atomic.LoadInt64(&session.stats.bytesOut),
+		MessagesIn:    atomic.LoadInt64(&session.stats.messagesIn),
+		MessagesOut:   atomic.LoadInt64(&session.stats.messagesOut),
+		LastActivity:  session.stats.lastActivityTime(session.connectTime),
+	}
+	if session.localAddr != nil {
+		info.LocalAddress = session.localAddr.String()
+	}
+	if session.proxySource != nil {
+		info.ProxySource = session.proxySource.String()
+	}
+	return info
+}
+
+// protocolName is the type name of the implementation, e.g. lis1A1
+func protocolName(implementation interface{}) string {
+	if implementation == nil {
+		return ""
+	}
+	t := reflect.TypeOf(implementation)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// Sessions returns the active sessions of the server, the oldest first
+func (instance *tcpServerInstance) Sessions() []SessionInfo {
+	sessions := instance.sessions.all()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.info())
+	}
+	return infos
+}
+
+// SessionCount is the number of active sessions
+func (instance *tcpServerInstance) SessionCount() int {
+	return instance.sessions.count()
+}
+
+// SessionByID returns the active session with the ID of its SessionInfo
+func (instance *tcpServerInstance) SessionByID(id uint64) (Session, bool) {
+	session, ok := instance.sessions.get(id)
+	if !ok {
+		return nil, false
+	}
+	return session, true
+}
+
+// ForEachSession calls fn for the active sessions, the oldest first, until it returns false. Sessions
+// can be closed within fn.
+func (instance *tcpServerInstance) ForEachSession(fn func(session Session) bool) {
+	for _, session := range instance.sessions.all() {
+		if !fn(session) {
+			return
+		}
+	}
+}
+
+// CloseSession disconnects the session with the ID, false if there is no such session
+func (instance *tcpServerInstance) CloseSession(id uint64) bool {
+	session, ok := instance.sessions.get(id)
+	if !ok {
+		return false
+	}
+	session.closeWithReason(DisconnectAdmin)
+	return true
+}
+
+// IPFilter returns the filter of the remote addresses, it can be changed while the server is running
+func (instance *tcpServerInstance) IPFilter() *IPFilter {
+	return instance.ipFilter
+}
+
+// Blacklist returns the denylist of the IPFilter
+func (instance *tcpServerInstance) Blacklist() []string {
+	return instance.ipFilter.DenyList()
+}
+
+// AddToBlacklist refuses new connections from the address or network, active sessions are not closed
+func (instance *tcpServerInstance) AddToBlacklist(entry string) error {
+	return instance.ipFilter.Deny(entry)
+}
+
+// RemoveFromBlacklist accepts connections from the address or network again, false if it was not blacklisted
+func (instance *tcpServerInstance) RemoveFromBlacklist(entry string) bool {
+	return instance.ipFilter.RemoveDenied(entry)
+}
+
+// TCPServerAdministration is implemented by the instances of CreateNewTCPServerInstance
+type TCPServerAdministration interface {
+	Sessions() []SessionInfo
+	SessionCount() int
+	SessionByID(id uint64) (Session, bool)
+	ForEachSession(fn func(session Session) bool)
+	CloseSession(id uint64) bool
+	IPFilter() *IPFilter
+	Blacklist() []string
+	AddToBlacklist(entry string) error
+	RemoveFromBlacklist(entry string) bool
+}
+
+var _ TCPServerAdministration = &tcpServerInstance{}
+
+// AdminHandler serves the administration of a TCP server (see CreateNewTCPServerInstance) via http:
+//
+//	GET    /sessions        list of SessionInfo
+//	DELETE /sessions/{id}   close the session
+//	GET    /blacklist       list of the denied addresses and networks
+//	PUT    /blacklist/{ip}  add the address or network (e.g. /blacklist/10.0.0.0/8) to the denylist
+//	DELETE /blacklist/{ip}  remove the address or network from the denylist
+//	GET    /allowlist       list of the allowed addresses and networks
+//	PUT    /allowlist/{ip}  add the address or network to the allowlist
+//	DELETE /allowlist/{ip}  remove the address or network from the allowlist
+//	GET    /healthz         liveness probe, always 200
+//	GET    /readyz          readiness probe, 200 while the server accepts connections, otherwise 503
+//
+// Use http.StripPrefix to serve it below a path. The handler has no authentication.
+func AdminHandler(server ConnectionInstance) (http.Handler, error) {
+	instance, ok := server.(*tcpServerInstance)
+	if !ok {
+		return nil, errors.New("the admin handler is only available for TCP servers")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !instance.isAccepting() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not accepting connections"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, instance.Sessions())
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid session id"})
+			return
+		}
+		if !instance.CloseSession(id) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		log.Info().Uint64("session", id).Msg("session closed by admin")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handleIPFilterList(mux, "/blacklist", instance.ipFilter.DenyList, instance.ipFilter.Deny, instance.ipFilter.RemoveDenied)
+	handleIPFilterList(mux, "/allowlist", instance.ipFilter.AllowList, instance.ipFilter.Allow, instance.ipFilter.RemoveAllowed)
+	return mux, nil
+}
+
+func handleIPFilterList(mux *http.ServeMux, path string, list func() []string,
+	add func(entries ...string) error, remove func(entry string) bool) {
+
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, list())
+	})
+	mux.HandleFunc(path+"/", func(w http.ResponseWriter, r *http.Request) {
+		entry := strings.TrimPrefix(r.URL.Path, path+"/")
+		switch r.Method {
+		case http.MethodPut:
+			if err := add(entry); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			log.Info().Str("entry", entry).Str("list", path).Msg("ip filter entry added by admin")
+		case http.MethodDelete:
+			if !remove(entry) {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "entry not found"})
+				return
+			}
+			log.Info().Str("entry", entry).Str("list", path).Msg("ip filter entry removed by admin")
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Error().Err(err).Msg("failed to write admin response")
+	}
+}
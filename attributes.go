@@ -0,0 +1,75 @@
+package bloodlabnet
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// Attributes is a key/value store of a session, e.g. for the identity of the instrument or a partial
+// result between the DataReceived events. It can be used from any goroutine. The attributes are
+// cleared when the session ended, after the Disconnected event.
+type Attributes struct {
+	mutex  sync.RWMutex
+	values map[string]interface{}
+}
+
+func (a *Attributes) Get(key string) (interface{}, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	value, ok := a.values[key]
+	return value, ok
+}
+
+func (a *Attributes) Set(key string, value interface{}) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.values == nil {
+		a.values = make(map[string]interface{})
+	}
+	a.values[key] = value
+}
+
+func (a *Attributes) Delete(key string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.values, key)
+}
+
+// Keys returns the keys in alphabetical order
+func (a *Attributes) Keys() []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	keys := make([]string, 0, len(a.values))
+	for key := range a.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (a *Attributes) Len() int {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return len(a.values)
+}
+
+func (a *Attributes) clear() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.values = nil
+}
+
+// connectionAddresses returns the addresses of the socket and the source of the PROXY protocol header,
+// which is nil if the connection has no header
+func connectionAddresses(conn net.Conn) (localAddr, remoteAddr, proxySource net.Addr) {
+	if proxyConn, ok := conn.(*proxyproto.Conn); ok {
+		if header := proxyConn.ProxyHeader(); header != nil && !header.Command.IsLocal() {
+			proxySource = header.SourceAddr
+		}
+		conn = proxyConn.Raw()
+	}
+	return conn.LocalAddr(), conn.RemoteAddr(), proxySource
+}
@@ -0,0 +1,86 @@
+package bloodlabnet
+
+import (
+	"context"
+	"sync"
+)
+
+const defaultBroadcastParallelism = 8
+
+// SessionFilter selects the sessions of a broadcast, nil selects all sessions
+type SessionFilter func(session Session) bool
+
+// SessionsOfIP selects the sessions of a remote address
+func SessionsOfIP(ip string) SessionFilter {
+	return func(session Session) bool {
+		remoteIP, err := session.RemoteAddress()
+		return err == nil && remoteIP == ip
+	}
+}
+
+// SessionsWithAttribute selects the sessions that have the value in their Attributes, e.g. the instrument
+// profile that the handler stored when the instrument identified itself
+func SessionsWithAttribute(key string, value interface{}) SessionFilter {
+	return func(session Session) bool {
+		attribute, ok := session.Attributes().Get(key)
+		return ok && attribute == value
+	}
+}
+
+// BroadcastResult is the outcome of a broadcast for one session, N and Err as returned by Session.Send
+type BroadcastResult struct {
+	Session Session
+	N       int
+	Err     error
+}
+
+// Broadcaster is implemented by the instances of CreateNewTCPServerInstance
+type Broadcaster interface {
+	// Broadcast sends the data to the sessions that the filter selects. The sessions are sent to concurrently,
+	// at most BroadcastParallelism at once, so that a slow peer does not delay the others. The results are in
+	// the order the sessions connected. Sessions that were not started when ctx is done get its error, a send
+	// that has started is not interrupted.
+	Broadcast(ctx context.Context, data [][]byte, filter SessionFilter) []BroadcastResult
+}
+
+var _ Broadcaster = &tcpServerInstance{}
+
+func (instance *tcpServerInstance) Broadcast(ctx context.Context, data [][]byte, filter SessionFilter) []BroadcastResult {
+	sessions := make([]*tcpServerSession, 0)
+	for _, session := range instance.sessions.all() {
+		if filter == nil || filter(session) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	parallelism := instance.config.BroadcastParallelism
+	if parallelism <= 0 {
+		parallelism = defaultBroadcastParallelism
+	}
+	slots := make(chan struct{}, parallelism)
+	results := make([]BroadcastResult, len(sessions))
+	var wg sync.WaitGroup
+
+	for i, session := range sessions {
+		results[i].Session = session
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(result *BroadcastResult, session *tcpServerSession) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result.N, result.Err = session.Send(data)
+		}(&results[i], session)
+	}
+
+	wg.Wait()
+	return results
+}
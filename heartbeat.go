@@ -0,0 +1,89 @@
+package bloodlabnet
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol"
+)
+
+const defaultHeartbeatTimeout = 15 * time.Second
+
+// heartbeat probes the peer of an idle connection with the Heartbeater of the protocol. A connection
+// is idle if nothing was sent or received for the interval.
+type heartbeat struct {
+	heartbeater protocol.Heartbeater
+	conn        net.Conn
+	interval    time.Duration
+	timeout     time.Duration
+	stats       *sessionStats
+	connectTime time.Time
+	// sending serializes the heartbeat with Send
+	sending  sync.Locker
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// startHeartbeat calls peerNotResponding when a heartbeat fails. It returns nil if the protocol
+// has no heartbeat or the interval is 0.
+func startHeartbeat(lowLevelProtocol protocol.Implementation, conn net.Conn, interval, timeout time.Duration,
+	stats *sessionStats, connectTime time.Time, sending sync.Locker, peerNotResponding func(err error)) *heartbeat {
+
+	heartbeater, ok := lowLevelProtocol.(protocol.Heartbeater)
+	if !ok || interval <= 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = defaultHeartbeatTimeout
+	}
+	hb := &heartbeat{
+		heartbeater: heartbeater,
+		conn:        conn,
+		interval:    interval,
+		timeout:     timeout,
+		stats:       stats,
+		connectTime: connectTime,
+		sending:     sending,
+		stop:        make(chan struct{}),
+	}
+	go hb.run(peerNotResponding)
+	return hb
+}
+
+func (hb *heartbeat) run(peerNotResponding func(err error)) {
+	for {
+		wait := hb.interval - time.Since(hb.stats.lastActivityTime(hb.connectTime))
+		if wait > 0 {
+			select {
+			case <-hb.stop:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		hb.sending.Lock()
+		err := hb.heartbeater.Heartbeat(hb.conn, hb.timeout)
+		hb.sending.Unlock()
+		// a heartbeat without traffic must not be repeated at once
+		hb.stats.touch()
+
+		if err != nil {
+			select {
+			case <-hb.stop:
+			default:
+				peerNotResponding(err)
+			}
+			return
+		}
+	}
+}
+
+// Stop may be called on nil and more than once
+func (hb *heartbeat) Stop() {
+	if hb == nil {
+		return
+	}
+	hb.stopOnce.Do(func() { close(hb.stop) })
+}
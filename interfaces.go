@@ -1,6 +1,8 @@
 package bloodlabnet
 
 import (
+	"context"
+	"net"
 	"time"
 )
 
@@ -22,10 +24,28 @@ type ConnectionInstance interface {
 type Session interface {
 	IsAlive() bool
 	Send(msg [][]byte) (int, error)
+	// Enqueue sends the message later from the goroutine of the session, in the order of the calls and not
+	// during a transfer of the protocol (e.g. after the EOT of LIS1A1). The channel receives the result.
+	// See SendQueueCapacity and SendQueueFullPolicy in the configuration for a full queue
+	Enqueue(msg [][]byte) (<-chan SendResult, error)
 	Receive() ([]byte, error)
 	Close() error
 	WaitTermination() error
 	RemoteAddress() (string, error)
+	// ID is unique among the sessions of a server. A client counts its connections
+	ID() uint64
+	ConnectTime() time.Time
+	// LocalAddr and RemoteAddr are the addresses of the socket including the port. Behind a load balancer
+	// that sends a PROXY protocol header RemoteAddr is the load balancer and ProxySource the original
+	// source, otherwise ProxySource is nil. RemoteAddress is the ip of the original source.
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	ProxySource() net.Addr
+	// Attributes keeps values between the events of the session, they are cleared when it ended
+	Attributes() *Attributes
+	// Context carries the span of the message during DataReceived to continue the trace, see TracerProvider
+	// in the configuration. Otherwise it is context.Background
+	Context() context.Context
 }
 
 type ConnectionAndSessionInstance interface {
@@ -51,3 +71,17 @@ type Handler interface {
 	// status messages regarding the connection is available
 	Error(session Session, typeOfError ErrorType, err error)
 }
+
+// DisconnectReasonHandler is an optional extension of the Handler. If the handler implements it,
+// DisconnectedWithReason is called instead of Disconnected.
+type DisconnectReasonHandler interface {
+	DisconnectedWithReason(session Session, reason DisconnectReason)
+}
+
+func notifyDisconnected(handler Handler, session Session, reason DisconnectReason) {
+	if reasonHandler, ok := handler.(DisconnectReasonHandler); ok {
+		reasonHandler.DisconnectedWithReason(session, reason)
+		return
+	}
+	handler.Disconnected(session)
+}
@@ -0,0 +1,227 @@
+package bloodlabnet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// IPFilterPolicy decides about addresses that are on the allowlist and the denylist
+type IPFilterPolicy int
+
+const (
+	DenyWins  IPFilterPolicy = 1
+	AllowWins IPFilterPolicy = 2
+)
+
+// IPFilter decides which remote addresses a server accepts. The entries are IPv4 or IPv6 addresses
+// or networks in CIDR notation (e.g. "10.0.0.0/8", "fd00::/8"). With an empty allowlist all addresses
+// that are not denied are accepted, otherwise only the addresses on the allowlist.
+// The lists can be changed while the server is running.
+type IPFilter struct {
+	mutex  sync.RWMutex
+	policy IPFilterPolicy
+	allow  []ipFilterEntry
+	deny   []ipFilterEntry
+}
+
+type ipFilterEntry struct {
+	text    string
+	network *net.IPNet
+}
+
+func NewIPFilter(policy IPFilterPolicy) *IPFilter {
+	return &IPFilter{policy: policy}
+}
+
+// parseIPFilterEntry accepts an address (as single host network) or a network in CIDR notation
+func parseIPFilterEntry(entry string) (ipFilterEntry, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return ipFilterEntry{}, fmt.Errorf("invalid network '%s' - %w", entry, err)
+		}
+		return ipFilterEntry{text: network.String(), network: network}, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return ipFilterEntry{}, fmt.Errorf("invalid ip address '%s'", entry)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return ipFilterEntry{text: ip.String(), network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+}
+
+func parseIPFilterEntries(entries []string) ([]ipFilterEntry, error) {
+	parsed := make([]ipFilterEntry, 0, len(entries))
+	for _, entry := range entries {
+		filterEntry, err := parseIPFilterEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, filterEntry)
+	}
+	return parsed, nil
+}
+
+func addIPFilterEntries(list []ipFilterEntry, entries []ipFilterEntry) []ipFilterEntry {
+	for _, entry := range entries {
+		if indexOfIPFilterEntry(list, entry.text) < 0 {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func indexOfIPFilterEntry(list []ipFilterEntry, text string) int {
+	for i, entry := range list {
+		if entry.text == text {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeIPFilterEntry(list []ipFilterEntry, entry string) ([]ipFilterEntry, bool) {
+	parsed, err := parseIPFilterEntry(entry)
+	if err != nil {
+		return list, false
+	}
+	i := indexOfIPFilterEntry(list, parsed.text)
+	if i < 0 {
+		return list, false
+	}
+	return append(append([]ipFilterEntry{}, list[:i]...), list[i+1:]...), true
+}
+
+func ipFilterEntriesToStrings(list []ipFilterEntry) []string {
+	texts := make([]string, 0, len(list))
+	for _, entry := range list {
+		texts = append(texts, entry.text)
+	}
+	return texts
+}
+
+func ipFilterEntriesContain(list []ipFilterEntry, ip net.IP) bool {
+	for _, entry := range list {
+		if entry.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow adds addresses or networks to the allowlist, nothing is added if one of them is invalid
+func (f *IPFilter) Allow(entries ...string) error {
+	parsed, err := parseIPFilterEntries(entries)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.allow = addIPFilterEntries(f.allow, parsed)
+	return nil
+}
+
+// Deny adds addresses or networks to the denylist, nothing is added if one of them is invalid
+func (f *IPFilter) Deny(entries ...string) error {
+	parsed, err := parseIPFilterEntries(entries)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deny = addIPFilterEntries(f.deny, parsed)
+	return nil
+}
+
+// RemoveAllowed removes an entry from the allowlist, false if it was not on the list
+func (f *IPFilter) RemoveAllowed(entry string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var removed bool
+	f.allow, removed = removeIPFilterEntry(f.allow, entry)
+	return removed
+}
+
+// RemoveDenied removes an entry from the denylist, false if it was not on the list
+func (f *IPFilter) RemoveDenied(entry string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var removed bool
+	f.deny, removed = removeIPFilterEntry(f.deny, entry)
+	return removed
+}
+
+// SetAllowList replaces the allowlist, it is unchanged if one of the entries is invalid
+func (f *IPFilter) SetAllowList(entries []string) error {
+	parsed, err := parseIPFilterEntries(entries)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.allow = addIPFilterEntries(nil, parsed)
+	return nil
+}
+
+// SetDenyList replaces the denylist, it is unchanged if one of the entries is invalid
+func (f *IPFilter) SetDenyList(entries []string) error {
+	parsed, err := parseIPFilterEntries(entries)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deny = addIPFilterEntries(nil, parsed)
+	return nil
+}
+
+func (f *IPFilter) AllowList() []string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return ipFilterEntriesToStrings(f.allow)
+}
+
+func (f *IPFilter) DenyList() []string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return ipFilterEntriesToStrings(f.deny)
+}
+
+// Permits is true if connections from the address are accepted
+func (f *IPFilter) Permits(ip string) bool {
+	permitted, _ := f.check(ip)
+	return permitted
+}
+
+// check tells if the address is accepted and otherwise why not. Addresses that can not be parsed
+// (e.g. unix sockets) are accepted unless there is an allowlist.
+func (f *IPFilter) check(ip string) (bool, RejectReason) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	address := net.ParseIP(ip)
+	if address == nil {
+		if len(f.allow) > 0 {
+			return false, RejectNotAllowed
+		}
+		return true, ""
+	}
+
+	denied := ipFilterEntriesContain(f.deny, address)
+	allowed := ipFilterEntriesContain(f.allow, address)
+
+	if denied && (!allowed || f.policy != AllowWins) {
+		return false, RejectBlacklisted
+	}
+	if len(f.allow) > 0 && !allowed {
+		return false, RejectNotAllowed
+	}
+	return true, ""
+}
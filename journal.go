@@ -0,0 +1,387 @@
+package bloodlabnet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrInvalidJournal = errors.New("invalid inbound journal")
+
+// the operations of the inbound journal
+const (
+	journalReceived = "received"
+	// journalExtended appends the continuation of a message to its received entry
+	journalExtended = "extended"
+	journalHandled  = "handled"
+	// journalLast keeps the last ID in an empty journal, so that IDs are not reused
+	journalLast = "last"
+)
+
+// JournalEntry is a received message that was not handled yet
+type JournalEntry struct {
+	ID       uint64
+	Peer     string
+	Data     []byte
+	Received time.Time
+}
+
+type journalRecord struct {
+	Operation string    `json:"op"`
+	ID        uint64    `json:"id"`
+	Peer      string    `json:"peer,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// InboundJournal records the received messages in a file before the protocol acknowledges them to the
+// instrument (see TCPServerConfiguration.InboundJournal). An entry is handled when DataReceived returned
+// nil. The server passes the entries that were not handled, e.g. because the process crashed, to the
+// handler again when it starts. A message may therefore be passed to the handler twice.
+type InboundJournal struct {
+	path    string
+	mutex   sync.Mutex
+	file    *os.File
+	lastID  uint64
+	entries map[uint64]*JournalEntry
+}
+
+// OpenInboundJournal opens the journal file or creates it
+func OpenInboundJournal(path string) (*InboundJournal, error) {
+	journal := &InboundJournal{
+		path:    path,
+		entries: make(map[uint64]*JournalEntry),
+	}
+
+	err := readJournal(path, func(line []byte, lineNumber int) error {
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("%w: %s line %d - %s", ErrInvalidJournal, path, lineNumber, err)
+		}
+		if record.ID > journal.lastID {
+			journal.lastID = record.ID
+		}
+		switch record.Operation {
+		case journalReceived:
+			journal.entries[record.ID] = &JournalEntry{ID: record.ID, Peer: record.Peer, Data: record.Data, Received: record.Time}
+		case journalExtended:
+			if entry, ok := journal.entries[record.ID]; ok {
+				entry.Data = append(entry.Data, record.Data...)
+			}
+		case journalHandled:
+			delete(journal.entries, record.ID)
+		case journalLast:
+		default:
+			return fmt.Errorf("%w: %s line %d - unknown operation %q", ErrInvalidJournal, path, lineNumber, record.Operation)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := []interface{}{journalRecord{Operation: journalLast, ID: journal.lastID, Time: time.Now()}}
+	for _, entry := range journal.Unhandled() {
+		records = append(records, journalRecord{Operation: journalReceived, ID: entry.ID, Peer: entry.Peer,
+			Data: entry.Data, Time: entry.Received})
+	}
+	if journal.file, err = rewriteJournal(path, records); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+// Unhandled returns the entries that were not handled, the oldest first
+func (journal *InboundJournal) Unhandled() []JournalEntry {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	entries := make([]JournalEntry, 0, len(journal.entries))
+	for _, entry := range journal.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// Close closes the file, the unhandled entries are kept
+func (journal *InboundJournal) Close() error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if journal.file == nil {
+		return nil
+	}
+	err := journal.file.Close()
+	journal.file = nil
+	return err
+}
+
+func (journal *InboundJournal) record(peer string, data []byte) (uint64, error) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if journal.file == nil {
+		return 0, os.ErrClosed
+	}
+	entry := &JournalEntry{ID: journal.lastID + 1, Peer: peer, Data: append([]byte(nil), data...), Received: time.Now()}
+	err := appendJournalRecord(journal.file, journalRecord{Operation: journalReceived, ID: entry.ID, Peer: peer,
+		Data: entry.Data, Time: entry.Received})
+	if err != nil {
+		return 0, err
+	}
+	journal.lastID = entry.ID
+	journal.entries[entry.ID] = entry
+	return entry.ID, nil
+}
+
+func (journal *InboundJournal) extend(id uint64, data []byte) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if journal.file == nil {
+		return os.ErrClosed
+	}
+	entry, ok := journal.entries[id]
+	if !ok {
+		return fmt.Errorf("journal entry %d does not exist", id)
+	}
+	// the record holds the continuation only, it is appended to the data when the journal is read
+	if err := appendJournalRecord(journal.file, journalRecord{Operation: journalExtended, ID: id, Data: data, Time: time.Now()}); err != nil {
+		return err
+	}
+	entry.Data = append(entry.Data[:len(entry.Data):len(entry.Data)], data...)
+	return nil
+}
+
+func (journal *InboundJournal) handled(id uint64) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if _, ok := journal.entries[id]; !ok || journal.file == nil {
+		return
+	}
+	if err := appendJournalRecord(journal.file, journalRecord{Operation: journalHandled, ID: id, Time: time.Now()}); err != nil {
+		// the entry is passed to the handler again after a restart
+		log.Error().Err(err).Uint64("entry", id).Msg("handled message not written to the inbound journal")
+		return
+	}
+	delete(journal.entries, id)
+
+	if len(journal.entries) == 0 {
+		// nothing is unhandled, the journal can start over
+		err := journal.file.Truncate(0)
+		if err == nil {
+			err = appendJournalRecord(journal.file, journalRecord{Operation: journalLast, ID: journal.lastID, Time: time.Now()})
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("inbound journal not truncated")
+		}
+	}
+}
+
+// replay passes the unhandled entries to the handler, see replayedSession
+func (journal *InboundJournal) replay(handler Handler) {
+	for _, entry := range journal.Unhandled() {
+		log.Info().Str("ip", entry.Peer).Uint64("entry", entry.ID).Msg("passing an unhandled message of the inbound journal to the handler")
+		if err := handler.DataReceived(&replayedSession{entry: entry}, entry.Data, entry.Received); err != nil {
+			log.Warn().Err(err).Str("ip", entry.Peer).Uint64("entry", entry.ID).Msg("the handler failed on a message of the inbound journal, it is kept")
+			continue
+		}
+		journal.handled(entry.ID)
+	}
+}
+
+// sessionJournal records the messages of a session, it is the protocol.Journal of the session
+type sessionJournal struct {
+	journal *InboundJournal
+	peer    string
+	mutex   sync.Mutex
+	// recorded are the messages that were not passed to the handler yet, in the order they were received
+	recorded []JournalEntry
+}
+
+func newSessionJournal(journal *InboundJournal, peer string) *sessionJournal {
+	if journal == nil {
+		return nil
+	}
+	return &sessionJournal{journal: journal, peer: peer}
+}
+
+func (sj *sessionJournal) Record(data []byte, extends bool) error {
+	sj.mutex.Lock()
+	defer sj.mutex.Unlock()
+	if extends && len(sj.recorded) > 0 {
+		last := &sj.recorded[len(sj.recorded)-1]
+		if err := sj.journal.extend(last.ID, data); err != nil {
+			return err
+		}
+		last.Data = append(last.Data[:len(last.Data):len(last.Data)], data...)
+		return nil
+	}
+	id, err := sj.journal.record(sj.peer, data)
+	if err != nil {
+		return err
+	}
+	sj.recorded = append(sj.recorded, JournalEntry{ID: id, Data: append([]byte(nil), data...)})
+	return nil
+}
+
+// received marks the entry of the message handled if the handler succeeded, or if the protocol refused the
+// message to the peer, which sends it again. Recorded messages before it were acknowledged but not passed to
+// the handler, e.g. an aborted transfer, and stay unhandled.
+func (sj *sessionJournal) received(data []byte, handlerErr error, refused bool) {
+	if sj == nil {
+		return
+	}
+	sj.mutex.Lock()
+	defer sj.mutex.Unlock()
+	for i, entry := range sj.recorded {
+		if !bytes.Equal(entry.Data, data) {
+			continue
+		}
+		for _, skipped := range sj.recorded[:i] {
+			log.Warn().Str("ip", sj.peer).Uint64("entry", skipped.ID).Msg("acknowledged message was not passed to the handler, it is kept in the inbound journal")
+		}
+		sj.recorded = sj.recorded[i+1:]
+		if handlerErr == nil || refused {
+			sj.journal.handled(entry.ID)
+		}
+		return
+	}
+}
+
+// replayedSession is the session of a message of the journal. It is not connected: IsAlive is false, Send
+// fails, ID is 0 and ConnectTime is the time the message was received. RemoteAddress is the address of
+// the instrument that sent the message.
+type replayedSession struct {
+	entry      JournalEntry
+	attributes Attributes
+}
+
+func (session *replayedSession) IsAlive() bool {
+	return false
+}
+
+func (session *replayedSession) Send(msg [][]byte) (int, error) {
+	return 0, ErrSessionClosed
+}
+
+func (session *replayedSession) Enqueue(msg [][]byte) (<-chan SendResult, error) {
+	return nil, ErrSessionClosed
+}
+
+func (session *replayedSession) Receive() ([]byte, error) {
+	return nil, ErrSessionClosed
+}
+
+func (session *replayedSession) Close() error {
+	return nil
+}
+
+func (session *replayedSession) WaitTermination() error {
+	return nil
+}
+
+func (session *replayedSession) RemoteAddress() (string, error) {
+	return session.entry.Peer, nil
+}
+
+func (session *replayedSession) ID() uint64 {
+	return 0
+}
+
+func (session *replayedSession) ConnectTime() time.Time {
+	return session.entry.Received
+}
+
+func (session *replayedSession) LocalAddr() net.Addr {
+	return nil
+}
+
+func (session *replayedSession) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (session *replayedSession) ProxySource() net.Addr {
+	return nil
+}
+
+func (session *replayedSession) Attributes() *Attributes {
+	return &session.attributes
+}
+
+func (session *replayedSession) Context() context.Context {
+	return context.Background()
+}
+
+// appendJournalRecord writes the record as a line of JSON and syncs the file to the disk
+func appendJournalRecord(file *os.File, record interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readJournal calls read for every line of the file, a missing file has no lines. A partly written last
+// line is the result of a crash during the write and is ignored.
+func readJournal(path string, read func(line []byte, lineNumber int) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Warn().Str("file", path).Int("line", lineNumber).Msg("ignoring the incomplete last entry of the journal")
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := read(line, lineNumber); err != nil {
+			return err
+		}
+	}
+}
+
+// rewriteJournal replaces the file with the records and opens it for appending
+func rewriteJournal(path string, records []interface{}) (*os.File, error) {
+	temporaryPath := path + ".tmp"
+	file, err := os.OpenFile(temporaryPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if err := appendJournalRecord(file, record); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(temporaryPath, path); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+}
@@ -0,0 +1,55 @@
+package bloodlabnet
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// KeepAliveConfiguration enables the TCP keepalive probes of the operating system to detect
+// peers that disappeared without closing the connection, e.g. after a pulled cable
+type KeepAliveConfiguration struct {
+	// Idle is the time without traffic until the first probe, 0 leaves the keepalive as it is
+	Idle time.Duration
+	// Interval is the time between the probes, 0 for the default of the system (linux only)
+	Interval time.Duration
+	// Count is the number of unanswered probes until the connection is dropped, 0 for the default
+	// of the system (linux only)
+	Count int
+}
+
+func (k KeepAliveConfiguration) enabled() bool {
+	return k.Idle > 0
+}
+
+// applyKeepAlive configures the keepalive of the TCP connection below conn
+func applyKeepAlive(conn net.Conn, keepAlive KeepAliveConfiguration) error {
+	if !keepAlive.enabled() {
+		return nil
+	}
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		return errors.New("keepalive requires a tcp connection")
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := tcpConn.SetKeepAlivePeriod(keepAlive.Idle); err != nil {
+		return err
+	}
+	return setKeepAliveProbes(tcpConn, keepAlive.Interval, keepAlive.Count)
+}
+
+// tcpConnOf unwraps the connections of the proxy protocol
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ Raw() net.Conn }:
+			conn = c.Raw()
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package bloodlabnet
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	if interval <= 0 && count <= 0 {
+		return nil
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if interval > 0 {
+			seconds := int(interval / time.Second)
+			if seconds < 1 {
+				seconds = 1
+			}
+			if sockoptErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, seconds); sockoptErr != nil {
+				return
+			}
+		}
+		if count > 0 {
+			sockoptErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockoptErr
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package bloodlabnet
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:4026")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:4026")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	err = applyKeepAlive(conn, KeepAliveConfiguration{Idle: time.Minute, Interval: 10 * time.Second, Count: 3})
+	assert.Nil(t, err)
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	assert.Nil(t, err)
+	rawConn.Control(func(fd uintptr) {
+		keepAlive, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		idle, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		interval, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+		count, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+		assert.Equal(t, 1, keepAlive)
+		assert.Equal(t, 60, idle)
+		assert.Equal(t, 10, interval)
+		assert.Equal(t, 3, count)
+	})
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package bloodlabnet
+
+import (
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// setKeepAliveProbes is only available on linux, elsewhere the interval is the idle time of
+// SetKeepAlivePeriod and the count the default of the system
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	if interval > 0 || count > 0 {
+		log.Debug().Msg("keepalive interval and count are not supported on this platform")
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package bloodlabnet
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol"
+)
+
+var errSessionClosing = errors.New("the session is closing")
+
+// sessionLimitsBusyRetry is how often an expired session checks whether the protocol finished its transfer
+const sessionLimitsBusyRetry = time.Second
+
+// sessionLimits closes a session after IdleTimeout without messages or after MaxSessionLifetime. The
+// session is closed between transfers only: while Send is running or the protocol is busy (see
+// protocol.BusyReporter) closing waits.
+type sessionLimits struct {
+	idleTimeout        time.Duration
+	maxSessionLifetime time.Duration
+	lowLevelProtocol   protocol.Implementation
+	stats              *sessionStats
+	connectTime        time.Time
+	// sending is held by Send
+	sending  sync.Locker
+	closing  int32
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// startSessionLimits calls expired with the reason when a limit is reached. It returns nil if there are no limits.
+func startSessionLimits(idleTimeout, maxSessionLifetime time.Duration, lowLevelProtocol protocol.Implementation,
+	stats *sessionStats, connectTime time.Time, sending sync.Locker, expired func(reason DisconnectReason)) *sessionLimits {
+
+	if idleTimeout <= 0 && maxSessionLifetime <= 0 {
+		return nil
+	}
+	sl := &sessionLimits{
+		idleTimeout:        idleTimeout,
+		maxSessionLifetime: maxSessionLifetime,
+		lowLevelProtocol:   lowLevelProtocol,
+		stats:              stats,
+		connectTime:        connectTime,
+		sending:            sending,
+		stop:               make(chan struct{}),
+	}
+	go sl.run(expired)
+	return sl
+}
+
+// check returns the reason if a limit is reached, otherwise the time until the next limit
+func (sl *sessionLimits) check(now time.Time) (DisconnectReason, time.Duration) {
+	wait := time.Duration(-1)
+	if sl.maxSessionLifetime > 0 {
+		remaining := sl.maxSessionLifetime - now.Sub(sl.connectTime)
+		if remaining <= 0 {
+			return DisconnectMaxLifetime, 0
+		}
+		wait = remaining
+	}
+	if sl.idleTimeout > 0 {
+		remaining := sl.idleTimeout - now.Sub(sl.stats.lastMessageTime(sl.connectTime))
+		if remaining <= 0 {
+			return DisconnectIdleTimeout, 0
+		}
+		if wait < 0 || remaining < wait {
+			wait = remaining
+		}
+	}
+	return "", wait
+}
+
+func (sl *sessionLimits) run(expired func(reason DisconnectReason)) {
+	for {
+		reason, wait := sl.check(time.Now())
+		if reason != "" {
+			if sl.startClosing() {
+				expired(reason)
+				return
+			}
+			wait = sessionLimitsBusyRetry
+		}
+		select {
+		case <-sl.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// startClosing refuses further sends unless a transfer is running
+func (sl *sessionLimits) startClosing() bool {
+	sl.sending.Lock()
+	defer sl.sending.Unlock()
+	if busyReporter, ok := sl.lowLevelProtocol.(protocol.BusyReporter); ok && busyReporter.Busy() {
+		return false
+	}
+	atomic.StoreInt32(&sl.closing, 1)
+	return true
+}
+
+// isClosing is true once a limit closes the session, Send must not start a transfer then.
+// It may be called on nil.
+func (sl *sessionLimits) isClosing() bool {
+	return sl != nil && atomic.LoadInt32(&sl.closing) == 1
+}
+
+// Stop may be called on nil and more than once
+func (sl *sessionLimits) Stop() {
+	if sl == nil {
+		return
+	}
+	sl.stopOnce.Do(func() { close(sl.stop) })
+}
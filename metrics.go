@@ -0,0 +1,113 @@
+package bloodlabnet
+
+import (
+	"net"
+	"time"
+)
+
+// RejectReason tells why the server closed a connection right after accepting it
+type RejectReason string
+
+const (
+	RejectBlacklisted         RejectReason = "blacklisted"
+	RejectNotAllowed          RejectReason = "not_allowed"
+	RejectMaxConnections      RejectReason = "max_connections"
+	RejectMaxConnectionsPerIP RejectReason = "max_connections_per_ip"
+	RejectRateLimited         RejectReason = "rate_limited"
+)
+
+// MetricsRecorder receives the measurements of servers, their sessions and clients, e.g. the
+// metrics.Collector for prometheus. The methods are called concurrently from all sessions.
+type MetricsRecorder interface {
+	// SessionOpened and SessionClosed are called once for every session
+	SessionOpened(remoteIP string)
+	SessionClosed(remoteIP string)
+	// ConnectionRejected is called for connections that were closed by the server before a session started
+	ConnectionRejected(remoteIP string, reason RejectReason)
+	// BytesReceived and BytesSent count the traffic on the connection including the protocol
+	BytesReceived(remoteIP string, n int)
+	BytesSent(remoteIP string, n int)
+	// MessageReceived and MessageSent count the messages passed to and from the protocol
+	MessageReceived(remoteIP string, size int)
+	MessageSent(remoteIP string, size int)
+	// MessageHandled is the time the DataReceived handler took for a message
+	MessageHandled(remoteIP string, duration time.Duration)
+	// Error is called for every error passed to the Error handler
+	Error(remoteIP string, errorType ErrorType)
+}
+
+// meteredConn counts the bytes read and written for the metrics and the statistics of the session,
+// both are optional
+type meteredConn struct {
+	net.Conn
+	metrics  MetricsRecorder
+	stats    *sessionStats
+	remoteIP string
+}
+
+func (mc *meteredConn) Read(b []byte) (int, error) {
+	n, err := mc.Conn.Read(b)
+	if n > 0 {
+		if mc.metrics != nil {
+			mc.metrics.BytesReceived(mc.remoteIP, n)
+		}
+		mc.stats.bytesReceived(n)
+	}
+	return n, err
+}
+
+func (mc *meteredConn) Write(b []byte) (int, error) {
+	n, err := mc.Conn.Write(b)
+	if n > 0 {
+		if mc.metrics != nil {
+			mc.metrics.BytesSent(mc.remoteIP, n)
+		}
+		mc.stats.bytesSent(n)
+	}
+	return n, err
+}
+
+// meteredHandler measures the DataReceived handler and counts the errors
+type meteredHandler struct {
+	Handler
+	metrics MetricsRecorder
+}
+
+func (mh *meteredHandler) DataReceived(session Session, data []byte, receiveTimestamp time.Time) error {
+	start := time.Now()
+	err := mh.Handler.DataReceived(session, data, receiveTimestamp)
+	mh.metrics.MessageHandled(sessionRemoteIP(session), time.Since(start))
+	return err
+}
+
+func (mh *meteredHandler) Error(session Session, typeOfError ErrorType, err error) {
+	mh.metrics.Error(sessionRemoteIP(session), typeOfError)
+	mh.Handler.Error(session, typeOfError, err)
+}
+
+func (mh *meteredHandler) DisconnectedWithReason(session Session, reason DisconnectReason) {
+	notifyDisconnected(mh.Handler, session, reason)
+}
+
+func withMetrics(handler Handler, metrics MetricsRecorder) Handler {
+	if handler == nil || metrics == nil {
+		return handler
+	}
+	return &meteredHandler{Handler: handler, metrics: metrics}
+}
+
+func sessionRemoteIP(session Session) string {
+	if session == nil {
+		return ""
+	}
+	remoteIP, _ := session.RemoteAddress()
+	return remoteIP
+}
+
+func messageSize(data [][]byte) int {
+	size := 0
+	for _, line := range data {
+		size += len(line)
+	}
+	return size
+}
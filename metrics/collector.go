@@ -0,0 +1,164 @@
+// Package metrics provides a prometheus collector for servers, clients and protocols of bloodlabnet
+package metrics
+
+import (
+	"net"
+	"time"
+
+	bloodlabnet "github.com/blutspende/go-bloodlab-net"
+	"github.com/blutspende/go-bloodlab-net/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements bloodlabnet.MetricsRecorder and protocol.EventReporter and exposes the
+// measurements as prometheus.Collector
+//
+//	collector := metrics.NewCollector("bloodlabnet")
+//	prometheus.MustRegister(collector)
+//
+//	settings := bloodlabnet.DefaultTCPServerSettings
+//	settings.Metrics = collector
+//	protocol.Lis1A1Protocol(protocol.DefaultLis1A1ProtocolSettings().SetEventReporter(collector))
+type Collector struct {
+	sessionsActive      prometheus.Gauge
+	sessionsTotal       prometheus.Counter
+	connectionsRejected *prometheus.CounterVec
+	bytesReceived       *prometheus.CounterVec
+	bytesSent           *prometheus.CounterVec
+	messagesReceived    *prometheus.CounterVec
+	messagesSent        *prometheus.CounterVec
+	errors              *prometheus.CounterVec
+	protocolEvents      *prometheus.CounterVec
+	messageSize         *prometheus.HistogramVec
+	messageHandling     prometheus.Histogram
+}
+
+// NewCollector creates the metrics with the namespace as prefix, e.g. bloodlabnet_sessions_active
+func NewCollector(namespace string) *Collector {
+	return &Collector{
+		sessionsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sessions_active",
+			Help:      "Number of open sessions.",
+		}),
+		sessionsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_total",
+			Help:      "Number of sessions since the start.",
+		}),
+		connectionsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_rejected_total",
+			Help:      "Connections closed by the server before a session started.",
+		}, []string{"reason"}),
+		bytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "received_bytes_total",
+			Help:      "Bytes received including the protocol.",
+		}, []string{"remote_ip"}),
+		bytesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sent_bytes_total",
+			Help:      "Bytes sent including the protocol.",
+		}, []string{"remote_ip"}),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "received_messages_total",
+			Help:      "Messages received by the protocol.",
+		}, []string{"remote_ip"}),
+		messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sent_messages_total",
+			Help:      "Messages sent by the protocol.",
+		}, []string{"remote_ip"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Errors passed to the handler.",
+		}, []string{"type"}),
+		protocolEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "protocol_events_total",
+			Help:      "NAKs, retries, timeouts and checksum errors of the protocols.",
+		}, []string{"remote_ip", "event"}),
+		messageSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "message_size_bytes",
+			Help:      "Size of the messages.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8), // 64 bytes to 1 MiB
+		}, []string{"direction"}),
+		messageHandling: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "message_handling_seconds",
+			Help:      "Duration of the DataReceived handler.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.sessionsActive, c.sessionsTotal, c.connectionsRejected,
+		c.bytesReceived, c.bytesSent, c.messagesReceived, c.messagesSent,
+		c.errors, c.protocolEvents, c.messageSize, c.messageHandling,
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+func (c *Collector) SessionOpened(remoteIP string) {
+	c.sessionsActive.Inc()
+	c.sessionsTotal.Inc()
+}
+
+func (c *Collector) SessionClosed(remoteIP string) {
+	c.sessionsActive.Dec()
+}
+
+func (c *Collector) ConnectionRejected(remoteIP string, reason bloodlabnet.RejectReason) {
+	c.connectionsRejected.WithLabelValues(string(reason)).Inc()
+}
+
+func (c *Collector) BytesReceived(remoteIP string, n int) {
+	c.bytesReceived.WithLabelValues(remoteIP).Add(float64(n))
+}
+
+func (c *Collector) BytesSent(remoteIP string, n int) {
+	c.bytesSent.WithLabelValues(remoteIP).Add(float64(n))
+}
+
+func (c *Collector) MessageReceived(remoteIP string, size int) {
+	c.messagesReceived.WithLabelValues(remoteIP).Inc()
+	c.messageSize.WithLabelValues("in").Observe(float64(size))
+}
+
+func (c *Collector) MessageSent(remoteIP string, size int) {
+	c.messagesSent.WithLabelValues(remoteIP).Inc()
+	c.messageSize.WithLabelValues("out").Observe(float64(size))
+}
+
+func (c *Collector) MessageHandled(remoteIP string, duration time.Duration) {
+	c.messageHandling.Observe(duration.Seconds())
+}
+
+func (c *Collector) Error(remoteIP string, errorType bloodlabnet.ErrorType) {
+	c.errors.WithLabelValues(errorType.String()).Inc()
+}
+
+func (c *Collector) ProtocolEvent(remoteAddr string, event protocol.ProtocolEvent) {
+	remoteIP := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteIP = host
+	}
+	c.protocolEvents.WithLabelValues(remoteIP, string(event)).Inc()
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	bloodlabnet "github.com/blutspende/go-bloodlab-net"
+	"github.com/blutspende/go-bloodlab-net/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	collector := NewCollector("bloodlabnet")
+
+	collector.SessionOpened("192.168.1.10")
+	collector.SessionOpened("192.168.1.11")
+	collector.SessionClosed("192.168.1.11")
+	collector.ConnectionRejected("10.0.0.1", bloodlabnet.RejectBlacklisted)
+	collector.BytesReceived("192.168.1.10", 100)
+	collector.BytesReceived("192.168.1.10", 20)
+	collector.MessageReceived("192.168.1.10", 120)
+	collector.MessageHandled("192.168.1.10", 10*time.Millisecond)
+	collector.Error("192.168.1.10", bloodlabnet.ErrorReceive)
+	collector.ProtocolEvent("192.168.1.10:4001", protocol.EventNAKSent)
+	collector.ProtocolEvent("192.168.1.10:4001", protocol.EventNAKSent)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.sessionsActive))
+	assert.Equal(t, 2.0, testutil.ToFloat64(collector.sessionsTotal))
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.connectionsRejected.WithLabelValues("blacklisted")))
+	assert.Equal(t, 120.0, testutil.ToFloat64(collector.bytesReceived.WithLabelValues("192.168.1.10")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.messagesReceived.WithLabelValues("192.168.1.10")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.errors.WithLabelValues("receive")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(collector.protocolEvents.WithLabelValues("192.168.1.10", "nak_sent")))
+
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(collector))
+	err := testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP bloodlabnet_sessions_active Number of open sessions.
+# TYPE bloodlabnet_sessions_active gauge
+bloodlabnet_sessions_active 1
+`), "bloodlabnet_sessions_active")
+	assert.Nil(t, err)
+}
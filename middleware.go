@@ -0,0 +1,130 @@
+package bloodlabnet
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrHandlerPanic is returned by the handler of RecoverPanics when DataReceived or Connected panicked
+var ErrHandlerPanic = errors.New("handler panicked")
+
+// Middleware wraps the next handler of a chain, see Chain. A middleware embeds next and overrides the
+// events it intercepts, e.g. DataReceived to change the payload before it calls next or to drop it by
+// returning nil without calling next. It implements DisconnectReasonHandler to pass the reason on.
+type Middleware func(next Handler) Handler
+
+// Chain wraps the handler in the middlewares, the first middleware sees every event first
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// HandlerEvent names the events of a Handler
+type HandlerEvent string
+
+const (
+	HandlerConnected    HandlerEvent = "connected"
+	HandlerDataReceived HandlerEvent = "data_received"
+	HandlerDisconnected HandlerEvent = "disconnected"
+	HandlerError        HandlerEvent = "error"
+)
+
+// RecoverPanics recovers a panic of the next handler, which otherwise ends the process. A panic in
+// DataReceived or Connected is returned as ErrHandlerPanic, the message is refused or the connection is
+// declined. A panic in Disconnected or Error is logged.
+func RecoverPanics() Middleware {
+	return func(next Handler) Handler {
+		return &recoveringHandler{Handler: next}
+	}
+}
+
+type recoveringHandler struct {
+	Handler
+}
+
+func (rh *recoveringHandler) recoverPanic(session Session, event HandlerEvent, err *error) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	log.Error().Str("ip", sessionRemoteIP(session)).Str("event", string(event)).Str("stack", string(debug.Stack())).
+		Msgf("handler panicked: %v", recovered)
+	if err != nil {
+		*err = fmt.Errorf("%w: %v", ErrHandlerPanic, recovered)
+	}
+}
+
+func (rh *recoveringHandler) DataReceived(session Session, data []byte, receiveTimestamp time.Time) (err error) {
+	defer rh.recoverPanic(session, HandlerDataReceived, &err)
+	return rh.Handler.DataReceived(session, data, receiveTimestamp)
+}
+
+func (rh *recoveringHandler) Connected(session Session) (err error) {
+	defer rh.recoverPanic(session, HandlerConnected, &err)
+	return rh.Handler.Connected(session)
+}
+
+func (rh *recoveringHandler) Disconnected(session Session) {
+	defer rh.recoverPanic(session, HandlerDisconnected, nil)
+	rh.Handler.Disconnected(session)
+}
+
+func (rh *recoveringHandler) DisconnectedWithReason(session Session, reason DisconnectReason) {
+	defer rh.recoverPanic(session, HandlerDisconnected, nil)
+	notifyDisconnected(rh.Handler, session, reason)
+}
+
+func (rh *recoveringHandler) Error(session Session, typeOfError ErrorType, err error) {
+	defer rh.recoverPanic(session, HandlerError, nil)
+	rh.Handler.Error(session, typeOfError, err)
+}
+
+// TimingObserver receives the time the next handler took for an event
+type TimingObserver func(session Session, event HandlerEvent, duration time.Duration)
+
+// TimeHandler measures every call of the next handler
+func TimeHandler(observer TimingObserver) Middleware {
+	return func(next Handler) Handler {
+		return &timedHandler{Handler: next, observer: observer}
+	}
+}
+
+type timedHandler struct {
+	Handler
+	observer TimingObserver
+}
+
+func (th *timedHandler) DataReceived(session Session, data []byte, receiveTimestamp time.Time) error {
+	defer th.observe(session, HandlerDataReceived, time.Now())
+	return th.Handler.DataReceived(session, data, receiveTimestamp)
+}
+
+func (th *timedHandler) Connected(session Session) error {
+	defer th.observe(session, HandlerConnected, time.Now())
+	return th.Handler.Connected(session)
+}
+
+func (th *timedHandler) Disconnected(session Session) {
+	defer th.observe(session, HandlerDisconnected, time.Now())
+	th.Handler.Disconnected(session)
+}
+
+func (th *timedHandler) DisconnectedWithReason(session Session, reason DisconnectReason) {
+	defer th.observe(session, HandlerDisconnected, time.Now())
+	notifyDisconnected(th.Handler, session, reason)
+}
+
+func (th *timedHandler) Error(session Session, typeOfError ErrorType, err error) {
+	defer th.observe(session, HandlerError, time.Now())
+	th.Handler.Error(session, typeOfError, err)
+}
+
+func (th *timedHandler) observe(session Session, event HandlerEvent, start time.Time) {
+	th.observer(session, event, time.Since(start))
+}
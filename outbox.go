@@ -0,0 +1,422 @@
+package bloodlabnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrOutboxClosed  = errors.New("the outbox is closed")
+	ErrInvalidOutbox = errors.New("invalid outbox journal")
+)
+
+// the operations of the journal
+const (
+	outboxPut     = "put"
+	outboxAttempt = "attempt"
+	outboxDone    = "done"
+	// outboxLast keeps the last ID in an empty journal, so that IDs are not reused
+	outboxLast = "last"
+)
+
+type OutboxSettings struct {
+	maxAttempts   int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+	resultHandler OutboxResultHandler
+}
+
+func DefaultOutboxSettings() *OutboxSettings {
+	return &OutboxSettings{
+		maxAttempts:   10,
+		retryDelay:    time.Second,
+		maxRetryDelay: time.Minute,
+	}
+}
+
+// SetMaxAttempts gives up on a message after the failed sends. 0 = retry until it is delivered, default is 10
+func (s OutboxSettings) SetMaxAttempts(maxAttempts int) *OutboxSettings {
+	s.maxAttempts = maxAttempts
+	return &s
+}
+
+// SetRetryDelay sets the wait after the first failed send, it doubles with every further failure up to
+// maxRetryDelay. Default is 1 second up to 1 minute
+func (s OutboxSettings) SetRetryDelay(retryDelay, maxRetryDelay time.Duration) *OutboxSettings {
+	s.retryDelay = retryDelay
+	s.maxRetryDelay = maxRetryDelay
+	return &s
+}
+
+// SetResultHandler receives the final outcome of every message
+func (s OutboxSettings) SetResultHandler(resultHandler OutboxResultHandler) *OutboxSettings {
+	s.resultHandler = resultHandler
+	return &s
+}
+
+// OutboxResult is the final outcome of a message, Err is nil if it was delivered, otherwise the error of
+// the last attempt
+type OutboxResult struct {
+	ID       uint64
+	Peer     string
+	Data     [][]byte
+	Queued   time.Time
+	Attempts int
+	Err      error
+}
+
+type OutboxResultHandler func(result OutboxResult)
+
+type outboxRecord struct {
+	Operation string    `json:"op"`
+	ID        uint64    `json:"id"`
+	Peer      string    `json:"peer,omitempty"`
+	Data      [][]byte  `json:"data,omitempty"`
+	Time      time.Time `json:"time"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type outboxMessage struct {
+	id       uint64
+	peer     string
+	data     [][]byte
+	queued   time.Time
+	attempts int
+}
+
+type outboxPeer struct {
+	messages []*outboxMessage
+	// signal wakes the delivery up for a new message
+	signal chan struct{}
+	// delivering is held by the one session of the peer that delivers
+	delivering chan struct{}
+}
+
+// Outbox keeps the messages for instruments that are not connected in a journal file and delivers them in
+// order when the instrument connects (see TCPServerConfiguration.Outbox). The instrument is identified by
+// the PeerIdentity of its session, by default its IP address. A message stays in the outbox until it was
+// sent or SetMaxAttempts gave up on it, also across restarts of the process. A message may be sent again
+// if the process stopped between the send and the journal entry.
+type Outbox struct {
+	settings *OutboxSettings
+	path     string
+	mutex    sync.Mutex
+	file     *os.File
+	lastID   uint64
+	peers    map[string]*outboxPeer
+	closed   chan struct{}
+}
+
+// OpenOutbox opens the journal file or creates it. The messages in the file are queued again.
+func OpenOutbox(path string, settings ...*OutboxSettings) (*Outbox, error) {
+	var theSettings *OutboxSettings
+	if len(settings) >= 1 {
+		theSettings = settings[0]
+	} else {
+		theSettings = DefaultOutboxSettings()
+	}
+
+	outbox := &Outbox{
+		settings: theSettings,
+		path:     path,
+		peers:    make(map[string]*outboxPeer),
+		closed:   make(chan struct{}),
+	}
+	if err := outbox.load(); err != nil {
+		return nil, err
+	}
+	if err := outbox.compact(); err != nil {
+		return nil, err
+	}
+	return outbox, nil
+}
+
+// Put queues a message for the peer and returns its ID, it is written to the journal before Put returns
+func (outbox *Outbox) Put(peer string, data [][]byte) (uint64, error) {
+	copied := make([][]byte, len(data))
+	for i := range data {
+		copied[i] = append([]byte(nil), data[i]...)
+	}
+
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	if outbox.file == nil {
+		return 0, ErrOutboxClosed
+	}
+	message := &outboxMessage{id: outbox.lastID + 1, peer: peer, data: copied, queued: time.Now()}
+	if err := outbox.write(outboxRecord{Operation: outboxPut, ID: message.id, Peer: peer, Data: copied, Time: message.queued}); err != nil {
+		return 0, err
+	}
+	outbox.lastID = message.id
+	p := outbox.peer(peer)
+	p.messages = append(p.messages, message)
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+	return message.id, nil
+}
+
+// Pending is the number of messages for the peer that were not delivered yet
+func (outbox *Outbox) Pending(peer string) int {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	if p, ok := outbox.peers[peer]; ok {
+		return len(p.messages)
+	}
+	return 0
+}
+
+// Close stops the deliveries, the pending messages stay in the journal
+func (outbox *Outbox) Close() error {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	if outbox.file == nil {
+		return nil
+	}
+	close(outbox.closed)
+	err := outbox.file.Close()
+	outbox.file = nil
+	return err
+}
+
+// deliver sends the messages of the peer through enqueue until the session is closed, see Session.Enqueue.
+// Only one session of a peer delivers at a time, a second one waits until the first ended.
+func (outbox *Outbox) deliver(peer string, enqueue func(data [][]byte) (<-chan SendResult, error), sessionClosed <-chan struct{}) {
+	outbox.mutex.Lock()
+	p := outbox.peer(peer)
+	outbox.mutex.Unlock()
+
+	select {
+	case p.delivering <- struct{}{}:
+		defer func() { <-p.delivering }()
+	case <-sessionClosed:
+		return
+	case <-outbox.closed:
+		return
+	}
+
+	retryDelay := outbox.settings.retryDelay
+	wait := func() bool {
+		select {
+		case <-time.After(retryDelay):
+		case <-sessionClosed:
+			return false
+		case <-outbox.closed:
+			return false
+		}
+		if retryDelay *= 2; outbox.settings.maxRetryDelay > 0 && retryDelay > outbox.settings.maxRetryDelay {
+			retryDelay = outbox.settings.maxRetryDelay
+		}
+		return true
+	}
+
+	for {
+		message, ok := outbox.next(p)
+		if !ok {
+			select {
+			case <-p.signal:
+				continue
+			case <-sessionClosed:
+				return
+			case <-outbox.closed:
+				return
+			}
+		}
+
+		result, err := enqueue(message.data)
+		if errors.Is(err, ErrSessionClosed) {
+			return
+		} else if err != nil {
+			// e.g. the send queue is full, that is not an attempt of the message
+			if !wait() {
+				return
+			}
+			continue
+		}
+		sent := <-result
+		if errors.Is(sent.Err, ErrSessionClosed) || errors.Is(sent.Err, errSessionClosing) {
+			return
+		}
+		if sent.Err == nil {
+			outbox.finish(message, nil)
+			retryDelay = outbox.settings.retryDelay
+			continue
+		}
+
+		log.Warn().Err(sent.Err).Str("peer", peer).Uint64("message", message.id).Msg("outbox message not sent")
+		if attempts := outbox.failed(message); outbox.settings.maxAttempts > 0 && attempts >= outbox.settings.maxAttempts {
+			outbox.finish(message, sent.Err)
+			continue
+		}
+		if !wait() {
+			return
+		}
+	}
+}
+
+// next is the oldest message of the peer
+func (outbox *Outbox) next(p *outboxPeer) (*outboxMessage, bool) {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	if outbox.file == nil || len(p.messages) == 0 {
+		return nil, false
+	}
+	return p.messages[0], true
+}
+
+func (outbox *Outbox) failed(message *outboxMessage) int {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	message.attempts++
+	if outbox.file != nil {
+		if err := outbox.write(outboxRecord{Operation: outboxAttempt, ID: message.id, Time: time.Now()}); err != nil {
+			log.Error().Err(err).Uint64("message", message.id).Msg("outbox attempt not written to the journal")
+		}
+	}
+	return message.attempts
+}
+
+func (outbox *Outbox) finish(message *outboxMessage, sendErr error) {
+	result := OutboxResult{
+		ID:       message.id,
+		Peer:     message.peer,
+		Data:     message.data,
+		Queued:   message.queued,
+		Attempts: message.attempts,
+		Err:      sendErr,
+	}
+	if sendErr == nil {
+		result.Attempts++
+	}
+
+	outbox.mutex.Lock()
+	if outbox.file != nil {
+		record := outboxRecord{Operation: outboxDone, ID: message.id, Time: time.Now()}
+		if sendErr != nil {
+			record.Error = sendErr.Error()
+		}
+		if err := outbox.write(record); err != nil {
+			// the message is sent again after a restart
+			log.Error().Err(err).Uint64("message", message.id).Msg("outbox result not written to the journal")
+		}
+	}
+	p := outbox.peer(message.peer)
+	if len(p.messages) > 0 && p.messages[0] == message {
+		p.messages = p.messages[1:]
+	}
+	if outbox.file != nil && outbox.empty() {
+		// nothing is pending, the journal can start over
+		err := outbox.file.Truncate(0)
+		if err == nil {
+			err = outbox.write(outboxRecord{Operation: outboxLast, ID: outbox.lastID, Time: time.Now()})
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("outbox journal not truncated")
+		}
+	}
+	outbox.mutex.Unlock()
+
+	if outbox.settings.resultHandler != nil {
+		outbox.settings.resultHandler(result)
+	}
+}
+
+// peer must be called with the mutex held
+func (outbox *Outbox) peer(peer string) *outboxPeer {
+	p, ok := outbox.peers[peer]
+	if !ok {
+		p = &outboxPeer{signal: make(chan struct{}, 1), delivering: make(chan struct{}, 1)}
+		outbox.peers[peer] = p
+	}
+	return p
+}
+
+func (outbox *Outbox) empty() bool {
+	for _, p := range outbox.peers {
+		if len(p.messages) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// write appends the record to the journal, the mutex must be held
+func (outbox *Outbox) write(record outboxRecord) error {
+	return appendJournalRecord(outbox.file, record)
+}
+
+// load reads the pending messages from the journal
+func (outbox *Outbox) load() error {
+	messages := make(map[uint64]*outboxMessage)
+	order := make([]uint64, 0)
+	err := readJournal(outbox.path, func(line []byte, lineNumber int) error {
+		var record outboxRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("%w: %s line %d - %s", ErrInvalidOutbox, outbox.path, lineNumber, err)
+		}
+		if record.ID > outbox.lastID {
+			outbox.lastID = record.ID
+		}
+		switch record.Operation {
+		case outboxPut:
+			messages[record.ID] = &outboxMessage{id: record.ID, peer: record.Peer, data: record.Data,
+				queued: record.Time, attempts: record.Attempts}
+			order = append(order, record.ID)
+		case outboxAttempt:
+			if message, ok := messages[record.ID]; ok {
+				message.attempts++
+			}
+		case outboxDone:
+			delete(messages, record.ID)
+		case outboxLast:
+		default:
+			return fmt.Errorf("%w: %s line %d - unknown operation %q", ErrInvalidOutbox, outbox.path, lineNumber, record.Operation)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range order {
+		if message, ok := messages[id]; ok {
+			p := outbox.peer(message.peer)
+			p.messages = append(p.messages, message)
+		}
+	}
+	return nil
+}
+
+// compact replaces the journal with the pending messages and opens it for writing
+func (outbox *Outbox) compact() error {
+	records := []interface{}{outboxRecord{Operation: outboxLast, ID: outbox.lastID, Time: time.Now()}}
+	for _, message := range outbox.pending() {
+		records = append(records, outboxRecord{Operation: outboxPut, ID: message.id, Peer: message.peer,
+			Data: message.data, Time: message.queued, Attempts: message.attempts})
+	}
+	file, err := rewriteJournal(outbox.path, records)
+	if err != nil {
+		return err
+	}
+	outbox.file = file
+	return nil
+}
+
+// pending returns the pending messages in the order they were put
+func (outbox *Outbox) pending() []*outboxMessage {
+	messages := make([]*outboxMessage, 0)
+	for _, p := range outbox.peers {
+		messages = append(messages, p.messages...)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].id < messages[j].id })
+	return messages
+}
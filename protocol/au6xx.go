@@ -5,12 +5,16 @@ Implementation of the Beckman&Coulter AU6xx low-level protocol.
 */
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
+	"github.com/rs/zerolog/log"
 )
 
 type AU6XXProtocolSettings struct {
@@ -21,6 +25,8 @@ type AU6XXProtocolSettings struct {
 	lineBreak                byte
 	acknowledgementTimeout   time.Duration
 	realTimeDataTransmission bool
+	transitionObserver       utilities.TransitionObserver
+	acknowledgement          bool
 }
 
 func (s AU6XXProtocolSettings) SetLineBreakByte(lineBreak byte) *AU6XXProtocolSettings {
@@ -74,6 +80,20 @@ func (s AU6XXProtocolSettings) DisableRealTimeDataTransmission() *AU6XXProtocolS
 	return &s
 }
 
+// EnableAcknowledgement holds back the ACK of a request, a real-time message or the end block until the
+// handler returned, a handler error answers it with NAK (see Acknowledger). The handler must answer with
+// Enqueue then, Send fails with ErrAcknowledgementPending while the ACK is held back.
+func (s AU6XXProtocolSettings) EnableAcknowledgement() *AU6XXProtocolSettings {
+	s.acknowledgement = true
+	return &s
+}
+
+// SetTransitionObserver receives every transition of the state machine, e.g. utilities.ZerologTransitionObserver
+func (s AU6XXProtocolSettings) SetTransitionObserver(observer utilities.TransitionObserver) *AU6XXProtocolSettings {
+	s.transitionObserver = observer
+	return &s
+}
+
 func DefaultAU6XXProtocolSettings() *AU6XXProtocolSettings {
 	return &AU6XXProtocolSettings{
 		strictChecksumValidation: false,
@@ -97,9 +117,19 @@ type processState struct {
 
 type au6xxProtocol struct {
 	settings               *AU6XXProtocolSettings
-	receiveThreadIsRunning bool
+	receiveThreadIsRunning int32
 	receiveQ               chan protocolMessage
 	state                  processState
+	// journal records the messages before their acknowledgement
+	journalMutex sync.Mutex
+	journal      Journal
+	// acknowledgementDeferred is 1 if the ACK of a message waits for Acknowledge
+	acknowledgementDeferred int32
+	// acknowledgementPending is 1 while a message waits for Acknowledge
+	acknowledgementPending int32
+	// acknowledgementRefusable is 1 if the pending message was not acknowledged yet
+	acknowledgementRefusable int32
+	acknowledgements         chan error
 }
 
 func AU6XXProtocol(settings ...*AU6XXProtocolSettings) Implementation {
@@ -111,8 +141,9 @@ func AU6XXProtocol(settings ...*AU6XXProtocolSettings) Implementation {
 	}
 
 	return &au6xxProtocol{
-		settings: theSettings,
-		receiveQ: make(chan protocolMessage),
+		settings:         theSettings,
+		receiveQ:         make(chan protocolMessage),
+		acknowledgements: make(chan error, 1),
 	}
 }
 
@@ -125,18 +156,22 @@ func (p *au6xxProtocol) Interrupt() {
 	panic("not implemented")
 }
 
+// au6xxReceiverTimeout aborts a stalled transfer. Unlike lis1a1 the protocol of the AU6XX defines no receiver
+// timeout, so the receiver keeps the 25 minutes it always waited for the next byte.
+const au6xxReceiverTimeout = 25 * time.Minute
+
 func (p *au6xxProtocol) generateRules() []utilities.Rule {
 	var printableChars8BitWithoutE = []byte{10, 13, 32, 33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64, 65, 66, 67, 68, 70, 71, 72, 73, 74, 75, 76, 77, 78, 79, 80, 81, 82, 83, 84, 85, 86, 87, 88, 89, 90, 91, 92, 93, 94, 95, 96, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 110, 111, 112, 113, 114, 115, 116, 117, 118, 119, 120, 121, 122, 123, 124, 125, 126, 127, 128, 129, 130, 131, 132, 133, 134, 135, 136, 137, 138, 139, 140, 141, 142, 143, 144, 145, 146, 147, 148, 149, 150, 151, 152, 153, 154, 155, 156, 157, 158, 159, 160, 161, 162, 163, 164, 165, 166, 167, 168, 169, 170, 171, 172, 173, 174, 175, 176, 177, 178, 179, 180, 181, 182, 183, 184, 185, 186, 187, 188, 189, 190, 191, 192, 193, 194, 195, 196, 197, 198, 199, 200, 201, 202, 203, 204, 205, 206, 207, 208, 209, 210, 211, 212, 213, 214, 215, 216, 217, 218, 219, 220, 221, 222, 223, 224, 225, 226, 227, 228, 229, 230, 231, 232, 233, 234, 235, 236, 237, 238, 239, 240, 241, 242, 243, 244, 245, 246, 247, 248, 249, 250, 251, 252, 253, 254, 255}
 
 	// CHECK For If CheckSumCheck is enabled
-	return []utilities.Rule{
+	rules := []utilities.Rule{
 		{FromState: 0, Symbols: []byte{p.settings.startByte}, ToState: 1, Scan: false},
 		{FromState: 1, Symbols: []byte{'D', 'S', 'd'}, ToState: 2, Scan: true},
 		{FromState: 1, Symbols: []byte{'R'}, ToState: 10, Scan: true},
 
 		{FromState: 10, Symbols: []byte{'B'}, ToState: 14, Scan: true},
 		{FromState: 10, Symbols: []byte{'E'}, ToState: 15, Scan: true},
-		{FromState: 10, Symbols: printableChars8BitWithoutE, ToState: 11, ActionCode: RequestStart, Scan: true},
+		{FromState: 10, Symbols: utilities.Exclude(printableChars8BitWithoutE, []byte{'B'}), ToState: 11, ActionCode: RequestStart, Scan: true},
 		{FromState: 11, Symbols: []byte{p.settings.endByte}, ToState: 12, ActionCode: LineReceived, Scan: false},
 		{FromState: 11, Symbols: utilities.PrintableChars8Bit, ToState: 11, Scan: true},
 
@@ -161,23 +196,28 @@ func (p *au6xxProtocol) generateRules() []utilities.Rule {
 		{FromState: 7, Symbols: []byte{p.settings.endByte}, ToState: 15, ActionCode: utilities.Finished, Scan: false},
 		{FromState: 7, Symbols: utilities.PrintableChars8Bit, ToState: 7, Scan: true},
 		//utilities.Rule{FromState: 8, Symbols: utilities.PrintableChars8Bit, ToState: 9, ActionCode: utilities.CheckSum, Scan: true},
-		{FromState: 9, Symbols: utilities.PrintableChars8Bit, ToState: 0, ActionCode: utilities.Finished, Scan: false},
 		{FromState: 15, Symbols: []byte{p.settings.endByte}, ToState: 16, ActionCode: utilities.RequestFinished, Scan: false},
 		{FromState: 15, Symbols: utilities.PrintableChars8Bit, ToState: 15, Scan: true},
 
 		{FromState: 16, Symbols: []byte{utilities.ACK, utilities.NAK}, ToState: 0},
 		{FromState: 16, Symbols: []byte{p.settings.startByte}, ToState: 1, Scan: false},
 	}
+
+	// the fsm returns to the initial state when a transfer stalls
+	for _, state := range []utilities.State{1, 2, 3, 5, 7, 10, 11, 12, 13, 14, 15, 16} {
+		rules = append(rules, utilities.Rule{FromState: state, Timeout: au6xxReceiverTimeout, ToState: 0, ActionCode: utilities.Timeout})
+	}
+
+	return rules
 }
 
 func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 
-	if p.receiveThreadIsRunning {
+	if !atomic.CompareAndSwapInt32(&p.receiveThreadIsRunning, 0, 1) {
 		return
 	}
 
 	go func() {
-		p.receiveThreadIsRunning = true
 		p.state.State = 0
 
 		lastMessage := make([]byte, 0)
@@ -185,12 +225,17 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 		fileBuffer := make([][]byte, 0)
 
 		fsm := utilities.CreateFSM(p.generateRules())
-		for p.receiveThreadIsRunning {
+		if p.settings.transitionObserver != nil {
+			fsm.SetTransitionObserver(p.settings.transitionObserver)
+		}
+		for atomic.LoadInt32(&p.receiveThreadIsRunning) == 1 {
 
-			err := conn.SetReadDeadline(time.Now().Add(time.Minute * 25))
+			// the timer rules of the current state define how long to wait
+			deadline, _ := fsm.Deadline()
+			err := conn.SetReadDeadline(deadline)
 			if err != nil {
 				fmt.Printf(`should not happen: %s`, err.Error())
-				p.receiveThreadIsRunning = false
+				atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 				p.receiveQ <- protocolMessage{
 					Status: DISCONNECT,
 					Data:   []byte(err.Error()),
@@ -201,13 +246,14 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 			// enabled FSM
 			if err != nil {
 				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-					fmt.Printf("read timeout reached. reset fsm")
-					tcpReceiveBuffer = make([]byte, 4096)
-					fsm.ResetBuffer()
-					fsm.Init()
+					if _, action, expired := fsm.Expire(); expired && action == utilities.Timeout {
+						fmt.Printf("read timeout reached. reset fsm")
+						fileBuffer = make([][]byte, 0)
+						fsm.ResetBuffer()
+					}
 					continue // on timeout....
 				} else if opErr, ok := err.(*net.OpError); ok && opErr.Op == "read" {
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					p.receiveQ <- protocolMessage{
 						Status: DISCONNECT,
 						Data:   []byte(err.Error()),
@@ -218,7 +264,7 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 						Status: DISCONNECT,
 						Data:   []byte(err.Error()),
 					}
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					return
 				}
 
@@ -226,7 +272,7 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 					Status: DISCONNECT,
 					Data:   []byte(err.Error()),
 				}
-				p.receiveThreadIsRunning = false
+				atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 				return
 			}
 
@@ -237,7 +283,7 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 						Status: ERROR,
 						Data:   []byte(err.Error()),
 					}
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					return
 				}
 
@@ -255,7 +301,7 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 					}
 
 					p.receiveQ <- protocolMsg
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					return
 				case RequestStart:
 					p.state.isRequest = true
@@ -264,6 +310,24 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 					if p.settings.acknowledgementTimeout > 0 {
 						time.Sleep(p.settings.acknowledgementTimeout)
 					}
+					// 5 Because if a bcc is set than its bigger than 4
+					isRequestMessage := p.state.isRequest && len(messageBuffer) > 5
+					isRealTimeMessage := !p.state.isRequest && p.settings.realTimeDataTransmission
+					deferred := atomic.LoadInt32(&p.acknowledgementDeferred) == 1
+					if isRequestMessage || isRealTimeMessage {
+						if err := p.recordJournal(messageBuffer); err != nil {
+							p.refuse(conn, err, fsm)
+							fsm.ResetBuffer()
+							continue
+						}
+						if deferred {
+							if err := p.deliver(messageBuffer, true); err != nil {
+								p.refuse(conn, err, fsm)
+								fsm.ResetBuffer()
+								continue
+							}
+						}
+					}
 					_, err = conn.Write([]byte{utilities.ACK})
 					if err != nil {
 						fmt.Printf("can not send ACK in LineReceived. Should never happen\n")
@@ -271,29 +335,18 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 					}
 
 					lastMessage = messageBuffer
-					if p.state.isRequest && len(messageBuffer) > 5 { // 5 Because if a bcc is set than its bigger than 4
-						// Request logic
-						p.receiveQ <- protocolMessage{
-							Status: DATA,
-							Data:   messageBuffer,
+					if isRequestMessage || isRealTimeMessage {
+						if !deferred {
+							p.deliver(messageBuffer, false)
 						}
 					} else if !p.state.isRequest {
-						if p.settings.realTimeDataTransmission {
-							p.receiveQ <- protocolMessage{
-								Status: DATA,
-								Data:   messageBuffer,
-							}
-						} else {
-							fileBuffer = append(fileBuffer, lastMessage)
-						}
+						fileBuffer = append(fileBuffer, lastMessage)
 					}
 
 					fsm.ResetBuffer()
 				case RetransmitLastMessage:
-					p.receiveQ <- protocolMessage{
-						Status: DATA,
-						Data:   lastMessage,
-					}
+					// it was acknowledged already
+					p.deliver(lastMessage, false)
 
 				case utilities.RequestFinished:
 					time.Sleep(p.settings.acknowledgementTimeout)
@@ -316,11 +369,6 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 					if p.settings.acknowledgementTimeout > 0 {
 						time.Sleep(p.settings.acknowledgementTimeout)
 					}
-					_, err = conn.Write([]byte{utilities.ACK})
-					if err != nil {
-						fmt.Printf("can not send ACK in Finish. Should never happen\n")
-						fsm.Init()
-					}
 
 					fullMsg := make([]byte, 0)
 					for _, messageLine := range fileBuffer {
@@ -331,14 +379,31 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 						fullMsg = append(fullMsg, messageLine...)
 						fullMsg = append(fullMsg, p.settings.lineBreak)
 					}
-
-					// Send only if data are set
+					deferred := atomic.LoadInt32(&p.acknowledgementDeferred) == 1
 					if len(fullMsg) > 0 {
-						p.receiveQ <- protocolMessage{
-							Status: DATA,
-							Data:   fullMsg,
+						err := p.recordJournal(fullMsg)
+						if err == nil && deferred {
+							err = p.deliver(fullMsg, true)
+						}
+						if err != nil {
+							// the instrument repeats the end block, the lines received so far are kept
+							p.refuse(conn, err, fsm)
+							fsm.ResetBuffer()
+							fsm.Init()
+							continue
 						}
 					}
+
+					_, err = conn.Write([]byte{utilities.ACK})
+					if err != nil {
+						fmt.Printf("can not send ACK in Finish. Should never happen\n")
+						fsm.Init()
+					}
+
+					// Send only if data are set
+					if len(fullMsg) > 0 && !deferred {
+						p.deliver(fullMsg, false)
+					}
 					fileBuffer = make([][]byte, 0)
 					fsm.ResetBuffer()
 					fsm.Init()
@@ -357,7 +422,7 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 					}
 
 					p.receiveQ <- protocolMsg
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					fmt.Println("Disconnect due to unexpected, unknown and unlikely error")
 					return
 				}
@@ -366,6 +431,83 @@ func (p *au6xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 	}()
 }
 
+func (p *au6xxProtocol) SetJournal(journal Journal) {
+	p.journalMutex.Lock()
+	defer p.journalMutex.Unlock()
+	p.journal = journal
+}
+
+func (p *au6xxProtocol) recordJournal(data []byte) error {
+	p.journalMutex.Lock()
+	journal := p.journal
+	p.journalMutex.Unlock()
+	if journal == nil {
+		return nil
+	}
+	return journal.Record(data, false)
+}
+
+// DeferAcknowledgement answers a message with ACK or NAK after Acknowledge. A retransmitted message was
+// acknowledged already.
+func (p *au6xxProtocol) DeferAcknowledgement() bool {
+	if !p.settings.acknowledgement {
+		return false
+	}
+	atomic.StoreInt32(&p.acknowledgementDeferred, 1)
+	return true
+}
+
+func (p *au6xxProtocol) Acknowledge(conn net.Conn, err error) (bool, error) {
+	if atomic.LoadInt32(&p.acknowledgementDeferred) == 0 {
+		return false, nil
+	}
+	refusable := atomic.LoadInt32(&p.acknowledgementRefusable) == 1
+	select {
+	case p.acknowledgements <- err:
+	default:
+		return false, errors.New("the message was acknowledged already")
+	}
+	return err != nil && refusable, nil
+}
+
+// deliver passes the message to Receive, it returns the result of Acknowledge if the acknowledgement is deferred.
+// refusable is false if the message was acknowledged already.
+func (p *au6xxProtocol) deliver(data []byte, refusable bool) error {
+	deferred := atomic.LoadInt32(&p.acknowledgementDeferred) == 1
+	if deferred {
+		if refusable {
+			atomic.StoreInt32(&p.acknowledgementRefusable, 1)
+		} else {
+			atomic.StoreInt32(&p.acknowledgementRefusable, 0)
+		}
+		// pending before the handler has the message, it may call Send at once
+		atomic.StoreInt32(&p.acknowledgementPending, 1)
+		defer atomic.StoreInt32(&p.acknowledgementPending, 0)
+	}
+	p.receiveQ <- protocolMessage{
+		Status: DATA,
+		Data:   data,
+	}
+	if !deferred {
+		return nil
+	}
+	return <-p.acknowledgements
+}
+
+// Busy is true while a received message waits for Acknowledge, the send queue waits for the ACK
+func (p *au6xxProtocol) Busy() bool {
+	return atomic.LoadInt32(&p.acknowledgementPending) == 1
+}
+
+// refuse answers a message that could not be recorded or that the handler refused with NAK, the
+// instrument sends it again
+func (p *au6xxProtocol) refuse(conn net.Conn, err error, fsm utilities.FiniteStateMachine) {
+	log.Warn().Err(err).Msg("au6xx: refusing the message with NAK")
+	if _, err := conn.Write([]byte{utilities.NAK}); err != nil {
+		fsm.Init()
+	}
+}
+
 func (p *au6xxProtocol) Receive(conn net.Conn) ([]byte, error) {
 	p.ensureReceiveThreadRunning(conn)
 
@@ -384,6 +526,9 @@ func (p *au6xxProtocol) Receive(conn net.Conn) ([]byte, error) {
 }
 
 func (p *au6xxProtocol) Send(conn net.Conn, data [][]byte) (int, error) {
+	if atomic.LoadInt32(&p.acknowledgementPending) == 1 {
+		return -1, ErrAcknowledgementPending
+	}
 	// Maybe need to wait until the answer of the instrument
 	for _, buff := range data {
 		msgBuff := make([]byte, 0)
@@ -429,7 +574,8 @@ func (p *au6xxProtocol) receiveSendAnswer(conn net.Conn) (byte, error) {
 
 func (p *au6xxProtocol) NewInstance() Implementation {
 	return &au6xxProtocol{
-		settings: p.settings,
-		receiveQ: make(chan protocolMessage),
+		settings:         p.settings,
+		receiveQ:         make(chan protocolMessage),
+		acknowledgements: make(chan error, 1),
 	}
 }
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"io"
 	"net"
 	"os"
 	"testing"
@@ -86,16 +87,13 @@ func TestOneMessageRequestResponse(t *testing.T) {
 		assert.GreaterOrEqual(t, int64(2000-expectedLatency_inMs_TimesTwo), timeOf_6thAck.Sub(timeOf_EndTransferSTX).Milliseconds())
 		assert.Equal(t, []byte{utilities.ACK}, buffer_1Byte)
 
-		_, err = instrument.Read(buffer_SE)
-		timeOf_SE := time.Now()
-		assert.Nil(t, err)
-		assert.LessOrEqual(t, int64(500), timeOf_SE.Sub(timeOf_6thAck).Milliseconds())
-		assert.GreaterOrEqual(t, int64(2000-expectedLatency_inMs_TimesTwo), timeOf_6thAck.Sub(timeOf_EndTransferSTX).Milliseconds())
-		assert.Equal(t, []byte{utilities.STX, 'S', 'E', utilities.LF}, buffer_SE)
+		//-- the host ends the request block with its ACK, it sends no SE
+		instrument.SetReadDeadline(time.Now().Add(2000*time.Millisecond + expectedLatency_inMs_TimesTwo))
+		n, err := instrument.Read(buffer_SE)
+		netErr, isNetErr := err.(net.Error)
+		assert.True(t, isNetErr && netErr.Timeout(), "the host sent % X after the request block", buffer_SE[:n])
 
-		time.Sleep(500 * time.Millisecond)
-		_, err = instrument.Write([]byte{utilities.ACK})
-		assert.Nil(t, err)
+		instrument.Close()
 	}()
 
 	// from here on we become the host :) - (thats ourselfes)
@@ -112,12 +110,9 @@ func TestOneMessageRequestResponse(t *testing.T) {
 	_, err = instance.Send(host, [][]byte{[]byte(str)})
 	assert.Nil(t, err)
 
-	// Need to wait here. Because some timing issue by the host
-	time.Sleep(time.Second)
-
-	ackBytes, err := instance.NewInstance().Receive(host)
-	assert.Equal(t, []byte{}, ackBytes)
-	//assert.ErrorContainsf(t, err, `invalid character : "?"`, "")
+	// the instrument disconnects after the request block, there is no receiver timeout to wait for
+	_, err = instance.Receive(host)
+	assert.Equal(t, io.EOF, err)
 }
 
 func TestMultipleMessageRequestResponse(t *testing.T) {
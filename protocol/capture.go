@@ -0,0 +1,494 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CaptureDirection tells whether the captured data was received or sent
+type CaptureDirection string
+
+const (
+	CaptureReceived CaptureDirection = "rx"
+	CaptureSent     CaptureDirection = "tx"
+)
+
+const captureTimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+var ErrInvalidCapture = errors.New("invalid capture file")
+
+type CaptureSettings struct {
+	directory   string
+	maxFileSize int64
+	maxFileAge  time.Duration
+	redactor    Redactor
+}
+
+func DefaultCaptureSettings() *CaptureSettings {
+	return &CaptureSettings{
+		directory:   ".",
+		maxFileSize: 10 * 1024 * 1024,
+		maxFileAge:  24 * time.Hour,
+	}
+}
+
+// SetDirectory sets the directory for the capture files, it must exist. Default is the working directory
+func (s CaptureSettings) SetDirectory(directory string) *CaptureSettings {
+	s.directory = directory
+	return &s
+}
+
+// SetMaxFileSize starts a new file when the capture file exceeds the size. 0 = no limit, default is 10 MiB
+func (s CaptureSettings) SetMaxFileSize(maxFileSize int64) *CaptureSettings {
+	s.maxFileSize = maxFileSize
+	return &s
+}
+
+// SetMaxFileAge starts a new file when the capture file is older. 0 = no limit, default is 24 hours
+func (s CaptureSettings) SetMaxFileAge(maxFileAge time.Duration) *CaptureSettings {
+	s.maxFileAge = maxFileAge
+	return &s
+}
+
+// SetRedactor masks sensitive data (e.g. patient names) before it is written to the file,
+// see ASTMFieldRedactor, HL7FieldRedactor and RegexRedactor
+func (s CaptureSettings) SetRedactor(redactor Redactor) *CaptureSettings {
+	s.redactor = redactor
+	return &s
+}
+
+// Capture writes every read and write of the protocol to a file per session (see ReadCaptureFile).
+// Each line of the file is one read or write:
+//
+//	2022-03-01T10:15:02.123456+01:00 rx 0231487C5C5E267C7C7C0D
+//
+// Lines starting with # are comments.
+func Capture(protocol Implementation, settings ...*CaptureSettings) Implementation {
+
+	var theSettings *CaptureSettings
+	if len(settings) >= 1 {
+		theSettings = settings[0]
+	} else {
+		theSettings = DefaultCaptureSettings()
+	}
+
+	return &captureProtocol{
+		settings: theSettings,
+		protocol: protocol,
+	}
+}
+
+type captureProtocol struct {
+	settings *CaptureSettings
+	protocol Implementation
+
+	// the protocol implementations keep the connection of the first call, the wrapper must
+	// therefore be the same for all calls with the same connection
+	mutex       sync.Mutex
+	conn        net.Conn
+	captureConn *netConnCaptureSpy
+}
+
+func (cp *captureProtocol) Receive(conn net.Conn) ([]byte, error) {
+	return cp.protocol.Receive(cp.wrap(conn))
+}
+
+func (cp *captureProtocol) Send(conn net.Conn, data [][]byte) (int, error) {
+	return cp.protocol.Send(cp.wrap(conn), data)
+}
+
+func (cp *captureProtocol) Interrupt() {
+	cp.protocol.Interrupt()
+}
+
+// AddEventReporter is passed to the wrapped protocol if it reports events
+func (cp *captureProtocol) AddEventReporter(reporter EventReporter) {
+	if source, ok := cp.protocol.(EventSource); ok {
+		source.AddEventReporter(reporter)
+	}
+}
+
+// Heartbeat is passed to the wrapped protocol if it supports heartbeats
+func (cp *captureProtocol) Heartbeat(conn net.Conn, timeout time.Duration) error {
+	if heartbeater, ok := cp.protocol.(Heartbeater); ok {
+		return heartbeater.Heartbeat(cp.wrap(conn), timeout)
+	}
+	return nil
+}
+
+// Busy is passed to the wrapped protocol if it reports its transfers
+func (cp *captureProtocol) Busy() bool {
+	if busyReporter, ok := cp.protocol.(BusyReporter); ok {
+		return busyReporter.Busy()
+	}
+	return false
+}
+
+// SetJournal is passed to the wrapped protocol if it acknowledges messages before Receive returns them
+func (cp *captureProtocol) SetJournal(journal Journal) {
+	if journaled, ok := cp.protocol.(Journaled); ok {
+		journaled.SetJournal(journal)
+	}
+}
+
+// DeferAcknowledgement is passed to the wrapped protocol if it acknowledges messages
+func (cp *captureProtocol) DeferAcknowledgement() bool {
+	if acknowledger, ok := cp.protocol.(Acknowledger); ok {
+		return acknowledger.DeferAcknowledgement()
+	}
+	return false
+}
+
+// Acknowledge is passed to the wrapped protocol if it acknowledges messages
+func (cp *captureProtocol) Acknowledge(conn net.Conn, err error) (bool, error) {
+	if acknowledger, ok := cp.protocol.(Acknowledger); ok {
+		return acknowledger.Acknowledge(cp.wrap(conn), err)
+	}
+	return false, nil
+}
+
+func (cp *captureProtocol) NewInstance() Implementation {
+	return &captureProtocol{
+		settings: cp.settings,
+		protocol: cp.protocol.NewInstance(),
+	}
+}
+
+func (cp *captureProtocol) wrap(conn net.Conn) net.Conn {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	if cp.conn == conn {
+		return cp.captureConn
+	}
+	if cp.captureConn != nil {
+		cp.captureConn.writer.close()
+	}
+
+	session := ""
+	if addr := conn.RemoteAddr(); addr != nil {
+		session = addr.String()
+	}
+	cp.conn = conn
+	cp.captureConn = &netConnCaptureSpy{
+		conn: conn,
+		writer: &captureWriter{
+			settings:  cp.settings,
+			session:   session,
+			redactors: newDirectionRedactors(cp.settings.redactor),
+		},
+	}
+	return cp.captureConn
+}
+
+// captureWriter writes the records of one session, the file is opened with the first record
+type captureWriter struct {
+	settings  *CaptureSettings
+	session   string
+	redactors *directionRedactors
+
+	mutex    sync.Mutex
+	file     *os.File
+	opened   time.Time
+	size     int64
+	sequence int
+	failed   bool
+}
+
+func (cw *captureWriter) record(direction CaptureDirection, data []byte) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	// the redactors must see all data, even if it is not written
+	data = cw.redactors.redact(direction, data)
+	if cw.failed {
+		return
+	}
+
+	now := time.Now()
+	if cw.file != nil && cw.mustRotate(now) {
+		cw.closeFile()
+	}
+	if cw.file == nil {
+		if err := cw.openFile(now); err != nil {
+			// a capture must never break the communication
+			log.Error().Err(err).Str("session", cw.session).Msg("capture disabled for session")
+			cw.failed = true
+			return
+		}
+	}
+
+	line := fmt.Sprintf("%s %s %s\n", now.Format(captureTimestampFormat), direction, strings.ToUpper(hex.EncodeToString(data)))
+	n, err := cw.file.WriteString(line)
+	cw.size += int64(n)
+	if err != nil {
+		log.Error().Err(err).Str("session", cw.session).Msg("capture disabled for session")
+		cw.closeFile()
+		cw.failed = true
+	}
+}
+
+func (cw *captureWriter) mustRotate(now time.Time) bool {
+	if cw.settings.maxFileSize > 0 && cw.size >= cw.settings.maxFileSize {
+		return true
+	}
+	if cw.settings.maxFileAge > 0 && now.Sub(cw.opened) >= cw.settings.maxFileAge {
+		return true
+	}
+	return false
+}
+
+func (cw *captureWriter) openFile(now time.Time) error {
+	name := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(cw.session)
+	if name == "" {
+		name = "session"
+	}
+	filename := filepath.Join(cw.settings.directory, fmt.Sprintf("%s_%s_%03d.cap", name, now.Format("20060102T150405.000000"), cw.sequence))
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("# session %s, part %d, started %s\n", cw.session, cw.sequence, now.Format(captureTimestampFormat))
+	n, err := file.WriteString(header)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	cw.file = file
+	cw.opened = now
+	cw.size = int64(n)
+	cw.sequence++
+	return nil
+}
+
+func (cw *captureWriter) closeFile() {
+	if cw.file != nil {
+		cw.file.Close()
+		cw.file = nil
+	}
+}
+
+func (cw *captureWriter) close() {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	cw.closeFile()
+}
+
+/* Implement net.Conn as a wrapper */
+type netConnCaptureSpy struct {
+	conn   net.Conn
+	writer *captureWriter
+}
+
+func (cs *netConnCaptureSpy) Read(b []byte) (n int, err error) {
+	n, err = cs.conn.Read(b)
+	if n > 0 {
+		cs.writer.record(CaptureReceived, b[:n])
+	}
+	if err != nil && (readErrorToEOF(err) == io.EOF || errors.Is(err, net.ErrClosed)) {
+		cs.writer.close()
+	}
+	return n, err
+}
+func (cs *netConnCaptureSpy) Write(b []byte) (n int, err error) {
+	n, err = cs.conn.Write(b)
+	if n > 0 {
+		cs.writer.record(CaptureSent, b[:n])
+	}
+	return n, err
+}
+func (cs *netConnCaptureSpy) Close() error {
+	cs.writer.close()
+	return cs.conn.Close()
+}
+func (cs *netConnCaptureSpy) LocalAddr() net.Addr {
+	return cs.conn.LocalAddr()
+}
+func (cs *netConnCaptureSpy) RemoteAddr() net.Addr {
+	return cs.conn.RemoteAddr()
+}
+func (cs *netConnCaptureSpy) SetDeadline(t time.Time) error {
+	return cs.conn.SetDeadline(t)
+}
+func (cs *netConnCaptureSpy) SetReadDeadline(t time.Time) error {
+	return cs.conn.SetReadDeadline(t)
+}
+func (cs *netConnCaptureSpy) SetWriteDeadline(t time.Time) error {
+	return cs.conn.SetWriteDeadline(t)
+}
+
+// CaptureRecord is one read or write of a capture file
+type CaptureRecord struct {
+	Timestamp time.Time
+	Direction CaptureDirection
+	Data      []byte
+}
+
+// ReadCaptureFile reads a file written by Capture
+func ReadCaptureFile(filename string) ([]CaptureRecord, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadCapture(file)
+}
+
+// ReadCapture reads the records of a capture
+func ReadCapture(reader io.Reader) ([]CaptureRecord, error) {
+	records := make([]CaptureRecord, 0)
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w: line %d has %d fields, expected 3", ErrInvalidCapture, lineNumber, len(fields))
+		}
+		timestamp, err := time.Parse(captureTimestampFormat, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %s", ErrInvalidCapture, lineNumber, err.Error())
+		}
+		direction := CaptureDirection(fields[1])
+		if direction != CaptureReceived && direction != CaptureSent {
+			return nil, fmt.Errorf("%w: line %d has unknown direction '%s'", ErrInvalidCapture, lineNumber, fields[1])
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %s", ErrInvalidCapture, lineNumber, err.Error())
+		}
+		records = append(records, CaptureRecord{Timestamp: timestamp, Direction: direction, Data: data})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ReplayConn is a fake net.Conn that plays back the received data of a capture. Every Read returns
+// the data of one received record in the original order and segmentation, after the last record
+// Read returns io.EOF. Everything written is collected (see Written).
+type ReplayConn struct {
+	mutex    sync.Mutex
+	received [][]byte
+	written  []byte
+	closed   bool
+}
+
+func NewReplayConn(records []CaptureRecord) *ReplayConn {
+	received := make([][]byte, 0)
+	for _, record := range records {
+		if record.Direction == CaptureReceived {
+			received = append(received, record.Data)
+		}
+	}
+	return &ReplayConn{
+		received: received,
+		written:  make([]byte, 0),
+	}
+}
+
+func (rc *ReplayConn) Read(b []byte) (int, error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.closed {
+		return 0, net.ErrClosed
+	}
+	if len(rc.received) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, rc.received[0])
+	if n < len(rc.received[0]) {
+		rc.received[0] = rc.received[0][n:]
+	} else {
+		rc.received = rc.received[1:]
+	}
+	return n, nil
+}
+
+func (rc *ReplayConn) Write(b []byte) (int, error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.closed {
+		return 0, net.ErrClosed
+	}
+	rc.written = append(rc.written, b...)
+	return len(b), nil
+}
+
+// Written returns everything the protocol has sent, e.g. to compare it with the sent records of the capture
+func (rc *ReplayConn) Written() []byte {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	written := make([]byte, len(rc.written))
+	copy(written, rc.written)
+	return written
+}
+
+func (rc *ReplayConn) Close() error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.closed = true
+	return nil
+}
+func (rc *ReplayConn) LocalAddr() net.Addr {
+	return replayAddr{}
+}
+func (rc *ReplayConn) RemoteAddr() net.Addr {
+	return replayAddr{}
+}
+func (rc *ReplayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+func (rc *ReplayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (rc *ReplayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+// Replay feeds the received data of the capture through the protocol and returns all received
+// messages. conn holds what the protocol has sent in response.
+func Replay(protocol Implementation, records []CaptureRecord) (messages [][]byte, conn *ReplayConn, err error) {
+	conn = NewReplayConn(records)
+	messages = make([][]byte, 0)
+	for {
+		message, err := protocol.Receive(conn)
+		if err == io.EOF {
+			return messages, conn, nil
+		}
+		if err != nil {
+			return messages, conn, err
+		}
+		messages = append(messages, message)
+	}
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+var lis1A1Session = [][]byte{
+	{utilities.ENQ},
+	[]byte("\u00021H|\\^&|||\r\u000359\r\n"),
+	[]byte("\u00022P|1||777025164810\r\u0003A7\r\n"),
+	[]byte("\u00023L|1|N\r\u000306\r\n"),
+	{utilities.EOT},
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	directory := t.TempDir()
+	instance := Capture(Lis1A1Protocol(), DefaultCaptureSettings().SetDirectory(directory)).NewInstance()
+
+	host, instrument := net.Pipe()
+	go func() {
+		answer := make([]byte, 1)
+		for i, frame := range lis1A1Session {
+			instrument.Write(frame)
+			if i < len(lis1A1Session)-1 {
+				instrument.Read(answer)
+			}
+		}
+		instrument.Close()
+	}()
+
+	message, err := instance.Receive(host)
+	assert.Nil(t, err)
+	_, err = instance.Receive(host)
+	assert.NotNil(t, err)
+
+	files, err := filepath.Glob(filepath.Join(directory, "pipe_*.cap"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+
+	records, err := ReadCaptureFile(files[0])
+	assert.Nil(t, err)
+	received, sent := make([]byte, 0), make([]byte, 0)
+	for _, record := range records {
+		assert.False(t, record.Timestamp.IsZero())
+		if record.Direction == CaptureReceived {
+			received = append(received, record.Data...)
+		} else {
+			sent = append(sent, record.Data...)
+		}
+	}
+	// the full transmission is captured
+	assert.Equal(t, string(concat(lis1A1Session)), string(received))
+	assert.Equal(t, []byte{utilities.ACK, utilities.ACK, utilities.ACK, utilities.ACK}, sent)
+
+	// the replay through a new instance gives the same result
+	messages, conn, err := Replay(Lis1A1Protocol(), records)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{message}, messages)
+	assert.Equal(t, sent, conn.Written())
+}
+
+func TestCaptureRotatesBySize(t *testing.T) {
+	directory := t.TempDir()
+	instance := Capture(LengthPrefixed(), DefaultCaptureSettings().SetDirectory(directory).SetMaxFileSize(100))
+
+	host, instrument := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		buffer := make([]byte, 24)
+		for i := 0; i < 5; i++ {
+			_, err := host.Read(buffer)
+			assert.Nil(t, err)
+		}
+		done <- true
+	}()
+	for i := 0; i < 5; i++ {
+		_, err := instance.Send(instrument, [][]byte{[]byte(strings.Repeat("x", 20))})
+		assert.Nil(t, err)
+	}
+	<-done
+
+	files, err := os.ReadDir(directory)
+	assert.Nil(t, err)
+	assert.Greater(t, len(files), 1)
+
+	records := make([]CaptureRecord, 0)
+	for _, file := range files {
+		fileRecords, err := ReadCaptureFile(filepath.Join(directory, file.Name()))
+		assert.Nil(t, err)
+		records = append(records, fileRecords...)
+	}
+	assert.Equal(t, 5, len(records))
+}
+
+func TestReadCaptureInvalid(t *testing.T) {
+	for _, invalid := range []string{
+		"2022-03-01T10:15:02.123456Z rx",
+		"yesterday rx 02",
+		"2022-03-01T10:15:02.123456Z up 02",
+		"2022-03-01T10:15:02.123456Z rx XY",
+	} {
+		_, err := ReadCapture(strings.NewReader("# comment\n" + invalid + "\n"))
+		assert.ErrorIs(t, err, ErrInvalidCapture, invalid)
+	}
+}
+
+func concat(lines [][]byte) []byte {
+	result := make([]byte, 0)
+	for _, line := range lines {
+		result = append(result, line...)
+	}
+	return result
+}
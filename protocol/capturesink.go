@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CaptureSink receives the traffic of connections, e.g. a PcapngWriter. Set it with
+// ProtocolLoggerSettings.SetCaptureSink or in the TCPServerConfiguration.
+type CaptureSink interface {
+	// OpenSession is called once for every connection. local is the address of this side,
+	// remote the address of the peer (the proxy-protocol source address if present)
+	OpenSession(local, remote net.Addr, timestamp time.Time) CaptureSession
+}
+
+// CaptureSession receives the traffic of one connection
+type CaptureSession interface {
+	// Record is called for every read (CaptureReceived) and write (CaptureSent)
+	Record(timestamp time.Time, direction CaptureDirection, data []byte)
+	// Close is called once when the connection ends
+	Close(timestamp time.Time)
+}
+
+// WrapConnWithCaptureSink records all reads and writes of the connection to a new session of the sink
+func WrapConnWithCaptureSink(conn net.Conn, sink CaptureSink) net.Conn {
+	return &netConnCaptureSinkSpy{
+		Conn:    conn,
+		session: sink.OpenSession(conn.LocalAddr(), conn.RemoteAddr(), time.Now()),
+	}
+}
+
+type netConnCaptureSinkSpy struct {
+	net.Conn
+	session   CaptureSession
+	closeOnce sync.Once
+}
+
+func (cs *netConnCaptureSinkSpy) Read(b []byte) (n int, err error) {
+	n, err = cs.Conn.Read(b)
+	if n > 0 {
+		cs.session.Record(time.Now(), CaptureReceived, b[:n])
+	}
+	if err != nil && (readErrorToEOF(err) == io.EOF || errors.Is(err, net.ErrClosed)) {
+		cs.closeSession()
+	}
+	return n, err
+}
+
+func (cs *netConnCaptureSinkSpy) Write(b []byte) (n int, err error) {
+	n, err = cs.Conn.Write(b)
+	if n > 0 {
+		cs.session.Record(time.Now(), CaptureSent, b[:n])
+	}
+	return n, err
+}
+
+func (cs *netConnCaptureSinkSpy) Close() error {
+	cs.closeSession()
+	return cs.Conn.Close()
+}
+
+func (cs *netConnCaptureSinkSpy) closeSession() {
+	cs.closeOnce.Do(func() {
+		cs.session.Close(time.Now())
+	})
+}
@@ -0,0 +1,554 @@
+package protocol
+
+/*
+Declarative protocol definitions.
+
+A definition describes a receiving protocol the same way the hand-written protocols do: as a list of
+FSM-rules. States and symbol classes are named, every transition can trigger an action code and each
+action code is mapped to a list of built-in actions. Definitions can be loaded from YAML or JSON, so
+that a new instrument can be connected without writing Go code.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalidDefinition = errors.New("invalid protocol definition")
+
+// Built-in actions that can be triggered by an action code
+const (
+	ActionAppend           = "append"           // append the scanned buffer as a line to the message and reset the buffer
+	ActionEmit             = "emit"             // deliver the message (all appended lines) to the receiver
+	ActionDiscard          = "discard"          // drop all lines appended so far
+	ActionResetBuffer      = "resetBuffer"      // drop the scanned buffer
+	ActionAck              = "ack"              // send <ACK>
+	ActionNak              = "nak"              // send <NAK>
+	ActionBeginChecksum    = "beginChecksum"    // start summing up all following bytes for the checksum
+	ActionEndChecksum      = "endChecksum"      // stop summing up, the current byte is included
+	ActionValidateChecksum = "validateChecksum" // compare the scanned buffer against the checksum (ASTM, modulo 256 as two hex digits)
+)
+
+var builtInActions = []string{ActionAppend, ActionEmit, ActionDiscard, ActionResetBuffer, ActionAck, ActionNak,
+	ActionBeginChecksum, ActionEndChecksum, ActionValidateChecksum}
+
+// Definition of a protocol. The first entry of States is the initial state.
+type Definition struct {
+	Name          string                 `json:"name" yaml:"name"`
+	States        []string               `json:"states" yaml:"states"`
+	SymbolClasses map[string]SymbolClass `json:"symbolClasses" yaml:"symbolClasses"`
+	Transitions   []TransitionDefinition `json:"transitions" yaml:"transitions"`
+	Actions       map[string][]string    `json:"actions" yaml:"actions"`
+	Framing       *FramingDefinition     `json:"framing,omitempty" yaml:"framing,omitempty"`
+}
+
+// SymbolClass is a named set of bytes.
+// Symbols are written as single characters ("A"), as hex ("0x05") or as name of a control character ("ENQ").
+// Ranges are two symbols separated by '-' ("0x20-0x7E", "A-Z").
+type SymbolClass struct {
+	Chars  string   `json:"chars,omitempty" yaml:"chars,omitempty"`
+	Bytes  []string `json:"bytes,omitempty" yaml:"bytes,omitempty"`
+	Ranges []string `json:"ranges,omitempty" yaml:"ranges,omitempty"`
+	Except []string `json:"except,omitempty" yaml:"except,omitempty"` // symbols or classes removed from this class
+}
+
+// TransitionDefinition is the declarative form of a utilities.Rule. Symbols can name symbol classes,
+// single symbols or ranges.
+type TransitionDefinition struct {
+	From    string   `json:"from" yaml:"from"`
+	Symbols []string `json:"symbols" yaml:"symbols"`
+	To      string   `json:"to" yaml:"to"`
+	Scan    bool     `json:"scan,omitempty" yaml:"scan,omitempty"`
+	Action  string   `json:"action,omitempty" yaml:"action,omitempty"`
+	// Timeout turns the transition into a timer, e.g. "30s": it is taken when no byte arrives
+	// within the timeout. A timer has no symbols.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// FramingDefinition is used for sending. Every line is terminated by LineBreak, the whole message is
+// enclosed by Start and End. Without framing, the protocol can not send.
+type FramingDefinition struct {
+	Start     string `json:"start,omitempty" yaml:"start,omitempty"`
+	End       string `json:"end,omitempty" yaml:"end,omitempty"`
+	LineBreak string `json:"lineBreak,omitempty" yaml:"lineBreak,omitempty"`
+}
+
+// LoadDefinition parses a definition from YAML or JSON
+func LoadDefinition(data []byte) (*Definition, error) {
+	var def Definition
+	if err := yaml.Unmarshal(data, &def); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDefinition, err.Error())
+	}
+	return &def, nil
+}
+
+// LoadDefinitionFile reads a definition from a YAML or JSON file
+func LoadDefinitionFile(filename string) (*Definition, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return LoadDefinition(data)
+}
+
+type compiledDefinition struct {
+	name      string
+	rules     []utilities.Rule
+	actions   map[utilities.ActionCode][]string
+	start     []byte
+	end       []byte
+	lineBreak []byte
+	canSend   bool
+}
+
+// compile validates the definition and translates it to FSM-rules
+func (def *Definition) compile() (*compiledDefinition, error) {
+	if len(def.States) == 0 {
+		return nil, fmt.Errorf("%w: no states defined", ErrInvalidDefinition)
+	}
+
+	states := make(map[string]utilities.State)
+	for i, name := range def.States {
+		if _, exists := states[name]; exists {
+			return nil, fmt.Errorf("%w: state '%s' is defined twice", ErrInvalidDefinition, name)
+		}
+		states[name] = utilities.Init + utilities.State(i)
+	}
+
+	classes := make(map[string][]byte)
+	for name := range def.SymbolClasses {
+		if _, err := resolveSymbolClass(name, def.SymbolClasses, classes, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+
+	compiled := &compiledDefinition{
+		name:    def.Name,
+		rules:   make([]utilities.Rule, 0, len(def.Transitions)),
+		actions: make(map[utilities.ActionCode][]string),
+	}
+
+	for actionCode, actions := range def.Actions {
+		if actionCode == "" {
+			return nil, fmt.Errorf("%w: action code must not be empty", ErrInvalidDefinition)
+		}
+		for _, action := range actions {
+			if !utilities.Contains(action, builtInActions) {
+				return nil, fmt.Errorf("%w: action code '%s' uses unknown built-in action '%s'", ErrInvalidDefinition, actionCode, action)
+			}
+		}
+		compiled.actions[utilities.ActionCode(actionCode)] = actions
+	}
+
+	for i, transition := range def.Transitions {
+		fromState, ok := states[transition.From]
+		if !ok {
+			return nil, fmt.Errorf("%w: transition %d starts in unknown state '%s'", ErrInvalidDefinition, i, transition.From)
+		}
+		toState, ok := states[transition.To]
+		if !ok {
+			return nil, fmt.Errorf("%w: transition %d leads to unknown state '%s'", ErrInvalidDefinition, i, transition.To)
+		}
+		if transition.Action != "" {
+			if _, ok := compiled.actions[utilities.ActionCode(transition.Action)]; !ok {
+				return nil, fmt.Errorf("%w: transition %d uses undefined action code '%s'", ErrInvalidDefinition, i, transition.Action)
+			}
+		}
+		if transition.Timeout != "" {
+			timeout, err := time.ParseDuration(transition.Timeout)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("%w: transition %d has an invalid timeout '%s'", ErrInvalidDefinition, i, transition.Timeout)
+			}
+			if len(transition.Symbols) > 0 {
+				return nil, fmt.Errorf("%w: transition %d has a timeout and symbols", ErrInvalidDefinition, i)
+			}
+			compiled.rules = append(compiled.rules, utilities.Rule{
+				FromState:  fromState,
+				ToState:    toState,
+				ActionCode: utilities.ActionCode(transition.Action),
+				Timeout:    timeout,
+			})
+			continue
+		}
+		symbols, err := resolveSymbols(transition.Symbols, classes)
+		if err != nil {
+			return nil, fmt.Errorf("%w (transition %d)", err, i)
+		}
+		if len(symbols) == 0 {
+			return nil, fmt.Errorf("%w: transition %d has no symbols", ErrInvalidDefinition, i)
+		}
+		compiled.rules = append(compiled.rules, utilities.Rule{
+			FromState:  fromState,
+			Symbols:    symbols,
+			ToState:    toState,
+			ActionCode: utilities.ActionCode(transition.Action),
+			Scan:       transition.Scan,
+		})
+	}
+
+	if def.Framing != nil {
+		var err error
+		if compiled.start, err = resolveOptionalSymbol(def.Framing.Start); err != nil {
+			return nil, err
+		}
+		if compiled.end, err = resolveOptionalSymbol(def.Framing.End); err != nil {
+			return nil, err
+		}
+		if compiled.lineBreak, err = resolveOptionalSymbol(def.Framing.LineBreak); err != nil {
+			return nil, err
+		}
+		compiled.canSend = true
+	}
+	if compiled.lineBreak == nil {
+		compiled.lineBreak = []byte{utilities.CR}
+	}
+
+	return compiled, nil
+}
+
+func resolveSymbolClass(name string, definitions map[string]SymbolClass, resolved map[string][]byte, visiting map[string]bool) ([]byte, error) {
+	if symbols, ok := resolved[name]; ok {
+		return symbols, nil
+	}
+	if visiting[name] {
+		return nil, fmt.Errorf("%w: symbol class '%s' references itself", ErrInvalidDefinition, name)
+	}
+	visiting[name] = true
+
+	class := definitions[name]
+	var set [256]bool
+	for _, c := range []byte(class.Chars) {
+		set[c] = true
+	}
+	for _, symbol := range class.Bytes {
+		b, err := parseSymbol(symbol)
+		if err != nil {
+			return nil, fmt.Errorf("%w (symbol class '%s')", err, name)
+		}
+		set[b] = true
+	}
+	for _, symbolRange := range class.Ranges {
+		from, to, err := parseSymbolRange(symbolRange)
+		if err != nil {
+			return nil, fmt.Errorf("%w (symbol class '%s')", err, name)
+		}
+		for i := int(from); i <= int(to); i++ {
+			set[i] = true
+		}
+	}
+	for _, except := range class.Except {
+		var excluded []byte
+		if _, isClass := definitions[except]; isClass {
+			var err error
+			if excluded, err = resolveSymbolClass(except, definitions, resolved, visiting); err != nil {
+				return nil, err
+			}
+		} else {
+			b, err := parseSymbol(except)
+			if err != nil {
+				return nil, fmt.Errorf("%w (symbol class '%s')", err, name)
+			}
+			excluded = []byte{b}
+		}
+		for _, b := range excluded {
+			set[b] = false
+		}
+	}
+
+	symbols := make([]byte, 0)
+	for i, isSet := range set {
+		if isSet {
+			symbols = append(symbols, byte(i))
+		}
+	}
+	resolved[name] = symbols
+	return symbols, nil
+}
+
+func resolveSymbols(names []string, classes map[string][]byte) ([]byte, error) {
+	symbols := make([]byte, 0)
+	for _, name := range names {
+		if class, ok := classes[name]; ok {
+			symbols = append(symbols, class...)
+			continue
+		}
+		if b, err := parseSymbol(name); err == nil {
+			symbols = append(symbols, b)
+			continue
+		}
+		from, to, err := parseSymbolRange(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: '%s' is neither a symbol class, a symbol nor a range", ErrInvalidDefinition, name)
+		}
+		for i := int(from); i <= int(to); i++ {
+			symbols = append(symbols, byte(i))
+		}
+	}
+	return symbols, nil
+}
+
+func resolveOptionalSymbol(symbol string) ([]byte, error) {
+	if symbol == "" {
+		return nil, nil
+	}
+	b, err := parseSymbol(symbol)
+	if err != nil {
+		return nil, err
+	}
+	return []byte{b}, nil
+}
+
+// parseSymbol accepts a single character, hex ("0x1C") or the name of a control character ("STX")
+func parseSymbol(symbol string) (byte, error) {
+	if len(symbol) == 1 {
+		return symbol[0], nil
+	}
+	if strings.HasPrefix(symbol, "0x") || strings.HasPrefix(symbol, "0X") {
+		value, err := strconv.ParseUint(symbol[2:], 16, 8)
+		if err != nil {
+			return 0, fmt.Errorf("%w: invalid hex symbol '%s'", ErrInvalidDefinition, symbol)
+		}
+		return byte(value), nil
+	}
+	for b, name := range utilities.ASCIIMapNotPrintable {
+		if "<"+strings.ToUpper(symbol)+">" == name {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown symbol '%s'", ErrInvalidDefinition, symbol)
+}
+
+func parseSymbolRange(symbolRange string) (byte, byte, error) {
+	for i := 1; i < len(symbolRange)-1; i++ {
+		if symbolRange[i] != '-' {
+			continue
+		}
+		from, errFrom := parseSymbol(symbolRange[:i])
+		to, errTo := parseSymbol(symbolRange[i+1:])
+		if errFrom == nil && errTo == nil && from <= to {
+			return from, to, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("%w: invalid symbol range '%s'", ErrInvalidDefinition, symbolRange)
+}
+
+type DefinitionProtocolSettings struct {
+	transitionObserver utilities.TransitionObserver
+}
+
+func DefaultDefinitionProtocolSettings() *DefinitionProtocolSettings {
+	return &DefinitionProtocolSettings{}
+}
+
+// SetTransitionObserver receives every transition of the state machine, e.g. utilities.ZerologTransitionObserver
+func (s DefinitionProtocolSettings) SetTransitionObserver(observer utilities.TransitionObserver) *DefinitionProtocolSettings {
+	s.transitionObserver = observer
+	return &s
+}
+
+type definitionProtocol struct {
+	definition             *compiledDefinition
+	settings               *DefinitionProtocolSettings
+	receiveQ               chan protocolMessage
+	receiveThreadIsRunning int32
+}
+
+// FromDefinition creates a protocol that interprets the definition
+func FromDefinition(def *Definition, settings ...*DefinitionProtocolSettings) (Implementation, error) {
+	compiled, err := def.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	var theSettings *DefinitionProtocolSettings
+	if len(settings) >= 1 {
+		theSettings = settings[0]
+	} else {
+		theSettings = DefaultDefinitionProtocolSettings()
+	}
+
+	return &definitionProtocol{
+		definition: compiled,
+		settings:   theSettings,
+		receiveQ:   make(chan protocolMessage),
+	}, nil
+}
+
+func (proto *definitionProtocol) NewInstance() Implementation {
+	return &definitionProtocol{
+		definition: proto.definition,
+		settings:   proto.settings,
+		receiveQ:   make(chan protocolMessage),
+	}
+}
+
+func (proto *definitionProtocol) Receive(conn net.Conn) ([]byte, error) {
+
+	proto.ensureReceiveThreadRunning(conn)
+
+	message := <-proto.receiveQ
+
+	switch message.Status {
+	case DATA:
+		return message.Data, nil
+	case EOF, DISCONNECT:
+		return []byte{}, io.EOF
+	case ERROR:
+		return []byte{}, fmt.Errorf("error while reading - abort receiving data: %s", string(message.Data))
+	default:
+		return []byte{}, fmt.Errorf("internal error: Invalid status of communication (%d) - abort", message.Status)
+	}
+}
+
+// asynchronous receive loop
+func (proto *definitionProtocol) ensureReceiveThreadRunning(conn net.Conn) {
+
+	if !atomic.CompareAndSwapInt32(&proto.receiveThreadIsRunning, 0, 1) {
+		return
+	}
+
+	go func() {
+
+		tcpReceiveBuffer := make([]byte, 4096)
+		fileBuffer := make([][]byte, 0)
+		checksumActive := false
+		checksumSum := 0
+
+		fsm := utilities.CreateFSM(proto.definition.rules)
+		if proto.settings.transitionObserver != nil {
+			fsm.SetTransitionObserver(proto.settings.transitionObserver)
+		}
+		// performs the built-in actions of an action code, false if receiving ends
+		performActions := func(action utilities.ActionCode, messageBuffer []byte) bool {
+			for _, builtIn := range proto.definition.actions[action] {
+				switch builtIn {
+				case ActionAppend:
+					fileBuffer = append(fileBuffer, messageBuffer)
+					fsm.ResetBuffer()
+				case ActionEmit:
+					fullMsg := make([]byte, 0)
+					for _, messageLine := range fileBuffer {
+						fullMsg = append(fullMsg, messageLine...)
+						fullMsg = append(fullMsg, proto.definition.lineBreak...)
+					}
+					proto.receiveQ <- protocolMessage{
+						Status: DATA,
+						Data:   fullMsg,
+					}
+					fileBuffer = make([][]byte, 0)
+				case ActionDiscard:
+					fileBuffer = make([][]byte, 0)
+				case ActionResetBuffer:
+					fsm.ResetBuffer()
+				case ActionAck, ActionNak:
+					answer := utilities.ACK
+					if builtIn == ActionNak {
+						answer = utilities.NAK
+					}
+					if _, err := conn.Write([]byte{answer}); err != nil {
+						atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
+						proto.receiveQ <- protocolMessage{
+							Status: DISCONNECT,
+							Data:   []byte(err.Error()),
+						}
+						return false
+					}
+				case ActionBeginChecksum:
+					checksumActive = true
+					checksumSum = 0
+				case ActionEndChecksum:
+					checksumActive = false
+				case ActionValidateChecksum:
+					currentChecksum := fmt.Sprintf("%02X", checksumSum%256)
+					if !strings.EqualFold(currentChecksum, string(messageBuffer)) {
+						protocolMsg := protocolMessage{
+							Status: ERROR,
+							Data:   []byte(fmt.Sprintf("Invalid Checksum. want: %s given: %s ", currentChecksum, string(messageBuffer))),
+						}
+						if _, err := conn.Write([]byte{utilities.NAK}); err != nil {
+							protocolMsg.Data = append(protocolMsg.Data, []byte(err.Error())...)
+						}
+						atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
+						proto.receiveQ <- protocolMsg
+						return false
+					}
+					fsm.ResetBuffer()
+				}
+			}
+			return true
+		}
+
+		for {
+			// the timer rules of the current state define how long to wait
+			deadline, _ := fsm.Deadline()
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(tcpReceiveBuffer)
+			if err != nil {
+				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+					if messageBuffer, action, expired := fsm.Expire(); expired {
+						if !performActions(action, messageBuffer) {
+							return
+						}
+					}
+					continue // on timeout....
+				}
+				atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
+				proto.receiveQ <- protocolMessage{
+					Status: DISCONNECT,
+					Data:   []byte(err.Error()),
+				}
+				return
+			}
+
+			for _, ascii := range tcpReceiveBuffer[:n] {
+				if checksumActive {
+					checksumSum += int(ascii)
+				}
+
+				messageBuffer, action, err := fsm.Push(ascii)
+				if err != nil {
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
+					proto.receiveQ <- protocolMessage{
+						Status: ERROR,
+						Data:   []byte(err.Error()),
+					}
+					return
+				}
+
+				if !performActions(action, messageBuffer) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (proto *definitionProtocol) Interrupt() {
+	// not implemented (not required neither)
+}
+
+func (proto *definitionProtocol) Send(conn net.Conn, data [][]byte) (int, error) {
+	if !proto.definition.canSend {
+		return 0, fmt.Errorf("protocol definition '%s' has no framing, sending is not supported", proto.definition.name)
+	}
+
+	msgBuff := make([]byte, 0)
+	msgBuff = append(msgBuff, proto.definition.start...)
+	for _, line := range data {
+		msgBuff = append(msgBuff, line...)
+		msgBuff = append(msgBuff, proto.definition.lineBreak...)
+	}
+	msgBuff = append(msgBuff, proto.definition.end...)
+
+	return conn.Write(msgBuff)
+}
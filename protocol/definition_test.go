@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+const lis1A1Definition = `
+name: lis1a1
+states: [init, established, frame, text, checksum, lineFeed, afterFrame]
+symbolClasses:
+  anyButEnq:
+    ranges: ["0x00-0xFF"]
+    except: [ENQ]
+  printable:
+    ranges: ["0x20-0xFF"]
+    bytes: [CR, LF]
+  hex:
+    ranges: ["0-9", "A-F", "a-f"]
+transitions:
+  - {from: init, symbols: [ENQ], to: established, action: Established}
+  - {from: init, symbols: [anyButEnq], to: init}
+  - {from: established, symbols: [STX], to: frame, action: FrameStart}
+  - {from: afterFrame, symbols: [STX], to: frame, action: FrameStart}
+  - {from: afterFrame, symbols: [EOT], to: init, action: Finished}
+  - {from: frame, symbols: ["0-7"], to: text, scan: true, action: FrameNumber}
+  - {from: text, symbols: [ETX, ETB], to: checksum, action: LineReceived}
+  - {from: text, symbols: [printable], to: text, scan: true}
+  - {from: checksum, symbols: [hex], to: checksum, scan: true}
+  - {from: checksum, symbols: [CR], to: lineFeed, action: CheckSum}
+  - {from: lineFeed, symbols: [LF], to: afterFrame, action: Established}
+actions:
+  Established: [ack]
+  FrameStart: [beginChecksum]
+  FrameNumber: [resetBuffer]
+  LineReceived: [endChecksum, append]
+  CheckSum: [validateChecksum]
+  Finished: [emit]
+`
+
+func TestDefinitionReceivesLis1A1Transmission(t *testing.T) {
+	definition, err := LoadDefinition([]byte(lis1A1Definition))
+	assert.Nil(t, err)
+	instance, err := FromDefinition(definition)
+	assert.Nil(t, err)
+
+	host, instrument := net.Pipe()
+	go func() {
+		answer := make([]byte, 1)
+		for _, frame := range [][]byte{
+			{utilities.ENQ},
+			[]byte("\u00021H|\\^&|||\r\u000359\r\n"),
+			[]byte("\u00022P|1||777025164810\r\u0003A7\r\n"),
+			[]byte("\u00023L|1|N\r\u000306\r\n"),
+		} {
+			instrument.Write(frame)
+			instrument.Read(answer)
+			assert.Equal(t, utilities.ACK, answer[0])
+		}
+		instrument.Write([]byte{utilities.EOT})
+	}()
+
+	message, err := instance.NewInstance().Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, "H|\\^&|||\r\rP|1||777025164810\r\rL|1|N\r\r", string(message))
+}
+
+func TestDefinitionRejectsInvalidChecksum(t *testing.T) {
+	definition, err := LoadDefinition([]byte(lis1A1Definition))
+	assert.Nil(t, err)
+	instance, err := FromDefinition(definition)
+	assert.Nil(t, err)
+
+	host, instrument := net.Pipe()
+	go func() {
+		answer := make([]byte, 1)
+		instrument.Write([]byte{utilities.ENQ})
+		instrument.Read(answer)
+		instrument.Write([]byte("\u00021H|\\^&|||\r\u000300\r\n"))
+		instrument.Read(answer)
+		assert.Equal(t, utilities.NAK, answer[0])
+	}()
+
+	_, err = instance.Receive(host)
+	assert.NotNil(t, err)
+}
+
+func TestDefinitionFromJSONWithFraming(t *testing.T) {
+	definition, err := LoadDefinition([]byte(`{
+		"name": "stx-etx",
+		"states": ["idle", "text"],
+		"transitions": [
+			{"from": "idle", "symbols": ["STX"], "to": "text"},
+			{"from": "text", "symbols": ["ETX"], "to": "idle", "action": "Done"},
+			{"from": "text", "symbols": ["0x20-0x7E"], "to": "text", "scan": true}
+		],
+		"actions": {"Done": ["append", "emit"]},
+		"framing": {"start": "STX", "end": "ETX", "lineBreak": "CR"}
+	}`))
+	assert.Nil(t, err)
+	instance, err := FromDefinition(definition)
+	assert.Nil(t, err)
+
+	host, instrument := net.Pipe()
+	go func() {
+		instrument.Write([]byte("\u0002Hello\u0003"))
+	}()
+	message, err := instance.Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello\r", string(message))
+
+	go func() {
+		instance.Send(host, [][]byte{[]byte("a"), []byte("b")})
+	}()
+	sent := make([]byte, 6)
+	n, err := instrument.Read(sent)
+	assert.Nil(t, err)
+	assert.Equal(t, "\u0002a\rb\r\u0003", string(sent[:n]))
+}
+
+func TestDefinitionValidation(t *testing.T) {
+	for _, invalid := range []string{
+		`states: []`,
+		`{states: [a], transitions: [{from: a, symbols: [STX], to: b}]}`,
+		`{states: [a], transitions: [{from: a, symbols: [NOSUCHSYMBOL], to: a}]}`,
+		`{states: [a], transitions: [{from: a, symbols: [STX], to: a, action: Undefined}]}`,
+		`{states: [a], actions: {X: [explode]}}`,
+		`{states: [a], symbolClasses: {x: {except: [y]}, y: {except: [x]}}}`,
+		`{states: [a], transitions: [{from: a, to: a, timeout: soon}]}`,
+		`{states: [a], transitions: [{from: a, symbols: [STX], to: a, timeout: 1s}]}`,
+	} {
+		definition, err := LoadDefinition([]byte(invalid))
+		assert.Nil(t, err)
+		_, err = FromDefinition(definition)
+		assert.ErrorIs(t, err, ErrInvalidDefinition, invalid)
+	}
+}
+
+func TestDefinitionTimeoutDiscardsIncompleteMessage(t *testing.T) {
+	definition, err := LoadDefinition([]byte(`
+states: [idle, text]
+transitions:
+  - {from: idle, symbols: [STX], to: text}
+  - {from: text, symbols: ["0x20-0x7E"], to: text, scan: true}
+  - {from: text, symbols: [ETX], to: idle, action: Done}
+  - {from: text, timeout: 50ms, to: idle, action: Abort}
+actions:
+  Done: [append, emit]
+  Abort: [resetBuffer, discard]
+`))
+	assert.Nil(t, err)
+	instance, err := FromDefinition(definition)
+	assert.Nil(t, err)
+
+	host, instrument := net.Pipe()
+	go func() {
+		instrument.Write([]byte("\u0002incomplete"))
+		time.Sleep(200 * time.Millisecond)
+		instrument.Write([]byte("\u0002complete\u0003"))
+	}()
+
+	message, err := instance.Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, "complete\r", string(message))
+}
@@ -1,6 +1,10 @@
 package protocol
 
-import "net"
+import (
+	"errors"
+	"net"
+	"time"
+)
 
 type Implementation interface {
 
@@ -31,3 +35,87 @@ type protocolMessage struct {
 	Status protocolMessageType
 	Data   []byte
 }
+
+// ProtocolEvent is a notable event within a protocol, e.g. for metrics
+type ProtocolEvent string
+
+const (
+	EventNAKSent       ProtocolEvent = "nak_sent"
+	EventNAKReceived   ProtocolEvent = "nak_received"
+	EventRetry         ProtocolEvent = "retry"
+	EventTimeout       ProtocolEvent = "timeout"
+	EventChecksumError ProtocolEvent = "checksum_error"
+	EventEstablished   ProtocolEvent = "established" // the receiver accepted the transmission, e.g. ENQ answered by ACK
+)
+
+// EventReporter receives the events of a protocol, e.g. the metrics.Collector
+type EventReporter interface {
+	// ProtocolEvent is called from the goroutines of the protocol, remoteAddr is the address of the connection
+	ProtocolEvent(remoteAddr string, event ProtocolEvent)
+}
+
+// EventSource is implemented by protocols that report events. The reporter receives the events
+// of this instance only, e.g. to add them to the trace of a session
+type EventSource interface {
+	AddEventReporter(reporter EventReporter)
+}
+
+// Journal records received messages durably, see Journaled
+type Journal interface {
+	// Record is called with a complete message before the protocol acknowledges it to the peer, in the
+	// order Receive returns the messages. extends is true if data continues the data of the previous Record,
+	// e.g. the next message of a LIS1A1 transfer that Receive returns as one. The message is not acknowledged
+	// if Record returns an error.
+	Record(data []byte, extends bool) error
+}
+
+// Journaled is implemented by protocols that acknowledge a message before Receive returns it, e.g. lis1A1
+// and au6xx. The journal is used by this instance only
+type Journaled interface {
+	SetJournal(journal Journal)
+}
+
+// ErrMessageRejected is returned by a handler, also wrapped, to reject a message as invalid instead of
+// failing on it, e.g. AR instead of AE in the acknowledgement of HL7
+var ErrMessageRejected = errors.New("message rejected")
+
+// ErrAcknowledgementPending is returned by Send while a received message waits for Acknowledge, sending
+// would interrupt the transfer of the peer. A handler answers with Enqueue instead.
+var ErrAcknowledgementPending = errors.New("a received message waits for its acknowledgement")
+
+// Acknowledger is implemented by protocols that acknowledge the received messages to the peer
+type Acknowledger interface {
+	// DeferAcknowledgement makes the final acknowledgement of every message wait until Acknowledge was called
+	// for it. It is called once before the first Receive and is false if the instance can not pass the
+	// result to the peer, e.g. without EnableAcknowledgement in the settings.
+	DeferAcknowledgement() bool
+	// Acknowledge answers the message Receive returned last, it must be called once for every message. A nil
+	// err accepts the message, otherwise it is refused (e.g. NAK) so that the peer sends it again. refused is
+	// false if the message was acknowledged before it was passed to Receive and the peer does not send it
+	// again, e.g. a LIS1A1 message without terminator record.
+	Acknowledge(conn net.Conn, err error) (refused bool, ackErr error)
+}
+
+// Heartbeater is implemented by protocols that can probe whether the peer is still there
+type Heartbeater interface {
+	// Heartbeat probes the peer on an idle connection and returns an error if the peer did not
+	// respond within the timeout. It is never called concurrently with Send.
+	Heartbeat(conn net.Conn, timeout time.Duration) error
+}
+
+// BusyReporter is implemented by protocols with transfer phases that must not be interrupted
+type BusyReporter interface {
+	// Busy is true during a transfer, e.g. from ENQ to EOT with lis1A1
+	Busy() bool
+}
+
+// writeHeartbeat writes a probe the peer does not answer, a dead peer shows when writing fails
+func writeHeartbeat(conn net.Conn, probe []byte, timeout time.Duration) error {
+	if len(probe) == 0 {
+		return nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write(probe)
+	return err
+}
@@ -0,0 +1,251 @@
+//
+//Implementation of a length-prefixed binary framing protocol.
+//
+//Every message is preceded by a length field that holds the number of payload bytes that
+//follow. Unlike STX-ETX or MLLP there are no sentinel bytes, so the payload may contain
+//any binary data.
+//
+//The format is as follows:
+//<LENGTH>dddd[<CRC32>]
+//
+//The size of the length field (2, 4 or 8 bytes), its byte order, the maximum frame size
+//and an optional CRC32 (IEEE) trailer over the payload are configurable.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+var (
+	ErrFrameTooLarge        = errors.New("frame exceeds the maximum frame size")
+	ErrFrameChecksumInvalid = errors.New("frame checksum does not match the payload")
+)
+
+const crc32TrailerSize = 4
+
+type LengthPrefixedProtocolSettings struct {
+	lengthFieldSize int
+	byteOrder       binary.ByteOrder
+	maxFrameSize    uint64
+	crc32Trailer    bool
+}
+
+func DefaultLengthPrefixedProtocolSettings() *LengthPrefixedProtocolSettings {
+	return &LengthPrefixedProtocolSettings{
+		lengthFieldSize: 4,
+		byteOrder:       binary.BigEndian,
+		maxFrameSize:    16 * 1024 * 1024,
+		crc32Trailer:    false,
+	}
+}
+
+// SetLengthFieldSize sets the size of the length field in bytes. Valid sizes are 2, 4 and 8.
+// Default is 4
+func (s LengthPrefixedProtocolSettings) SetLengthFieldSize(size int) *LengthPrefixedProtocolSettings {
+	s.lengthFieldSize = size
+	return &s
+}
+
+func (s LengthPrefixedProtocolSettings) SetBigEndian() *LengthPrefixedProtocolSettings {
+	s.byteOrder = binary.BigEndian
+	return &s
+}
+
+func (s LengthPrefixedProtocolSettings) SetLittleEndian() *LengthPrefixedProtocolSettings {
+	s.byteOrder = binary.LittleEndian
+	return &s
+}
+
+// SetMaxFrameSize limits the size of the payload of one frame (without length field and trailer).
+// Default is 16 MiB
+func (s LengthPrefixedProtocolSettings) SetMaxFrameSize(maxFrameSize uint64) *LengthPrefixedProtocolSettings {
+	s.maxFrameSize = maxFrameSize
+	return &s
+}
+
+func (s LengthPrefixedProtocolSettings) EnableCRC32Trailer() *LengthPrefixedProtocolSettings {
+	s.crc32Trailer = true
+	return &s
+}
+
+func (s LengthPrefixedProtocolSettings) DisableCRC32Trailer() *LengthPrefixedProtocolSettings {
+	s.crc32Trailer = false
+	return &s
+}
+
+type lengthPrefixed struct {
+	settings *LengthPrefixedProtocolSettings
+	// once the length of a frame could not be trusted, the position in the stream is lost
+	// and no further frames can be read from this connection
+	desynchronized bool
+}
+
+func LengthPrefixed(settings ...*LengthPrefixedProtocolSettings) Implementation {
+
+	var thesettings *LengthPrefixedProtocolSettings
+	if len(settings) >= 1 {
+		thesettings = settings[0]
+	} else {
+		thesettings = DefaultLengthPrefixedProtocolSettings()
+	}
+
+	return &lengthPrefixed{
+		settings: thesettings,
+	}
+}
+
+func (proto *lengthPrefixed) NewInstance() Implementation {
+	return &lengthPrefixed{
+		settings: proto.settings,
+	}
+}
+
+// Receive reads exactly one frame. The returned slice is the buffer the payload was read
+// into, it is not copied again before it is handed out.
+func (proto *lengthPrefixed) Receive(conn net.Conn) ([]byte, error) {
+
+	if err := proto.validateSettings(); err != nil {
+		return []byte{}, err
+	}
+
+	if proto.desynchronized {
+		return []byte{}, io.EOF
+	}
+
+	var header [8]byte
+	lengthField := header[:proto.settings.lengthFieldSize]
+	if n, err := io.ReadFull(conn, lengthField); err != nil {
+		// a part of the length field was read, e.g. before a read deadline expired
+		proto.desynchronized = n > 0
+		return []byte{}, readErrorToEOF(err)
+	}
+
+	frameSize := proto.decodeLength(lengthField)
+	if frameSize > proto.settings.maxFrameSize {
+		proto.desynchronized = true
+		return []byte{}, fmt.Errorf("%w (size: %d, max: %d)", ErrFrameTooLarge, frameSize, proto.settings.maxFrameSize)
+	}
+
+	// from here on every failed read leaves the stream inside the frame
+	payload := make([]byte, frameSize)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		proto.desynchronized = true
+		return []byte{}, readErrorToEOF(err)
+	}
+
+	if proto.settings.crc32Trailer {
+		var trailer [crc32TrailerSize]byte
+		if _, err := io.ReadFull(conn, trailer[:]); err != nil {
+			proto.desynchronized = true
+			return []byte{}, readErrorToEOF(err)
+		}
+		want := proto.settings.byteOrder.Uint32(trailer[:])
+		if given := crc32.ChecksumIEEE(payload); given != want {
+			return []byte{}, fmt.Errorf("%w (want: %08X, given: %08X)", ErrFrameChecksumInvalid, want, given)
+		}
+	}
+
+	return payload, nil
+}
+
+func (proto *lengthPrefixed) Interrupt() {
+	// not implemented (not required neither)
+}
+
+// Send transmits all lines as one frame. The lines are concatenated without separator.
+func (proto *lengthPrefixed) Send(conn net.Conn, data [][]byte) (int, error) {
+
+	if err := proto.validateSettings(); err != nil {
+		return 0, err
+	}
+
+	frameSize := 0
+	for _, line := range data {
+		frameSize += len(line)
+	}
+	maxSize := proto.settings.maxFrameSize
+	if proto.maxEncodableLength() < maxSize {
+		maxSize = proto.maxEncodableLength()
+	}
+	if uint64(frameSize) > maxSize {
+		return 0, fmt.Errorf("%w (size: %d, max: %d)", ErrFrameTooLarge, frameSize, maxSize)
+	}
+
+	trailerSize := 0
+	if proto.settings.crc32Trailer {
+		trailerSize = crc32TrailerSize
+	}
+
+	msgBuff := make([]byte, proto.settings.lengthFieldSize, proto.settings.lengthFieldSize+frameSize+trailerSize)
+	proto.encodeLength(msgBuff, uint64(frameSize))
+	for _, line := range data {
+		msgBuff = append(msgBuff, line...)
+	}
+
+	if proto.settings.crc32Trailer {
+		var trailer [crc32TrailerSize]byte
+		proto.settings.byteOrder.PutUint32(trailer[:], crc32.ChecksumIEEE(msgBuff[proto.settings.lengthFieldSize:]))
+		msgBuff = append(msgBuff, trailer[:]...)
+	}
+
+	return conn.Write(msgBuff)
+}
+
+func (proto *lengthPrefixed) validateSettings() error {
+	switch proto.settings.lengthFieldSize {
+	case 2, 4, 8:
+	default:
+		return fmt.Errorf("invalid length field size %d - must be 2, 4 or 8 bytes", proto.settings.lengthFieldSize)
+	}
+	if proto.settings.byteOrder == nil {
+		return errors.New("invalid length-prefixed settings - no byte order set")
+	}
+	return nil
+}
+
+func (proto *lengthPrefixed) decodeLength(lengthField []byte) uint64 {
+	switch proto.settings.lengthFieldSize {
+	case 2:
+		return uint64(proto.settings.byteOrder.Uint16(lengthField))
+	case 4:
+		return uint64(proto.settings.byteOrder.Uint32(lengthField))
+	default:
+		return proto.settings.byteOrder.Uint64(lengthField)
+	}
+}
+
+func (proto *lengthPrefixed) encodeLength(lengthField []byte, length uint64) {
+	switch proto.settings.lengthFieldSize {
+	case 2:
+		proto.settings.byteOrder.PutUint16(lengthField, uint16(length))
+	case 4:
+		proto.settings.byteOrder.PutUint32(lengthField, uint32(length))
+	default:
+		proto.settings.byteOrder.PutUint64(lengthField, length)
+	}
+}
+
+func (proto *lengthPrefixed) maxEncodableLength() uint64 {
+	if proto.settings.lengthFieldSize == 8 {
+		return ^uint64(0)
+	}
+	return uint64(1)<<(8*proto.settings.lengthFieldSize) - 1
+}
+
+// readErrorToEOF maps all errors that mean "the connection is gone" to io.EOF, which is
+// a disconnect for the server and client
+func readErrorToEOF(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "read" && !opErr.Timeout() {
+		return io.EOF
+	}
+	return err
+}
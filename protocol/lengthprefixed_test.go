@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLengthPrefixedReceiveBinaryPayload(t *testing.T) {
+	host, instrument := net.Pipe()
+
+	instance := LengthPrefixed()
+	go func() {
+		// STX, ETX, VT and FS inside the payload must not be mistaken for framing
+		payload := []byte{utilities.STX, 0x00, utilities.ETX, utilities.VT, 0xFF, utilities.FS}
+		frame := []byte{0x00, 0x00, 0x00, byte(len(payload))}
+		frame = append(frame, payload...)
+		frame = append(frame, 0x00, 0x00, 0x00, 0x02, 'o', 'k')
+		instrument.Write(frame)
+		instrument.Close()
+	}()
+
+	message, err := instance.Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{utilities.STX, 0x00, utilities.ETX, utilities.VT, 0xFF, utilities.FS}, message)
+
+	message, err = instance.Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(message))
+
+	_, err = instance.Receive(host)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLengthPrefixedSendAndReceiveAllSettings(t *testing.T) {
+	for _, settings := range []*LengthPrefixedProtocolSettings{
+		DefaultLengthPrefixedProtocolSettings().SetLengthFieldSize(2),
+		DefaultLengthPrefixedProtocolSettings().SetLengthFieldSize(8).SetLittleEndian(),
+		DefaultLengthPrefixedProtocolSettings().SetLittleEndian().EnableCRC32Trailer(),
+	} {
+		host, instrument := net.Pipe()
+		sender := LengthPrefixed(settings)
+		receiver := sender.NewInstance()
+
+		go func() {
+			sender.Send(instrument, [][]byte{[]byte("first "), {0x02, 0x03}, []byte(" last")})
+		}()
+
+		message, err := receiver.Receive(host)
+		assert.Nil(t, err)
+		assert.Equal(t, append(append([]byte("first "), 0x02, 0x03), []byte(" last")...), message)
+	}
+}
+
+func TestLengthPrefixedLittleEndianWireFormat(t *testing.T) {
+	host, instrument := net.Pipe()
+
+	instance := LengthPrefixed(DefaultLengthPrefixedProtocolSettings().SetLengthFieldSize(2).SetLittleEndian().EnableCRC32Trailer())
+	go func() {
+		instance.Send(instrument, [][]byte{[]byte("abc")})
+	}()
+
+	buffer := make([]byte, 9)
+	_, err := io.ReadFull(host, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x03, 0x00, 'a', 'b', 'c'}, buffer[:5])
+	assert.Equal(t, crc32.ChecksumIEEE([]byte("abc")), binary.LittleEndian.Uint32(buffer[5:]))
+}
+
+func TestLengthPrefixedInvalidChecksum(t *testing.T) {
+	host, instrument := net.Pipe()
+
+	instance := LengthPrefixed(DefaultLengthPrefixedProtocolSettings().SetLengthFieldSize(2).EnableCRC32Trailer())
+	go func() {
+		instrument.Write([]byte{0x00, 0x01, 'x', 0xDE, 0xAD, 0xBE, 0xEF})
+		instrument.Write([]byte{0x00, 0x01, 'y'})
+		trailer := make([]byte, 4)
+		binary.BigEndian.PutUint32(trailer, crc32.ChecksumIEEE([]byte("y")))
+		instrument.Write(trailer)
+	}()
+
+	_, err := instance.Receive(host)
+	assert.ErrorIs(t, err, ErrFrameChecksumInvalid)
+
+	// the frame boundary is still intact, the next frame can be read
+	message, err := instance.Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, "y", string(message))
+}
+
+func TestLengthPrefixedFrameTooLarge(t *testing.T) {
+	host, instrument := net.Pipe()
+
+	instance := LengthPrefixed(DefaultLengthPrefixedProtocolSettings().SetMaxFrameSize(10))
+	go func() {
+		instrument.Write([]byte{0x7F, 0xFF, 0xFF, 0xFF})
+	}()
+
+	_, err := instance.Receive(host)
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+
+	// the position in the stream is lost, the connection is regarded as disconnected
+	_, err = instance.Receive(host)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = instance.Send(host, [][]byte{make([]byte, 11)})
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+}
+
+func TestLengthPrefixedTimeoutWithinFrame(t *testing.T) {
+	host, instrument := net.Pipe()
+
+	instance := LengthPrefixed()
+	go func() {
+		// the payload is cut off after 2 of 5 bytes
+		instrument.Write([]byte{0x00, 0x00, 0x00, 0x05, 'h', 'e'})
+	}()
+
+	host.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := instance.Receive(host)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	// the rest of the payload must not be read as the next length field
+	go func() {
+		instrument.Write([]byte{'l', 'l', 'o'})
+	}()
+	host.SetReadDeadline(time.Time{})
+	_, err = instance.Receive(host)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLengthPrefixedSendReportsTheEncodableLength(t *testing.T) {
+	host, _ := net.Pipe()
+
+	instance := LengthPrefixed(DefaultLengthPrefixedProtocolSettings().SetLengthFieldSize(2))
+	_, err := instance.Send(host, [][]byte{make([]byte, 65536)})
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+	assert.Contains(t, err.Error(), "max: 65535")
+}
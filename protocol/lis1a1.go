@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
@@ -27,6 +28,9 @@ type Lis1A1ProtocolSettings struct {
 	sendTimeoutDuration            time.Duration
 	strictFrameOrder               bool
 	lineEnding                     []byte
+	transitionObserver             utilities.TransitionObserver
+	eventReporter                  EventReporter
+	acknowledgement                bool
 }
 
 func (s Lis1A1ProtocolSettings) EnableStrictChecksum() *Lis1A1ProtocolSettings {
@@ -77,6 +81,26 @@ func (s Lis1A1ProtocolSettings) SetLineEnding(lineEnding []byte) *Lis1A1Protocol
 	return &s
 }
 
+// EnableAcknowledgement holds back the ACK of the frame with the terminator record until the handler
+// returned, a handler error answers it with NAK (see Acknowledger). The handler must answer with Enqueue
+// then, Send fails with ErrAcknowledgementPending while the ACK is held back.
+func (s Lis1A1ProtocolSettings) EnableAcknowledgement() *Lis1A1ProtocolSettings {
+	s.acknowledgement = true
+	return &s
+}
+
+// SetTransitionObserver receives every transition of the state machine, e.g. utilities.ZerologTransitionObserver
+func (s Lis1A1ProtocolSettings) SetTransitionObserver(observer utilities.TransitionObserver) *Lis1A1ProtocolSettings {
+	s.transitionObserver = observer
+	return &s
+}
+
+// SetEventReporter receives NAKs, retries, timeouts and checksum errors, e.g. the metrics.Collector
+func (s Lis1A1ProtocolSettings) SetEventReporter(eventReporter EventReporter) *Lis1A1ProtocolSettings {
+	s.eventReporter = eventReporter
+	return &s
+}
+
 type ProcessState struct {
 	State              int
 	LastMessage        string
@@ -92,16 +116,20 @@ const (
 	FrameNumber  utilities.ActionCode = "FrameNumber"
 )
 
+// lis1a1ReceiverTimeout is the receiver timeout of ASTM E1381 8.5.1.2: the receiver waits 30 seconds for the
+// next frame or EOT, then the transmission is aborted
+const lis1a1ReceiverTimeout = 30 * time.Second
+
 var Rules []utilities.Rule = []utilities.Rule{
 	{FromState: utilities.Init, Symbols: []byte{utilities.EOT}, ToState: utilities.Init, Scan: false},
-	// everything except ENQ
-	{FromState: utilities.Init, Symbols: []byte{0, 1, 2, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64, 65, 66, 67, 68, 69, 70, 71, 72, 73, 74, 75, 76, 77, 78, 79, 80, 81, 82, 83, 84, 85, 86, 87, 88, 89, 90, 91, 92, 93, 94, 95, 96, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 110, 111, 112, 113, 114, 115, 116, 117, 118, 119, 120, 121, 122, 123, 124, 125, 126, 127, 128, 129, 130, 131, 132, 133, 134, 135, 136, 137, 138, 139, 140, 141, 142, 143, 144, 145, 146, 147, 148, 149, 150, 151, 152, 153, 154, 155, 156, 157, 158, 159, 160, 161, 162, 163, 164, 165, 166, 167, 168, 169, 170, 171, 172, 173, 174, 175, 176, 177, 178, 179, 180, 181, 182, 183, 184, 185, 186, 187, 188, 189, 190, 191, 192, 193, 194, 195, 196, 197, 198, 199, 200, 201, 202, 203, 204, 205, 206, 207, 208, 209, 210, 211, 212, 213, 214, 215, 216, 217, 218, 219, 220, 221, 222, 223, 224, 225, 226, 227, 228, 229, 230, 231, 232, 233, 234, 235, 236, 237, 238, 239, 240, 241, 242, 243, 244, 245, 246, 247, 248, 249, 250, 251, 252, 253, 254, 255}, ToState: utilities.Init, Scan: false},
+	// everything except ENQ (and EOT, see above)
+	{FromState: utilities.Init, Symbols: []byte{0, 1, 2, 3, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64, 65, 66, 67, 68, 69, 70, 71, 72, 73, 74, 75, 76, 77, 78, 79, 80, 81, 82, 83, 84, 85, 86, 87, 88, 89, 90, 91, 92, 93, 94, 95, 96, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 110, 111, 112, 113, 114, 115, 116, 117, 118, 119, 120, 121, 122, 123, 124, 125, 126, 127, 128, 129, 130, 131, 132, 133, 134, 135, 136, 137, 138, 139, 140, 141, 142, 143, 144, 145, 146, 147, 148, 149, 150, 151, 152, 153, 154, 155, 156, 157, 158, 159, 160, 161, 162, 163, 164, 165, 166, 167, 168, 169, 170, 171, 172, 173, 174, 175, 176, 177, 178, 179, 180, 181, 182, 183, 184, 185, 186, 187, 188, 189, 190, 191, 192, 193, 194, 195, 196, 197, 198, 199, 200, 201, 202, 203, 204, 205, 206, 207, 208, 209, 210, 211, 212, 213, 214, 215, 216, 217, 218, 219, 220, 221, 222, 223, 224, 225, 226, 227, 228, 229, 230, 231, 232, 233, 234, 235, 236, 237, 238, 239, 240, 241, 242, 243, 244, 245, 246, 247, 248, 249, 250, 251, 252, 253, 254, 255}, ToState: utilities.Init, Scan: false},
 	{FromState: utilities.Init, Symbols: []byte{utilities.ENQ}, ToState: 1, Scan: false, ActionCode: JustAck},
 
 	{FromState: 1, Symbols: []byte{utilities.STX}, ToState: 99, Scan: false},
 
 	{FromState: 99, Symbols: []byte("01234567"), ToState: 100, Scan: true, ActionCode: FrameNumber},
-	{FromState: 99, Symbols: utilities.PrintableChars8Bit, ToState: 2, Scan: true, ActionCode: FrameNumber}, //  TODO: exclude 0...7
+	{FromState: 99, Symbols: utilities.Exclude(utilities.PrintableChars8Bit, []byte("01234567")), ToState: 2, Scan: true, ActionCode: FrameNumber},
 	{FromState: 100, Symbols: utilities.PrintableChars8Bit, ToState: 2, Scan: true},
 
 	{FromState: 2, Symbols: utilities.PrintableChars8Bit, ToState: 2, Scan: true},
@@ -118,12 +146,24 @@ var Rules []utilities.Rule = []utilities.Rule{
 	{FromState: 11, Symbols: []byte{utilities.LF}, ToState: 12, Scan: false, ActionCode: JustAck},
 	{FromState: 12, Symbols: []byte{utilities.STX}, ToState: 99, Scan: false},
 	{FromState: 12, Symbols: []byte{utilities.EOT}, ToState: utilities.Init, Scan: false, ActionCode: utilities.Finished},
+
+	// 8.5.1.2 - the receiver timeout
+	{FromState: 1, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 99, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 100, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 2, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 20, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 21, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 22, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 10, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 11, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
+	{FromState: 12, Timeout: lis1a1ReceiverTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout},
 }
 
 type lis1A1 struct {
 	settings               *Lis1A1ProtocolSettings
 	receiveQ               chan protocolMessage
-	receiveThreadIsRunning bool
+	receiveThreadIsRunning int32
 	state                  ProcessState
 
 	// The waitgroups are used as latches since the read-goroutine
@@ -133,6 +173,30 @@ type lis1A1 struct {
 	// finished.
 	asyncReadActive sync.WaitGroup
 	asyncSendActive sync.WaitGroup
+	// readInterrupts counts the sends that stop the read-routine, it must not replace their deadline
+	readInterrupts int32
+
+	// reporters of this instance in addition to the one of the settings
+	eventReportersMutex sync.Mutex
+	eventReporters      []EventReporter
+
+	// receiving is 1 during a transmission of the peer, heartbeats are skipped then
+	receiving int32
+	// sending is 1 during Send
+	sending int32
+	// pending are bytes a heartbeat read that belong to the receive loop, e.g. the ENQ of the peer
+	pendingMutex sync.Mutex
+	pending      []byte
+	// journal records the messages before the ACK of their last frame
+	journalMutex sync.Mutex
+	journal      Journal
+	// acknowledgementDeferred is 1 if the ACK of the terminator record waits for Acknowledge
+	acknowledgementDeferred int32
+	// acknowledgementPending is 1 while a message waits for Acknowledge
+	acknowledgementPending int32
+	// acknowledgementRefusable is 1 if the pending message was not acknowledged yet
+	acknowledgementRefusable int32
+	acknowledgements         chan error
 }
 
 func DefaultLis1A1ProtocolSettings() *Lis1A1ProtocolSettings {
@@ -157,9 +221,10 @@ func Lis1A1Protocol(settings ...*Lis1A1ProtocolSettings) Implementation {
 	return &lis1A1{
 		settings:               theSettings,
 		receiveQ:               make(chan protocolMessage),
-		receiveThreadIsRunning: false,
+		receiveThreadIsRunning: 0,
 		asyncReadActive:        sync.WaitGroup{},
 		asyncSendActive:        sync.WaitGroup{},
+		acknowledgements:       make(chan error, 1),
 	}
 }
 
@@ -167,7 +232,8 @@ func (proto *lis1A1) NewInstance() Implementation {
 	return &lis1A1{
 		settings:               proto.settings,
 		receiveQ:               make(chan protocolMessage),
-		receiveThreadIsRunning: false,
+		receiveThreadIsRunning: 0,
+		acknowledgements:       make(chan error, 1),
 	}
 }
 
@@ -200,55 +266,159 @@ func (proto *lis1A1) Receive(conn net.Conn) ([]byte, error) {
 
 func (proto *lis1A1) transferMessageToHandler(messageLog [][]byte) {
 	// looks like message is successfully transferred
+	proto.receiveQ <- protocolMessage{
+		Status: DATA,
+		Data:   joinMessageLog(messageLog),
+	}
+}
+
+func joinMessageLog(messageLog [][]byte) []byte {
 	fullMsg := make([]byte, 0)
 	for _, messageLine := range messageLog {
 		fullMsg = append(fullMsg, []byte(messageLine)...)
 		fullMsg = append(fullMsg, utilities.CR)
 	}
+	return fullMsg
+}
 
-	proto.receiveQ <- protocolMessage{
-		Status: DATA,
-		Data:   fullMsg,
+// DeferAcknowledgement passes every message to Receive when the frame with its terminator record arrived
+// and answers that frame with ACK or NAK after Acknowledge. A message that is not terminated is passed
+// with the EOT, its frames are acknowledged already.
+func (proto *lis1A1) DeferAcknowledgement() bool {
+	if !proto.settings.acknowledgement {
+		return false
+	}
+	atomic.StoreInt32(&proto.acknowledgementDeferred, 1)
+	return true
+}
+
+func (proto *lis1A1) Acknowledge(conn net.Conn, err error) (bool, error) {
+	if atomic.LoadInt32(&proto.acknowledgementDeferred) == 0 {
+		return false, nil
+	}
+	refusable := atomic.LoadInt32(&proto.acknowledgementRefusable) == 1
+	select {
+	case proto.acknowledgements <- err:
+	default:
+		return false, errors.New("the message was acknowledged already")
 	}
+	return err != nil && refusable, nil
+}
+
+// deliver passes the message to Receive, it returns the result of Acknowledge if the acknowledgement is deferred.
+// refusable is false if the message was acknowledged already.
+func (proto *lis1A1) deliver(messageLog [][]byte, refusable bool) error {
+	if atomic.LoadInt32(&proto.acknowledgementDeferred) == 0 {
+		proto.transferMessageToHandler(messageLog)
+		return nil
+	}
+	if refusable {
+		atomic.StoreInt32(&proto.acknowledgementRefusable, 1)
+	} else {
+		atomic.StoreInt32(&proto.acknowledgementRefusable, 0)
+	}
+	// pending before the handler has the message, it may call Send at once
+	atomic.StoreInt32(&proto.acknowledgementPending, 1)
+	defer atomic.StoreInt32(&proto.acknowledgementPending, 0)
+	proto.transferMessageToHandler(messageLog)
+	return <-proto.acknowledgements
+}
+
+func isTerminatorRecord(record []byte) bool {
+	return len(record) > 0 && record[0] == 'L'
+}
+
+func (proto *lis1A1) SetJournal(journal Journal) {
+	proto.journalMutex.Lock()
+	defer proto.journalMutex.Unlock()
+	proto.journal = journal
+}
+
+// recordJournal records the lines of a message, extends is true if they continue the lines of the transfer
+// that were recorded before
+func (proto *lis1A1) recordJournal(messageLog [][]byte, extends bool) error {
+	proto.journalMutex.Lock()
+	journal := proto.journal
+	proto.journalMutex.Unlock()
+	if journal == nil {
+		return nil
+	}
+	return journal.Record(joinMessageLog(messageLog), extends)
 }
 
 // asynchronous receive loop
 func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 
-	if proto.receiveThreadIsRunning {
+	if !atomic.CompareAndSwapInt32(&proto.receiveThreadIsRunning, 0, 1) {
 		return
 	}
 
 	go func() {
 		// fmt.Println("Start Receiving Thread")
-		proto.receiveThreadIsRunning = true
 
 		proto.state.State = 0 // initial state for FSM
 		lastMessage := make([]byte, 0)
 		fileBuffer := make([][]byte, 0)
+		// the frame ended with ETX, with a terminator record it completes a message that is recorded before the ACK
+		messageComplete := false
+		// the lines of fileBuffer that are in the journal already
+		recordedLines := 0
+		// the handler refused the last message, the sender repeats its terminator frame or gives up
+		refused := false
 
 		tcpReceiveBuffer := make([]byte, 4096)
 		nextExpectedFrameNumber := 1
 
 		// init state machine
 		fsm := utilities.CreateFSM(Rules)
-		for {
-			conn.SetReadDeadline(time.Time{}) // NO timeout ever
+		if proto.settings.transitionObserver != nil {
+			fsm.SetTransitionObserver(proto.settings.transitionObserver)
+		}
 
+		// refuseFrame answers the last frame with NAK, the sender repeats it with the same frame number
+		refuseFrame := func() {
+			if _, err := conn.Write([]byte{utilities.NAK}); err != nil {
+				fsm.Init()
+			}
+			proto.reportEvent(conn, EventNAKSent)
+			fileBuffer = fileBuffer[:len(fileBuffer)-1]
+			nextExpectedFrameNumber = (nextExpectedFrameNumber + 7) % 8
+		}
+		for {
 			proto.asyncSendActive.Wait()
 			proto.asyncReadActive.Add(1)
-			conn.SetDeadline(time.Now().Add(time.Second * 30))
-			n, err := conn.Read(tcpReceiveBuffer)
+			// the timer rules of the current state define how long to wait, no timeout in the idle state
+			deadline, inTransmission := fsm.Deadline()
+			proto.setReceiving(inTransmission)
+			n, err := proto.takePending(tcpReceiveBuffer)
+			if n == 0 {
+				conn.SetDeadline(deadline)
+				if atomic.LoadInt32(&proto.readInterrupts) > 0 {
+					// a send interrupted reading before the deadline was set
+					conn.SetReadDeadline(time.Now())
+				}
+				n, err = conn.Read(tcpReceiveBuffer)
+			}
 			proto.asyncReadActive.Done()
 			if os.Getenv("BNETDEBUG") == "true" {
 				fmt.Printf("bnet.lisa1.Receive received %s (%d bytes) (raw: % X)\n", string(tcpReceiveBuffer[:n]), n, tcpReceiveBuffer[:n])
 			}
 			if err != nil {
 				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-					fsm.Init()
+					// either the timer of the state expired or a send interrupted reading
+					if _, action, expired := fsm.Expire(); expired && action == utilities.Timeout {
+						log.Warn().Msg("lis1a1: no data within 30 seconds - transmission aborted")
+						proto.reportEvent(conn, EventTimeout)
+						lastMessage = make([]byte, 0)
+						fileBuffer = make([][]byte, 0)
+						messageComplete = false
+						recordedLines = 0
+						refused = false
+						fsm.ResetBuffer()
+					}
 					continue // on timeout....
 				} else if opErr, ok := err.(*net.OpError); ok && opErr.Op == "read" {
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					proto.receiveQ <- protocolMessage{
 						Status: DISCONNECT,
 						Data:   []byte(err.Error()),
@@ -259,7 +429,7 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 						Status: DISCONNECT,
 						Data:   []byte(err.Error()),
 					}
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					return
 				}
 
@@ -267,7 +437,7 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 					Status: DISCONNECT,
 					Data:   []byte(err.Error()),
 				}
-				proto.receiveThreadIsRunning = false
+				atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 				return
 			}
 
@@ -278,7 +448,7 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 						Status: ERROR,
 						Data:   []byte(err.Error()),
 					}
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					return
 				}
 				switch action {
@@ -296,18 +466,20 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 					}
 
 					_, err = conn.Write([]byte{utilities.NAK})
+					proto.reportEvent(conn, EventNAKSent)
 					if err != nil {
 						protocolMsg.Data = append(protocolMsg.Data, []byte(err.Error())...)
 					}
 
 					proto.receiveQ <- protocolMsg
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					return
 
 				case LineReceived:
 					// append Data
 					lastMessage = messageBuffer
 					fileBuffer = append(fileBuffer, lastMessage)
+					messageComplete = ascii == utilities.ETX
 					fsm.ResetBuffer()
 
 				case utilities.CheckSum:
@@ -316,18 +488,20 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 						currentChecksum := computeChecksum([]byte(proto.state.currentFrameNumber), lastMessage, []byte{utilities.ETX})
 
 						if string(currentChecksum) != string(messageBuffer) {
+							proto.reportEvent(conn, EventChecksumError)
 							protocolMsg := protocolMessage{
 								Status: ERROR,
 								Data:   []byte(fmt.Sprintf("Invalid Checksum. want: %s given: %s ", string(currentChecksum), string(messageBuffer))),
 							}
 
 							_, err = conn.Write([]byte{utilities.NAK})
+							proto.reportEvent(conn, EventNAKSent)
 							if err != nil {
 								protocolMsg.Data = append(protocolMsg.Data, []byte(err.Error())...)
 							}
 
 							proto.receiveQ <- protocolMsg
-							proto.receiveThreadIsRunning = false
+							atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 							return
 						}
 					}
@@ -336,17 +510,58 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 
 				case utilities.Finished:
 					// send fileData
-					proto.transferMessageToHandler(fileBuffer)
+					if refused {
+						// the sender gave up on the refused message
+						log.Warn().Msg("lis1a1: the sender ended the transmission after a refused message")
+					} else if atomic.LoadInt32(&proto.acknowledgementDeferred) == 0 || len(fileBuffer) > 0 {
+						if len(fileBuffer) > recordedLines {
+							// the lines after the last terminator record, their frames were acknowledged already
+							if err := proto.recordJournal(fileBuffer[recordedLines:], recordedLines > 0); err != nil {
+								log.Error().Err(err).Msg("lis1a1: acknowledged message not recorded in the journal")
+							}
+						}
+						if err := proto.deliver(fileBuffer, false); err != nil {
+							log.Warn().Err(err).Msg("lis1a1: the message without terminator record was acknowledged already")
+						}
+					}
+					refused = false
 
 					// fmt.Println("Exit handler !!!!!!!!!!!!!!!!!")
 					// TODO: reinitialize FSM would be sufficient
 					//proto.receiveThreadIsRunning = false
 					//return
 					fileBuffer = make([][]byte, 0)
+					recordedLines = 0
 					fsm.ResetBuffer()
 					fsm.Init()
 				case JustAck:
 					conn.SetDeadline(time.Time{})
+					if messageComplete && isTerminatorRecord(fileBuffer[len(fileBuffer)-1]) {
+						// the lines of the message are recorded once, before the ACK of its last frame
+						if err := proto.recordJournal(fileBuffer[recordedLines:], recordedLines > 0); err != nil {
+							log.Error().Err(err).Msg("lis1a1: message not recorded in the journal, the frame is refused")
+							messageComplete = false
+							refuseFrame()
+							continue
+						}
+						recordedLines = len(fileBuffer)
+
+						if atomic.LoadInt32(&proto.acknowledgementDeferred) == 1 {
+							// the handler decides about the ACK of the last frame of the message
+							if err := proto.deliver(fileBuffer, true); err != nil {
+								log.Warn().Err(err).Msg("lis1a1: the handler refused the message, sending NAK")
+								messageComplete = false
+								refuseFrame()
+								recordedLines = 0
+								refused = true
+								continue
+							}
+							fileBuffer = make([][]byte, 0)
+							recordedLines = 0
+							refused = false
+						}
+					}
+					messageComplete = false
 					bytes, err := conn.Write([]byte{utilities.ACK})
 					if bytes != 1 {
 						if os.Getenv("BNETDEBUG") == "true" {
@@ -368,11 +583,12 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 						}
 						conn.SetDeadline(time.Time{})
 						_, err = conn.Write([]byte{utilities.NAK})
+						proto.reportEvent(conn, EventNAKSent)
 						if err != nil {
 							protocolMsg.Data = append(protocolMsg.Data, []byte(err.Error())...)
 						}
 						proto.receiveQ <- protocolMsg
-						proto.receiveThreadIsRunning = false
+						atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 						return
 					}
 
@@ -394,11 +610,12 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 
 					conn.SetDeadline(time.Time{})
 					_, err = conn.Write([]byte{utilities.NAK})
+					proto.reportEvent(conn, EventNAKSent)
 					if err != nil {
 						protocolMsg.Data = append(protocolMsg.Data, []byte(err.Error())...)
 					}
 					proto.receiveQ <- protocolMsg
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					fmt.Println("Disconnect due to unexpected, unkown and unlikley error")
 					return
 				}
@@ -407,6 +624,64 @@ func (proto *lis1A1) ensureReceiveThreadRunning(conn net.Conn) {
 	}()
 }
 
+func (proto *lis1A1) setReceiving(receiving bool) {
+	if receiving {
+		atomic.StoreInt32(&proto.receiving, 1)
+	} else {
+		atomic.StoreInt32(&proto.receiving, 0)
+	}
+}
+
+func (proto *lis1A1) takePending(buffer []byte) (int, error) {
+	proto.pendingMutex.Lock()
+	defer proto.pendingMutex.Unlock()
+	n := copy(buffer, proto.pending)
+	proto.pending = proto.pending[n:]
+	return n, nil
+}
+
+// Heartbeat establishes a transmission and ends it without data (ENQ, ACK, EOT). The NAK of a busy
+// peer is an answer as well. If the peer wants to send at the same time (ENQ), its ENQ is passed to
+// the receive loop. There is no heartbeat during a transmission of the peer.
+func (proto *lis1A1) Heartbeat(conn net.Conn, timeout time.Duration) error {
+	if atomic.LoadInt32(&proto.receiving) == 1 {
+		return nil
+	}
+
+	proto.asyncSendActive.Add(1)
+	defer proto.asyncSendActive.Done()
+
+	proto.interruptReading(conn)
+	defer conn.SetDeadline(time.Time{})
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{utilities.ENQ}); err != nil {
+		return err
+	}
+
+	answer := make([]byte, 1)
+	if _, err := conn.Read(answer); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			proto.reportEvent(conn, EventTimeout)
+			return fmt.Errorf("no answer to the heartbeat - %w", ReceiverDoesNotRespond)
+		}
+		return err
+	}
+
+	switch answer[0] {
+	case utilities.ACK:
+		_, err := conn.Write([]byte{utilities.EOT})
+		return err
+	case utilities.NAK:
+		return nil
+	default:
+		proto.pendingMutex.Lock()
+		proto.pending = append(proto.pending, answer[0])
+		proto.pendingMutex.Unlock()
+		return nil
+	}
+}
+
 func (proto *lis1A1) Interrupt() {
 	// not implemented (not required neither)
 }
@@ -458,14 +733,22 @@ func (proto *lis1A1) sendFrameAndReceiveAnswer(frame []byte, frameNumber int, co
 	return receivedMsg, nil
 }
 
+// interruptReading stops the read-routine and waits until it left conn.Read. The read-routine checks
+// readInterrupts after it set its deadline, so that it does not clear the interrupt in the idle state.
+func (proto *lis1A1) interruptReading(conn net.Conn) {
+	atomic.AddInt32(&proto.readInterrupts, 1)
+	defer atomic.AddInt32(&proto.readInterrupts, -1)
+	conn.SetReadDeadline(time.Now())
+	proto.asyncReadActive.Wait()
+}
+
 // https://wiki.bloodlab.org/lib/exe/fetch.php?media=listnode:lis1-a.pdf
 func (proto *lis1A1) send(conn net.Conn, data [][]byte, recursionDepth int) (int, error) {
 
 	proto.asyncSendActive.Add(1)
 	defer proto.asyncSendActive.Done()
 
-	conn.SetReadDeadline(time.Now())
-	proto.asyncReadActive.Wait()
+	proto.interruptReading(conn)
 	conn.SetReadDeadline(time.Time{}) // Reset timeline
 
 	if recursionDepth > 10 {
@@ -490,6 +773,9 @@ func (proto *lis1A1) send(conn net.Conn, data [][]byte, recursionDepth int) (int
 		}
 
 		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				proto.reportEvent(conn, EventTimeout)
+			}
 			return n, err
 		}
 		if n == 0 {
@@ -500,10 +786,14 @@ func (proto *lis1A1) send(conn net.Conn, data [][]byte, recursionDepth int) (int
 			switch recievingMsg[0] {
 			case utilities.ACK: // 8.2.5
 				//  continue operation
+				proto.reportEvent(conn, EventEstablished)
 			case utilities.NAK: // 8.2.6
+				proto.reportEvent(conn, EventNAKReceived)
+				proto.reportEvent(conn, EventRetry)
 				time.Sleep(time.Second * 10)
 				return proto.send(conn, data, recursionDepth+1)
 			case utilities.ENQ: // 8.2.7.1, 2
+				proto.reportEvent(conn, EventRetry)
 				time.Sleep(time.Second)
 				return proto.send(conn, data, recursionDepth+1)
 			default:
@@ -529,6 +819,8 @@ func (proto *lis1A1) send(conn net.Conn, data [][]byte, recursionDepth int) (int
 
 			if receivedMsg == utilities.NAK {
 				for i := 0; i < 6; i++ {
+					proto.reportEvent(conn, EventNAKReceived)
+					proto.reportEvent(conn, EventRetry)
 					time.Sleep(time.Second)
 					receivedMsg, err = proto.sendFrameAndReceiveAnswer(frame, frameNumber, conn)
 					if err != nil {
@@ -539,6 +831,7 @@ func (proto *lis1A1) send(conn net.Conn, data [][]byte, recursionDepth int) (int
 					}
 				}
 				if receivedMsg == utilities.NAK {
+					proto.reportEvent(conn, EventNAKReceived)
 					return 0, fmt.Errorf("frame was not acknowledged by instrument after 6 retries (frameNumber: %d, frame: %s)", frameNumber, frame)
 				}
 			}
@@ -577,6 +870,32 @@ func (proto *lis1A1) send(conn net.Conn, data [][]byte, recursionDepth int) (int
 	}
 }
 
+func (proto *lis1A1) AddEventReporter(reporter EventReporter) {
+	proto.eventReportersMutex.Lock()
+	defer proto.eventReportersMutex.Unlock()
+	proto.eventReporters = append(proto.eventReporters, reporter)
+}
+
+func (proto *lis1A1) reportEvent(conn net.Conn, event ProtocolEvent) {
+	proto.eventReportersMutex.Lock()
+	reporters := proto.eventReporters
+	proto.eventReportersMutex.Unlock()
+	if proto.settings.eventReporter == nil && len(reporters) == 0 {
+		return
+	}
+
+	remoteAddr := ""
+	if addr := conn.RemoteAddr(); addr != nil {
+		remoteAddr = addr.String()
+	}
+	if proto.settings.eventReporter != nil {
+		proto.settings.eventReporter.ProtocolEvent(remoteAddr, event)
+	}
+	for _, reporter := range reporters {
+		reporter.ProtocolEvent(remoteAddr, event)
+	}
+}
+
 func incrementFrameNumberModulo8(frameNumber int) int {
 	return (frameNumber + 1) % 8
 }
@@ -594,6 +913,9 @@ func (proto *lis1A1) receiveSendAnswer(conn net.Conn) (byte, error) {
 	}
 
 	if err != nil {
+		if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+			proto.reportEvent(conn, EventTimeout)
+		}
 		return 0, err
 	}
 
@@ -614,9 +936,19 @@ func (proto *lis1A1) receiveSendAnswer(conn net.Conn) (byte, error) {
 }
 
 func (proto *lis1A1) Send(conn net.Conn, data [][]byte) (int, error) {
+	if atomic.LoadInt32(&proto.acknowledgementPending) == 1 {
+		return -1, ErrAcknowledgementPending
+	}
+	atomic.StoreInt32(&proto.sending, 1)
+	defer atomic.StoreInt32(&proto.sending, 0)
 	return proto.send(conn, data, 1)
 }
 
+// Busy is true from ENQ to EOT of a transmission in either direction
+func (proto *lis1A1) Busy() bool {
+	return atomic.LoadInt32(&proto.receiving) == 1 || atomic.LoadInt32(&proto.sending) == 1
+}
+
 // ComputeChecksum Helper to compute the ASTM-Checksum
 func computeChecksum(frameNumber, record, specialChars []byte) []byte {
 	sum := int(0)
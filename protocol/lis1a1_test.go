@@ -1,11 +1,16 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
 	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestComputeChecksum(t *testing.T) {
@@ -294,3 +299,283 @@ func TestRetriedSixTimesOnNAKThenError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, "frame was not acknowledged by instrument after 6 retries (frameNumber: 1, frame: H||||)", err.Error())
 }
+
+type eventRecorder struct {
+	events []ProtocolEvent
+}
+
+func (r *eventRecorder) ProtocolEvent(remoteAddr string, event ProtocolEvent) {
+	r.events = append(r.events, event)
+}
+
+func TestSendReportsEvents(t *testing.T) {
+	var mc mockConnection
+	mc.scriptedProtocol = make([]scriptedProtocol, 0)
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ENQ}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.STX}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte([]byte("1H||||"))})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ETX}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{54, 67}}) // checksum
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.CR, utilities.LF}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.NAK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.STX}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte([]byte("1H||||"))})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ETX}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{54, 67}}) // checksum
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.CR, utilities.LF}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.EOT}})
+	mc.currentRecord = 0
+
+	settingsReporter := &eventRecorder{}
+	instanceReporter := &eventRecorder{}
+	instance := Logger(Lis1A1Protocol(DefaultLis1A1ProtocolSettings().SetEventReporter(settingsReporter))).NewInstance()
+	// passed through the logger
+	instance.(EventSource).AddEventReporter(instanceReporter)
+
+	_, err := instance.Send(&mc, [][]byte{[]byte("H||||")})
+	assert.Nil(t, err)
+
+	expected := []ProtocolEvent{EventEstablished, EventNAKReceived, EventRetry}
+	assert.Equal(t, expected, settingsReporter.events)
+	assert.Equal(t, expected, instanceReporter.events)
+}
+
+func TestHeartbeat(t *testing.T) {
+	var mc mockConnection
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ENQ}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.EOT}})
+	// a busy instrument is alive as well
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ENQ}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.NAK}})
+
+	instance := Lis1A1Protocol(DefaultLis1A1ProtocolSettings()).NewInstance()
+	heartbeater, ok := instance.(Heartbeater)
+	assert.True(t, ok)
+
+	assert.Nil(t, heartbeater.Heartbeat(&mc, time.Second))
+	assert.Nil(t, heartbeater.Heartbeat(&mc, time.Second))
+	assert.Equal(t, len(mc.scriptedProtocol), mc.currentRecord)
+}
+
+func TestHeartbeatPeerDoesNotRespond(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	go func() {
+		buffer := make([]byte, 1)
+		peer.Read(buffer) // the ENQ remains unanswered
+	}()
+
+	heartbeater := Lis1A1Protocol(DefaultLis1A1ProtocolSettings()).NewInstance().(Heartbeater)
+	err := heartbeater.Heartbeat(conn, 100*time.Millisecond)
+	assert.ErrorIs(t, err, ReceiverDoesNotRespond)
+}
+
+// slowDeadlineConn delays the deadline the receive loop sets, a Send interrupts reading in between
+type slowDeadlineConn struct {
+	net.Conn
+	deadlineSet chan bool
+}
+
+func (c *slowDeadlineConn) SetDeadline(deadline time.Time) error {
+	select {
+	case c.deadlineSet <- true:
+	default:
+	}
+	time.Sleep(200 * time.Millisecond)
+	return c.Conn.SetDeadline(deadline)
+}
+
+func TestSendWhileTheReceiverIsIdle(t *testing.T) {
+	host, instrument := net.Pipe()
+	defer host.Close()
+	defer instrument.Close()
+	conn := &slowDeadlineConn{Conn: host, deadlineSet: make(chan bool, 1)}
+
+	go func() { // the instrument acknowledges the ENQ and every frame
+		buffer := make([]byte, 1)
+		for {
+			if _, err := instrument.Read(buffer); err != nil {
+				return
+			}
+			switch buffer[0] {
+			case utilities.ENQ, utilities.LF:
+				instrument.Write([]byte{utilities.ACK})
+			case utilities.EOT:
+				return
+			}
+		}
+	}()
+
+	instance := Lis1A1Protocol(DefaultLis1A1ProtocolSettings()).NewInstance()
+	go instance.Receive(conn)
+	// the receive loop sets the deadline of the idle state, there is no timer rule in it
+	<-conn.deadlineSet
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := instance.Send(conn, [][]byte{[]byte("H||||")})
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send waits for the receive loop of the idle connection")
+	}
+}
+
+func TestHeartbeatGivesWayToTheInstrument(t *testing.T) {
+	var mc mockConnection
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ENQ}})
+	// the instrument wants to send at the same time
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ENQ}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.STX}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte("1H||||")})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ETX}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{54, 67}}) // checksum
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.CR, utilities.LF}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.EOT}})
+
+	instance := Lis1A1Protocol(DefaultLis1A1ProtocolSettings()).NewInstance()
+	assert.Nil(t, instance.(Heartbeater).Heartbeat(&mc, time.Second))
+
+	data, err := instance.Receive(&mc)
+	assert.Nil(t, err)
+	assert.Equal(t, "H||||\r", string(data))
+}
+
+type journalMock struct {
+	mutex    sync.Mutex
+	failures int
+	records  []string
+	extends  []bool
+}
+
+func (j *journalMock) Record(data []byte, extends bool) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.failures > 0 {
+		j.failures--
+		return errors.New("disk full")
+	}
+	j.records = append(j.records, string(data))
+	j.extends = append(j.extends, extends)
+	return nil
+}
+
+func TestJournalIsWrittenBeforeTheACK(t *testing.T) {
+	frame := func(frameNumber string, record string) []scriptedProtocol {
+		return []scriptedProtocol{
+			{receiveOrSend: "tx", bytes: []byte{utilities.STX}},
+			{receiveOrSend: "tx", bytes: []byte(frameNumber + record)},
+			{receiveOrSend: "tx", bytes: []byte{utilities.ETX}},
+			{receiveOrSend: "tx", bytes: computeChecksum([]byte(frameNumber), []byte(record), []byte{utilities.ETX})},
+			{receiveOrSend: "tx", bytes: []byte{utilities.CR, utilities.LF}},
+		}
+	}
+	var mc mockConnection
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ENQ}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, frame("1", "H||||")...)
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, frame("2", "L|1")...)
+	// the journal fails, the terminator frame is refused and repeated
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.NAK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, frame("2", "L|1")...)
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, frame("3", "H||||")...)
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, frame("4", "L|2")...)
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.EOT}})
+
+	journal := &journalMock{failures: 1}
+	instance := Lis1A1Protocol(DefaultLis1A1ProtocolSettings()).NewInstance()
+	instance.(Journaled).SetJournal(journal)
+
+	data, err := instance.Receive(&mc)
+	assert.Nil(t, err)
+	assert.Equal(t, "H||||\rL|1\rH||||\rL|2\r", string(data))
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	assert.Equal(t, []string{"H||||\rL|1\r", "H||||\rL|2\r"}, journal.records, "every message is recorded once")
+	assert.Equal(t, []bool{false, true}, journal.extends, "the second message extends the record of the transfer")
+}
+
+func TestDeferredAcknowledgementRefusesTheMessage(t *testing.T) {
+	frame := func(frameNumber string, record string) []scriptedProtocol {
+		return []scriptedProtocol{
+			{receiveOrSend: "tx", bytes: []byte{utilities.STX}},
+			{receiveOrSend: "tx", bytes: []byte(frameNumber + record)},
+			{receiveOrSend: "tx", bytes: []byte{utilities.ETX}},
+			{receiveOrSend: "tx", bytes: computeChecksum([]byte(frameNumber), []byte(record), []byte{utilities.ETX})},
+			{receiveOrSend: "tx", bytes: []byte{utilities.CR, utilities.LF}},
+		}
+	}
+	var mc mockConnection
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ENQ}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, frame("1", "H||||")...)
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, frame("2", "L|1")...)
+	// the handler fails, the terminator frame is refused and repeated
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.NAK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, frame("2", "L|1")...)
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.EOT}})
+
+	instance := Lis1A1Protocol(DefaultLis1A1ProtocolSettings().EnableAcknowledgement()).NewInstance()
+	assert.True(t, instance.(Acknowledger).DeferAcknowledgement())
+
+	data, err := instance.Receive(&mc)
+	assert.Nil(t, err)
+	assert.Equal(t, "H||||\rL|1\r", string(data))
+	_, err = instance.Send(&mc, [][]byte{[]byte("H||||")})
+	assert.ErrorIs(t, err, ErrAcknowledgementPending, "the sender waits for the ACK of its last frame")
+	refused, err := instance.(Acknowledger).Acknowledge(&mc, errors.New("database not available"))
+	assert.Nil(t, err)
+	assert.True(t, refused)
+
+	data, err = instance.Receive(&mc)
+	assert.Nil(t, err)
+	assert.Equal(t, "H||||\rL|1\r", string(data), "the repeated message")
+	refused, err = instance.(Acknowledger).Acknowledge(&mc, nil)
+	assert.Nil(t, err)
+	assert.False(t, refused)
+
+	// the script is at its end after the EOT
+	_, err = instance.Receive(&mc)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, len(mc.scriptedProtocol), mc.currentRecord, "the repeated frame is acknowledged, the transfer ends")
+}
+
+func TestDeferredAcknowledgementOfAMessageWithoutTerminator(t *testing.T) {
+	var mc mockConnection
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ENQ}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.STX}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte("1H||||")})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.ETX}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: computeChecksum([]byte("1"), []byte("H||||"), []byte{utilities.ETX})})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.CR, utilities.LF}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "rx", bytes: []byte{utilities.ACK}})
+	mc.scriptedProtocol = append(mc.scriptedProtocol, scriptedProtocol{receiveOrSend: "tx", bytes: []byte{utilities.EOT}})
+
+	instance := Lis1A1Protocol(DefaultLis1A1ProtocolSettings().EnableAcknowledgement()).NewInstance()
+	assert.True(t, instance.(Acknowledger).DeferAcknowledgement())
+
+	data, err := instance.Receive(&mc)
+	assert.Nil(t, err)
+	assert.Equal(t, "H||||\r", string(data))
+	refused, err := instance.(Acknowledger).Acknowledge(&mc, errors.New("database not available"))
+	assert.Nil(t, err)
+	assert.False(t, refused, "the frames were acknowledged before the EOT, the sender does not repeat the message")
+}
@@ -16,23 +16,38 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
 )
 
 type MLLPProtocolSettings struct {
-	startByte     byte
-	endByte       byte
-	lineBreakByte byte
+	startByte        byte
+	endByte          byte
+	lineBreakByte    byte
+	heartbeatEnabled bool
+	heartbeat        []byte
+	acknowledgement  bool
 }
 
 type mllp struct {
 	settings               *MLLPProtocolSettings
 	receiveQ               chan protocolMessage
-	receiveThreadIsRunning bool
+	receiveThreadIsRunning int32
+	// acknowledgementDeferred is 1 if the acknowledgement is sent by Acknowledge instead of the receive loop
+	acknowledgementDeferred int32
+	lastReceivedMutex       sync.Mutex
+	lastReceived            []byte
+	// sendMutex keeps the blocks of Send, the acknowledgements and the heartbeat apart on the connection
+	sendMutex sync.Mutex
 }
 
 func DefaultMLLPProtocolSettings() *MLLPProtocolSettings {
@@ -53,6 +68,22 @@ func (set *MLLPProtocolSettings) SetEndByte(endByte byte) *MLLPProtocolSettings
 	return set
 }
 
+// SetHeartbeat enables a heartbeat on idle connections with the payload in a block (e.g. an empty
+// block for nil). The peer is not expected to answer, an answer is received as data.
+func (set *MLLPProtocolSettings) SetHeartbeat(payload []byte) *MLLPProtocolSettings {
+	set.heartbeatEnabled = true
+	set.heartbeat = payload
+	return set
+}
+
+// EnableAcknowledgement answers every received message with an HL7 acknowledgement. MSA-1 is AA, or AE with
+// the error of the handler, or AR if the error is ErrMessageRejected (see Acknowledger). Without a handler
+// that acknowledges, e.g. when Receive is called directly, every message is accepted with AA at once.
+func (set *MLLPProtocolSettings) EnableAcknowledgement() *MLLPProtocolSettings {
+	set.acknowledgement = true
+	return set
+}
+
 func MLLP(settings ...*MLLPProtocolSettings) Implementation {
 
 	var thesettings *MLLPProtocolSettings
@@ -65,7 +96,7 @@ func MLLP(settings ...*MLLPProtocolSettings) Implementation {
 	return &mllp{
 		settings:               thesettings,
 		receiveQ:               make(chan protocolMessage, 1024),
-		receiveThreadIsRunning: false,
+		receiveThreadIsRunning: 0,
 	}
 }
 
@@ -73,7 +104,7 @@ func (proto *mllp) NewInstance() Implementation {
 	return &mllp{
 		settings:               proto.settings,
 		receiveQ:               make(chan protocolMessage, 1024),
-		receiveThreadIsRunning: false,
+		receiveThreadIsRunning: 0,
 	}
 }
 
@@ -86,6 +117,9 @@ func (proto *mllp) Receive(conn net.Conn) ([]byte, error) {
 
 	switch message.Status {
 	case DATA:
+		proto.lastReceivedMutex.Lock()
+		proto.lastReceived = message.Data
+		proto.lastReceivedMutex.Unlock()
 		return message.Data, nil
 	case EOF:
 		return []byte{}, io.EOF
@@ -96,16 +130,41 @@ func (proto *mllp) Receive(conn net.Conn) ([]byte, error) {
 	}
 }
 
+// DeferAcknowledgement is false without EnableAcknowledgement
+func (proto *mllp) DeferAcknowledgement() bool {
+	if !proto.settings.acknowledgement {
+		return false
+	}
+	atomic.StoreInt32(&proto.acknowledgementDeferred, 1)
+	return true
+}
+
+// Acknowledge sends the HL7 acknowledgement of the message, see EnableAcknowledgement
+func (proto *mllp) Acknowledge(conn net.Conn, err error) (bool, error) {
+	if atomic.LoadInt32(&proto.acknowledgementDeferred) == 0 {
+		return false, nil
+	}
+	proto.lastReceivedMutex.Lock()
+	message := proto.lastReceived
+	proto.lastReceived = nil
+	proto.lastReceivedMutex.Unlock()
+	if message == nil {
+		return false, errors.New("the message was acknowledged already")
+	}
+	if _, sendErr := proto.Send(conn, newHL7Acknowledgement(message, err)); sendErr != nil {
+		return false, sendErr
+	}
+	return err != nil, nil
+}
+
 // asynchronous receiveloop
 func (proto *mllp) ensureReceiveThreadRunning(conn net.Conn) {
 
-	if proto.receiveThreadIsRunning {
+	if !atomic.CompareAndSwapInt32(&proto.receiveThreadIsRunning, 0, 1) {
 		return
 	}
 
 	go func() {
-		proto.receiveThreadIsRunning = true
-
 		tcpReceiveBuffer := make([]byte, 4096)
 		receivedMsg := make([]byte, 0)
 
@@ -136,19 +195,19 @@ func (proto *mllp) ensureReceiveThreadRunning(conn net.Conn) {
 
 					messageEOF := protocolMessage{Status: EOF}
 					proto.receiveQ <- messageEOF
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					return
 				} else if err == io.EOF { // EOF = silent exit
 
 					messageEOF := protocolMessage{Status: EOF}
 					proto.receiveQ <- messageEOF
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					return
 				}
 
 				messageERROR := protocolMessage{Status: ERROR, Data: []byte(err.Error())}
 				proto.receiveQ <- messageERROR
-				proto.receiveThreadIsRunning = false
+				atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 				return
 			}
 
@@ -160,6 +219,10 @@ func (proto *mllp) ensureReceiveThreadRunning(conn net.Conn) {
 				if x == proto.settings.endByte {
 					messageDATA := protocolMessage{Status: DATA, Data: receivedMsg}
 					proto.receiveQ <- messageDATA
+					if proto.settings.acknowledgement && atomic.LoadInt32(&proto.acknowledgementDeferred) == 0 {
+						// Send waits for a block that is being sent
+						proto.Send(conn, newHL7Acknowledgement(receivedMsg, nil))
+					}
 					continue
 				}
 				receivedMsg = append(receivedMsg, x)
@@ -172,6 +235,17 @@ func (proto *mllp) Interrupt() {
 	// not implemented (not required neither)
 }
 
+func (proto *mllp) Heartbeat(conn net.Conn, timeout time.Duration) error {
+	if !proto.settings.heartbeatEnabled {
+		return nil
+	}
+	block := append([]byte{proto.settings.startByte}, proto.settings.heartbeat...)
+	block = append(block, proto.settings.endByte, proto.settings.lineBreakByte)
+	proto.sendMutex.Lock()
+	defer proto.sendMutex.Unlock()
+	return writeHeartbeat(conn, block, timeout)
+}
+
 func (proto *mllp) Send(conn net.Conn, data [][]byte) (int, error) {
 
 	msgBuff := make([]byte, 0)
@@ -182,5 +256,65 @@ func (proto *mllp) Send(conn net.Conn, data [][]byte) (int, error) {
 	}
 	msgBuff = append(msgBuff, proto.settings.endByte)
 
+	proto.sendMutex.Lock()
+	defer proto.sendMutex.Unlock()
 	return conn.Write(msgBuff)
 }
+
+// hl7ControlIDCounter makes the message control IDs of the acknowledgements unique within a second
+var hl7ControlIDCounter uint32
+
+// newHL7Acknowledgement is the ACK message of the message with a new message control ID
+func newHL7Acknowledgement(message []byte, err error) [][]byte {
+	timestamp := time.Now()
+	controlID := fmt.Sprintf("%s%06d", timestamp.Format("20060102150405"), atomic.AddUint32(&hl7ControlIDCounter, 1)%1000000)
+	return hl7Acknowledgement(message, err, timestamp, controlID)
+}
+
+// hl7Acknowledgement is the ACK message of the message. MSH-10 is controlID, MSA-2 is the message control ID
+// of the message. MSA-1 is AA if err is nil, AR if err is ErrMessageRejected or the message has no MSH
+// segment, otherwise AE. MSA-3 is the error.
+func hl7Acknowledgement(message []byte, err error, timestamp time.Time, controlID string) [][]byte {
+	fieldSeparator := "|"
+	encodingCharacters := `^~\&`
+	var msh []string
+	segments := bytes.FieldsFunc(message, func(r rune) bool { return r == rune(utilities.CR) || r == rune(utilities.LF) })
+	if len(segments) > 0 && len(segments[0]) > 8 && bytes.HasPrefix(segments[0], []byte("MSH")) {
+		fieldSeparator = string(segments[0][3])
+		msh = strings.Split(string(segments[0]), fieldSeparator)
+		if msh[1] != "" {
+			encodingCharacters = msh[1]
+		}
+	} else if err == nil {
+		err = fmt.Errorf("%w: the message has no MSH segment", ErrMessageRejected)
+	}
+	// MSH-1 is the field separator, MSH-2 is msh[1]
+	field := func(number int, defaultValue string) string {
+		if number-1 < len(msh) && msh[number-1] != "" {
+			return msh[number-1]
+		}
+		return defaultValue
+	}
+
+	messageType := "ACK"
+	if components := strings.Split(field(9, ""), encodingCharacters[:1]); len(components) > 1 && components[1] != "" {
+		messageType += encodingCharacters[:1] + components[1]
+	}
+	header := strings.Join([]string{"MSH", encodingCharacters, field(5, ""), field(6, ""), field(3, ""), field(4, ""),
+		timestamp.Format("20060102150405"), "", messageType, controlID, field(11, "P"), field(12, "2.5")}, fieldSeparator)
+
+	acknowledgement := []string{"MSA", "AA", field(10, "")}
+	if err != nil {
+		acknowledgement[1] = "AE"
+		if errors.Is(err, ErrMessageRejected) {
+			acknowledgement[1] = "AR"
+		}
+		// the text must not contain delimiters
+		text := err.Error()
+		for _, delimiter := range fieldSeparator + encodingCharacters {
+			text = strings.ReplaceAll(text, string(delimiter), " ")
+		}
+		acknowledgement = append(acknowledgement, text)
+	}
+	return [][]byte{[]byte(header), []byte(strings.Join(acknowledgement, fieldSeparator))}
+}
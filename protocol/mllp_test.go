@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHL7Acknowledgement(t *testing.T) {
+	message := []byte("MSH|^~\\&|ANALYZER|LAB|LIS|HOSPITAL|20240101120000||ORU^R01|MSG00001|P|2.5.1\rPID|1||12345\r")
+	timestamp := time.Date(2024, 1, 1, 12, 0, 1, 0, time.UTC)
+
+	acknowledgement := hl7Acknowledgement(message, nil, timestamp, "ACK00001")
+	assert.Equal(t, "MSH|^~\\&|LIS|HOSPITAL|ANALYZER|LAB|20240101120001||ACK^R01|ACK00001|P|2.5.1", string(acknowledgement[0]))
+	assert.Equal(t, "MSA|AA|MSG00001", string(acknowledgement[1]), "MSA-2 is the control ID of the message")
+
+	acknowledgement = hl7Acknowledgement(message, errors.New("database|not available"), timestamp, "ACK00002")
+	assert.Equal(t, "MSA|AE|MSG00001|database not available", string(acknowledgement[1]), "the text has no delimiters")
+
+	acknowledgement = hl7Acknowledgement(message, fmt.Errorf("%w: unknown patient", ErrMessageRejected), timestamp, "ACK00003")
+	assert.Equal(t, "MSA|AR|MSG00001|message rejected: unknown patient", string(acknowledgement[1]))
+
+	acknowledgement = hl7Acknowledgement([]byte("PID|1||12345\r"), nil, timestamp, "ACK00004")
+	assert.Equal(t, "MSH|^~\\&|||||20240101120001||ACK|ACK00004|P|2.5", string(acknowledgement[0]))
+	assert.Equal(t, "MSA|AR||message rejected: the message has no MSH segment", string(acknowledgement[1]))
+}
+
+func TestHL7AcknowledgementHasANewControlID(t *testing.T) {
+	message := []byte("MSH|^~\\&|ANALYZER|LAB|LIS|HOSPITAL|20240101120000||ORU^R01|MSG00001|P|2.5.1\r")
+
+	first := strings.Split(string(newHL7Acknowledgement(message, nil)[0]), "|")
+	second := strings.Split(string(newHL7Acknowledgement(message, nil)[0]), "|")
+	assert.NotEqual(t, "MSG00001", first[9])
+	assert.Len(t, first[9], 20, "MSH-10 is limited to 20 characters")
+	assert.NotEqual(t, first[9], second[9])
+}
@@ -0,0 +1,322 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pcapng block types, see https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	pcapngSectionHeaderBlock    uint32 = 0x0A0D0D0A
+	pcapngInterfaceDescription  uint32 = 0x00000001
+	pcapngEnhancedPacketBlock   uint32 = 0x00000006
+	pcapngByteOrderMagic        uint32 = 0x1A2B3C4D
+	pcapngLinkTypeRaw           uint16 = 101 // raw IPv4 or IPv6 packets
+	pcapngMaxSegmentPayloadSize        = 65000
+)
+
+const (
+	tcpFlagFIN byte = 0x01
+	tcpFlagSYN byte = 0x02
+	tcpFlagPSH byte = 0x08
+	tcpFlagACK byte = 0x10
+)
+
+// PcapngWriter is a CaptureSink that writes the traffic as pcapng, e.g. for Wireshark. The IP and
+// TCP headers are synthesized from the addresses of the connections, each connection starts with a
+// handshake and ends with FIN. Sessions may be recorded concurrently.
+type PcapngWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	closer io.Closer
+	err    error
+}
+
+// NewPcapngWriter writes the section header to w
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	pw := &PcapngWriter{writer: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // version 1.0
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0)) // section length unknown
+	pw.writeBlock(pcapngSectionHeaderBlock, shb)
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length
+	pw.writeBlock(pcapngInterfaceDescription, idb)
+
+	if pw.err != nil {
+		return nil, pw.err
+	}
+	return pw, nil
+}
+
+// CreatePcapngFile creates (or truncates) the file and writes the section header
+func CreatePcapngFile(filename string) (*PcapngWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := NewPcapngWriter(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	pw.closer = file
+	return pw, nil
+}
+
+// Err returns the first error that occurred while writing, after that nothing is written anymore
+func (pw *PcapngWriter) Err() error {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	return pw.err
+}
+
+// Close closes the file if the writer was created by CreatePcapngFile
+func (pw *PcapngWriter) Close() error {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	if pw.closer != nil {
+		return pw.closer.Close()
+	}
+	return nil
+}
+
+func (pw *PcapngWriter) OpenSession(local, remote net.Addr, timestamp time.Time) CaptureSession {
+	session := &pcapngSession{
+		writer: pw,
+		local:  toTCPEndpoint(local, net.IPv4(127, 0, 0, 1)),
+		remote: toTCPEndpoint(remote, net.IPv4(127, 0, 0, 2)),
+		// fixed initial sequence numbers, Wireshark shows relative numbers anyway
+		localSeq:  1000,
+		remoteSeq: 5000,
+	}
+	if session.local.IP.To4() != nil && session.remote.IP.To4() != nil {
+		session.local.IP = session.local.IP.To4()
+		session.remote.IP = session.remote.IP.To4()
+	} else {
+		// one side is IPv6, then both are written as IPv6
+		session.local.IP = session.local.IP.To16()
+		session.remote.IP = session.remote.IP.To16()
+	}
+
+	// the connection was established by the peer
+	session.packet(timestamp, false, tcpFlagSYN, nil)
+	session.remoteSeq++
+	session.packet(timestamp, true, tcpFlagSYN|tcpFlagACK, nil)
+	session.localSeq++
+	session.packet(timestamp, false, tcpFlagACK, nil)
+	return session
+}
+
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte) {
+	padding := (4 - len(body)%4) % 4
+	totalLength := uint32(12 + len(body) + padding)
+
+	block := make([]byte, 0, totalLength)
+	block = appendUint32(block, blockType)
+	block = appendUint32(block, totalLength)
+	block = append(block, body...)
+	block = append(block, make([]byte, padding)...)
+	block = appendUint32(block, totalLength)
+
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = pw.writer.Write(block)
+}
+
+func (pw *PcapngWriter) writePacket(timestamp time.Time, packet []byte) {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	micros := uint64(timestamp.UnixNano() / 1000) // default resolution of the interface is microseconds
+	body := make([]byte, 20, 20+len(packet))
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	body = append(body, packet...)
+	pw.writeBlock(pcapngEnhancedPacketBlock, body)
+}
+
+type pcapngSession struct {
+	writer    *PcapngWriter
+	mutex     sync.Mutex
+	local     net.TCPAddr
+	remote    net.TCPAddr
+	localSeq  uint32
+	remoteSeq uint32
+	closed    bool
+}
+
+func (s *pcapngSession) Record(timestamp time.Time, direction CaptureDirection, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+
+	fromLocal := direction == CaptureSent
+	for len(data) > 0 {
+		segment := data
+		if len(segment) > pcapngMaxSegmentPayloadSize {
+			segment = segment[:pcapngMaxSegmentPayloadSize]
+		}
+		s.packet(timestamp, fromLocal, tcpFlagPSH|tcpFlagACK, segment)
+		if fromLocal {
+			s.localSeq += uint32(len(segment))
+		} else {
+			s.remoteSeq += uint32(len(segment))
+		}
+		data = data[len(segment):]
+	}
+}
+
+func (s *pcapngSession) Close(timestamp time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	s.packet(timestamp, true, tcpFlagFIN|tcpFlagACK, nil)
+	s.localSeq++
+	s.packet(timestamp, false, tcpFlagFIN|tcpFlagACK, nil)
+	s.remoteSeq++
+	s.packet(timestamp, true, tcpFlagACK, nil)
+}
+
+func (s *pcapngSession) packet(timestamp time.Time, fromLocal bool, flags byte, payload []byte) {
+	source, destination := s.remote, s.local
+	seq, ack := s.remoteSeq, s.localSeq
+	if fromLocal {
+		source, destination = s.local, s.remote
+		seq, ack = s.localSeq, s.remoteSeq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	segment := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:], uint16(source.Port))
+	binary.BigEndian.PutUint16(segment[2:], uint16(destination.Port))
+	binary.BigEndian.PutUint32(segment[4:], seq)
+	binary.BigEndian.PutUint32(segment[8:], ack)
+	segment[12] = 5 << 4 // header length in 32 bit words
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], 65535) // window
+	segment = append(segment, payload...)
+
+	var packet []byte
+	if len(source.IP) == net.IPv4len {
+		packet = ipv4Packet(source.IP, destination.IP, segment)
+	} else {
+		packet = ipv6Packet(source.IP, destination.IP, segment)
+	}
+	s.writer.writePacket(timestamp, packet)
+}
+
+func ipv4Packet(source, destination net.IP, segment []byte) []byte {
+	pseudoHeader := make([]byte, 0, 12)
+	pseudoHeader = append(pseudoHeader, source...)
+	pseudoHeader = append(pseudoHeader, destination...)
+	pseudoHeader = append(pseudoHeader, 0, 6)
+	pseudoHeader = append(pseudoHeader, byte(len(segment)>>8), byte(len(segment)))
+	binary.BigEndian.PutUint16(segment[16:], internetChecksum(pseudoHeader, segment))
+
+	header := make([]byte, 20, 20+len(segment))
+	header[0] = 0x45 // version 4, header length 5 words
+	binary.BigEndian.PutUint16(header[2:], uint16(20+len(segment)))
+	header[6] = 0x40 // don't fragment
+	header[8] = 64   // ttl
+	header[9] = 6    // tcp
+	copy(header[12:16], source)
+	copy(header[16:20], destination)
+	binary.BigEndian.PutUint16(header[10:], internetChecksum(header))
+	return append(header, segment...)
+}
+
+func ipv6Packet(source, destination net.IP, segment []byte) []byte {
+	pseudoHeader := make([]byte, 0, 40)
+	pseudoHeader = append(pseudoHeader, source...)
+	pseudoHeader = append(pseudoHeader, destination...)
+	pseudoHeader = appendUint32BigEndian(pseudoHeader, uint32(len(segment)))
+	pseudoHeader = append(pseudoHeader, 0, 0, 0, 6)
+	binary.BigEndian.PutUint16(segment[16:], internetChecksum(pseudoHeader, segment))
+
+	header := make([]byte, 40, 40+len(segment))
+	header[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(header[4:], uint16(len(segment)))
+	header[6] = 6  // tcp
+	header[7] = 64 // hop limit
+	copy(header[8:24], source)
+	copy(header[24:40], destination)
+	return append(header, segment...)
+}
+
+// internetChecksum is the ones' complement sum of RFC 1071 over all parts
+func internetChecksum(parts ...[]byte) uint16 {
+	var sum uint32
+	odd := false
+	for _, part := range parts {
+		for _, b := range part {
+			if odd {
+				sum += uint32(b)
+			} else {
+				sum += uint32(b) << 8
+			}
+			odd = !odd
+		}
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
+// toTCPEndpoint converts any address, addresses that are not IP-based (e.g. net.Pipe) get the fallback
+func toTCPEndpoint(addr net.Addr, fallback net.IP) net.TCPAddr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a.IP != nil {
+			return net.TCPAddr{IP: a.IP, Port: a.Port}
+		}
+	case nil:
+		return net.TCPAddr{IP: fallback}
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.TCPAddr{IP: fallback}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = fallback
+	}
+	portNumber, _ := strconv.Atoi(port)
+	return net.TCPAddr{IP: ip, Port: portNumber}
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buffer [4]byte
+	binary.LittleEndian.PutUint32(buffer[:], v)
+	return append(b, buffer[:]...)
+}
+
+func appendUint32BigEndian(b []byte, v uint32) []byte {
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], v)
+	return append(b, buffer[:]...)
+}
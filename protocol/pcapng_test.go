@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func readPcapngBlocks(t *testing.T, data []byte) []pcapngBlock {
+	blocks := make([]pcapngBlock, 0)
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data[0:])
+		totalLength := binary.LittleEndian.Uint32(data[4:])
+		assert.Equal(t, totalLength, binary.LittleEndian.Uint32(data[totalLength-4:]), "trailing block length")
+		blocks = append(blocks, pcapngBlock{blockType: blockType, body: data[8 : totalLength-4]})
+		data = data[totalLength:]
+	}
+	return blocks
+}
+
+// packetOf returns the ip packet of an enhanced packet block
+func packetOf(block pcapngBlock) []byte {
+	capturedLength := binary.LittleEndian.Uint32(block.body[12:])
+	return block.body[20 : 20+capturedLength]
+}
+
+func TestPcapngWriterIPv4Session(t *testing.T) {
+	var output bytes.Buffer
+	writer, err := NewPcapngWriter(&output)
+	assert.Nil(t, err)
+
+	timestamp := time.Date(2022, 3, 1, 10, 15, 2, 123456000, time.UTC)
+	session := writer.OpenSession(
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4001},
+		&net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 50123}, timestamp)
+	session.Record(timestamp, CaptureReceived, []byte("\u0002hello\u0003"))
+	session.Record(timestamp, CaptureSent, []byte{0x06})
+	session.Close(timestamp)
+
+	blocks := readPcapngBlocks(t, output.Bytes())
+	assert.Equal(t, 2+3+2+3, len(blocks))
+	assert.Equal(t, pcapngSectionHeaderBlock, blocks[0].blockType)
+	assert.Equal(t, pcapngByteOrderMagic, binary.LittleEndian.Uint32(blocks[0].body))
+	assert.Equal(t, pcapngInterfaceDescription, blocks[1].blockType)
+	assert.Equal(t, pcapngLinkTypeRaw, binary.LittleEndian.Uint16(blocks[1].body))
+
+	// received data: from the remote peer to the local address
+	data := blocks[5]
+	assert.Equal(t, pcapngEnhancedPacketBlock, data.blockType)
+	micros := uint64(binary.LittleEndian.Uint32(data.body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(data.body[8:]))
+	assert.Equal(t, uint64(timestamp.UnixNano()/1000), micros)
+
+	packet := packetOf(data)
+	assert.Equal(t, byte(0x45), packet[0])
+	assert.Equal(t, uint16(0), internetChecksum(packet[:20]), "ip header checksum")
+	assert.Equal(t, net.ParseIP("192.168.1.20").To4(), net.IP(packet[12:16]))
+	assert.Equal(t, net.ParseIP("10.0.0.1").To4(), net.IP(packet[16:20]))
+	segment := packet[20:]
+	assert.Equal(t, uint16(50123), binary.BigEndian.Uint16(segment[0:]))
+	assert.Equal(t, uint16(4001), binary.BigEndian.Uint16(segment[2:]))
+	assert.Equal(t, "\u0002hello\u0003", string(segment[20:]))
+	pseudoHeader := append(append(append([]byte{}, packet[12:20]...), 0, 6), byte(len(segment)>>8), byte(len(segment)))
+	assert.Equal(t, uint16(0), internetChecksum(pseudoHeader, segment), "tcp checksum")
+
+	// the answer acknowledges the received data
+	answer := packetOf(blocks[6])[20:]
+	assert.Equal(t, uint16(4001), binary.BigEndian.Uint16(answer[0:]))
+	assert.Equal(t, binary.BigEndian.Uint32(segment[4:])+7, binary.BigEndian.Uint32(answer[8:]))
+	assert.Equal(t, []byte{0x06}, answer[20:])
+
+	assert.Equal(t, tcpFlagFIN|tcpFlagACK, packetOf(blocks[7])[20+13])
+}
+
+func TestPcapngWriterMixedAddressesUseIPv6(t *testing.T) {
+	var output bytes.Buffer
+	writer, err := NewPcapngWriter(&output)
+	assert.Nil(t, err)
+
+	session := writer.OpenSession(
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4001},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50123}, time.Now())
+	session.Record(time.Now(), CaptureReceived, []byte("x"))
+
+	blocks := readPcapngBlocks(t, output.Bytes())
+	packet := packetOf(blocks[len(blocks)-1])
+	assert.Equal(t, byte(0x60), packet[0])
+	assert.Equal(t, net.ParseIP("2001:db8::1"), net.IP(packet[8:24]))
+	assert.Equal(t, net.ParseIP("10.0.0.1").To16(), net.IP(packet[24:40]))
+	assert.Equal(t, "x", string(packet[40+20:]))
+}
+
+func TestLoggerWithCaptureSink(t *testing.T) {
+	var output bytes.Buffer
+	writer, err := NewPcapngWriter(&output)
+	assert.Nil(t, err)
+
+	// logging is disabled, the traffic is recorded anyway
+	instance := Logger(STXETX(), DefaultProtocolLoggerSettings().Disable().SetCaptureSink(writer))
+
+	host, instrument := net.Pipe()
+	go func() {
+		instrument.Write([]byte("\u0002data\u0003"))
+		instrument.Close()
+	}()
+	message, err := instance.Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(message))
+	_, err = instance.Receive(host)
+	assert.NotNil(t, err)
+
+	blocks := readPcapngBlocks(t, output.Bytes())
+	assert.Equal(t, 2+3+1+3, len(blocks))
+	assert.Equal(t, "\u0002data\u0003", string(packetOf(blocks[5])[40:]))
+}
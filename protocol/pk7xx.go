@@ -4,12 +4,44 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
+	"github.com/rs/zerolog/log"
 )
 
+// pk7xxReceiverTimeout aborts a transfer that stalls. The instrument sends a transfer without waiting for the
+// host, so a pause that long within it means the transfer was cut off.
+const pk7xxReceiverTimeout = 30 * time.Second
+
+type PK7xxProtocolSettings struct {
+	receiveTimeout     time.Duration
+	transitionObserver utilities.TransitionObserver
+}
+
+func DefaultPK7xxProtocolSettings() *PK7xxProtocolSettings {
+	return &PK7xxProtocolSettings{
+		receiveTimeout: pk7xxReceiverTimeout,
+	}
+}
+
+// SetReceiveTimeout is the time without data after which a started transfer is discarded.
+// Default is 30s
+func (s PK7xxProtocolSettings) SetReceiveTimeout(timeout time.Duration) *PK7xxProtocolSettings {
+	s.receiveTimeout = timeout
+	return &s
+}
+
+// SetTransitionObserver receives every transition of the state machine, e.g. utilities.ZerologTransitionObserver
+func (s PK7xxProtocolSettings) SetTransitionObserver(observer utilities.TransitionObserver) *PK7xxProtocolSettings {
+	s.transitionObserver = observer
+	return &s
+}
+
 type pk7xxProtocol struct {
-	receiveThreadIsRunning bool
+	settings               *PK7xxProtocolSettings
+	receiveThreadIsRunning int32
 	receiveQ               chan protocolMessage
 	state                  processState
 	fsm                    []utilities.Rule
@@ -28,7 +60,14 @@ const (
 	DQRecordStarted  = "DQ"
 )
 
-func PK7xxProtocol() Implementation {
+func PK7xxProtocol(settings ...*PK7xxProtocolSettings) Implementation {
+	var theSettings *PK7xxProtocolSettings
+	if len(settings) >= 1 {
+		theSettings = settings[0]
+	} else {
+		theSettings = DefaultPK7xxProtocolSettings()
+	}
+
 	numbers := []byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9'}
 	normalCharacters := []byte{}
 	for i := 0x21; i < 0xF7; i++ { // Character specification according to manual
@@ -88,7 +127,17 @@ func PK7xxProtocol() Implementation {
 		{FromState: 202, Symbols: anySymbol, ToState: 202, Scan: true},
 	}
 
+	// every state but the initial one is within a transfer
+	timerStates := make(map[utilities.State]bool)
+	for _, rule := range fsm {
+		if rule.FromState != utilities.Init && !timerStates[rule.FromState] {
+			timerStates[rule.FromState] = true
+			fsm = append(fsm, utilities.Rule{FromState: rule.FromState, Timeout: theSettings.receiveTimeout, ToState: utilities.Init, ActionCode: utilities.Timeout})
+		}
+	}
+
 	return &pk7xxProtocol{
+		settings: theSettings,
 		fsm:      fsm,
 		receiveQ: make(chan protocolMessage),
 	}
@@ -97,28 +146,34 @@ func PK7xxProtocol() Implementation {
 func (p *pk7xxProtocol) Interrupt() {}
 
 func (p *pk7xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
-	if p.receiveThreadIsRunning {
+	if !atomic.CompareAndSwapInt32(&p.receiveThreadIsRunning, 0, 1) {
 		return
 	}
 	dataEndSegmentStarted := false
 	go func() {
-		p.receiveThreadIsRunning = true
 		p.state.State = 0
 
 		tcpReceiveBuffer := make([]byte, 4096)
 		fsm := utilities.CreateFSM(p.fsm)
-		for p.receiveThreadIsRunning {
+		if p.settings.transitionObserver != nil {
+			fsm.SetTransitionObserver(p.settings.transitionObserver)
+		}
+		for atomic.LoadInt32(&p.receiveThreadIsRunning) == 1 {
+			// the timer rules of the current state define how long to wait, no timeout in the idle state
+			deadline, _ := fsm.Deadline()
+			conn.SetReadDeadline(deadline)
 			n, err := conn.Read(tcpReceiveBuffer)
 			// enabled FSM
 			if err != nil {
 				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-					fmt.Printf("read timeout reached. reset fsm")
-					tcpReceiveBuffer = make([]byte, 4096)
-					fsm.ResetBuffer()
-					fsm.Init()
+					if _, action, expired := fsm.Expire(); expired && action == utilities.Timeout {
+						log.Warn().Msg("pk7xx: no data within the receive timeout - transmission discarded")
+						fsm.ResetBuffer()
+						dataEndSegmentStarted = false
+					}
 					continue // on timeout....
 				} else if opErr, ok := err.(*net.OpError); ok && opErr.Op == "read" {
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					p.receiveQ <- protocolMessage{
 						Status: DISCONNECT,
 						Data:   []byte(err.Error()),
@@ -129,7 +184,7 @@ func (p *pk7xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 						Status: DISCONNECT,
 						Data:   []byte(err.Error()),
 					}
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					return
 				}
 
@@ -137,7 +192,7 @@ func (p *pk7xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 					Status: DISCONNECT,
 					Data:   []byte(err.Error()),
 				}
-				p.receiveThreadIsRunning = false
+				atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 				return
 			}
 			dataETBHeaderStarted := false
@@ -161,7 +216,7 @@ func (p *pk7xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 						Status: ERROR,
 						Data:   []byte(err.Error()),
 					}
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					return
 				}
 				switch action {
@@ -187,7 +242,7 @@ func (p *pk7xxProtocol) ensureReceiveThreadRunning(conn net.Conn) {
 					}
 
 					p.receiveQ <- protocolMsg
-					p.receiveThreadIsRunning = false
+					atomic.StoreInt32(&p.receiveThreadIsRunning, 0)
 					fmt.Println("Disconnect due to unexpected, unknown and unlikely error")
 					return
 				}
@@ -223,6 +278,9 @@ func (p *pk7xxProtocol) Send(conn net.Conn, data [][]byte) (int, error) {
 // Create a new Instance of this class duplicating all settings
 func (p *pk7xxProtocol) NewInstance() Implementation {
 	return &pk7xxProtocol{
-		state: p.state,
+		settings: p.settings,
+		state:    p.state,
+		fsm:      p.fsm,
+		receiveQ: make(chan protocolMessage),
 	}
 }
@@ -2,8 +2,11 @@ package protocol
 
 import (
 	"net"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -66,3 +69,44 @@ func TestTransmissionWithTwoETB(t *testing.T) {
 }
 
 // A test where 02 'S' and then trash tries to crash the connection, expecting the fsm to reset
+
+func TestPK7xxTransitionObserver(t *testing.T) {
+	var mutex sync.Mutex
+	events := make([]utilities.TransitionEvent, 0)
+	observer := utilities.TransitionObserverFunc(func(event utilities.TransitionEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	})
+
+	host, instrument := net.Pipe()
+	instance := PK7xxProtocol(DefaultPK7xxProtocolSettings().SetTransitionObserver(observer)).NewInstance()
+	go func() {
+		instrument.Write([]byte("\x02SB99\x03\x12\x02DE99\x03\x02"))
+	}()
+	transmission, err := instance.Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, "DE\x03", string(transmission))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, utilities.Init, events[0].FromState)
+		assert.Equal(t, byte(utilities.STX), events[0].Token)
+	}
+}
+
+func TestPK7xxTimeoutWithinTransfer(t *testing.T) {
+	host, instrument := net.Pipe()
+	instance := PK7xxProtocol(DefaultPK7xxProtocolSettings().SetReceiveTimeout(100 * time.Millisecond))
+	go func() {
+		// the transfer is cut off within the device number of the DE record
+		instrument.Write([]byte("\x02SB99\x03\x12\x02DE9"))
+		time.Sleep(300 * time.Millisecond)
+		instrument.Write([]byte("\x02SB99\x03\x12\x02DE99\x03\x02"))
+	}()
+
+	transmission, err := instance.Receive(host)
+	assert.Nil(t, err, "the stalled transfer was discarded, the next one starts in the initial state")
+	assert.Equal(t, "DE\x03", string(transmission))
+}
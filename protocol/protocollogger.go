@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
@@ -14,27 +15,141 @@ type LogType string
 const LogTypeInfo LogType = "info"
 const LogTypeSend LogType = "send"
 const LogTypeRecv LogType = "recv"
+
+// Deprecated: failed reads and writes are logged with LogTypeRecv and LogTypeSend and LogEvent.Err
 const LogTypeFail LogType = "fail"
 const LogTypeClos LogType = "clos"
 
+// LogEvent is one entry of the protocol log
+type LogEvent struct {
+	Timestamp time.Time
+	Type      LogType // direction (LogTypeSend, LogTypeRecv) or LogTypeInfo, LogTypeClos
+	Session   string  // remote address of the connection
+	Payload   []byte  // the complete data sent or received, empty for other types
+	Message   string  // readable description, for send and recv the first 30 characters of the payload
+	Err       error   // set if reading or writing failed
+}
+
+// LogAdapter receives the events of the protocol logger, see ZerologLogAdapter and SlogLogAdapter
 type LogAdapter interface {
-	logMessage(timestamp time.Time, ltype LogType, msg string, payload []byte)
+	Log(event LogEvent)
+}
+
+// LogAdapterFunc allows to use an ordinary function as LogAdapter
+type LogAdapterFunc func(event LogEvent)
+
+func (f LogAdapterFunc) Log(event LogEvent) {
+	f(event)
+}
+
+type ProtocolLoggerSettings struct {
+	enabled       bool
+	printToStdout bool
+	logAdapter    LogAdapter
+	captureSink   CaptureSink
+	redactor      Redactor
+}
+
+// DefaultProtocolLoggerSettings enables logging if the environment-variable PROTOLOG_ENABLE is set.
+// All events are printed to stdout.
+func DefaultProtocolLoggerSettings() *ProtocolLoggerSettings {
+	return &ProtocolLoggerSettings{
+		enabled:       os.Getenv("PROTOLOG_ENABLE") != "",
+		printToStdout: true,
+	}
+}
+
+// Enable logging regardless of PROTOLOG_ENABLE
+func (s ProtocolLoggerSettings) Enable() *ProtocolLoggerSettings {
+	s.enabled = true
+	return &s
+}
+
+// Disable logging regardless of PROTOLOG_ENABLE
+func (s ProtocolLoggerSettings) Disable() *ProtocolLoggerSettings {
+	s.enabled = false
+	return &s
+}
+
+func (s ProtocolLoggerSettings) EnablePrintToStdout() *ProtocolLoggerSettings {
+	s.printToStdout = true
+	return &s
+}
+
+func (s ProtocolLoggerSettings) DisablePrintToStdout() *ProtocolLoggerSettings {
+	s.printToStdout = false
+	return &s
+}
+
+func (s ProtocolLoggerSettings) SetLogAdapter(logAdapter LogAdapter) *ProtocolLoggerSettings {
+	s.logAdapter = logAdapter
+	return &s
 }
+
+// SetCaptureSink records the traffic of every connection to the sink, e.g. a PcapngWriter.
+// The traffic is recorded even if logging is disabled.
+func (s ProtocolLoggerSettings) SetCaptureSink(captureSink CaptureSink) *ProtocolLoggerSettings {
+	s.captureSink = captureSink
+	return &s
+}
+
+// SetRedactor masks sensitive data (e.g. patient names) in the log and the capture sink,
+// see ASTMFieldRedactor, HL7FieldRedactor and RegexRedactor
+func (s ProtocolLoggerSettings) SetRedactor(redactor Redactor) *ProtocolLoggerSettings {
+	s.redactor = redactor
+	return &s
+}
+
 type protocolLogger struct {
-	enableLog  bool
-	protocol   Implementation
-	logAdapter LogAdapter
+	settings *ProtocolLoggerSettings
+	protocol Implementation
+
+	// the protocol implementations keep the connection of the first call, the wrapper must
+	// therefore be the same for all calls with the same connection
+	mutex       sync.Mutex
+	conn        net.Conn
+	wrappedConn net.Conn
+}
+
+func (pl *protocolLogger) log(event LogEvent) {
+	if pl.settings.logAdapter != nil {
+		pl.settings.logAdapter.Log(event)
+	}
+
+	if !pl.settings.printToStdout {
+		return
+	}
+	timestamp := event.Timestamp.Format("20060102 150405.0")
+	switch event.Type {
+	case LogTypeInfo:
+		fmt.Printf("PL|%s| info - %s\n", timestamp, event.Message)
+	case LogTypeFail:
+		fmt.Printf("PL|%s| fail - '%s'\n", timestamp, event.Message)
+	case LogTypeRecv:
+		if event.Err != nil {
+			fmt.Printf("PL|%s| fail - '%s'\n", timestamp, event.Message)
+			return
+		}
+		fmt.Printf("PL|%s| recv - (%d bytes) '%s' \n", timestamp, len(event.Payload), event.Message)
+	case LogTypeSend:
+		if event.Err != nil {
+			fmt.Printf("PL|%s| send - (error) '%s'\n", timestamp, event.Message)
+		} else {
+			fmt.Printf("PL|%s| send - (%d bytes) '%s'\n", timestamp, len(event.Payload), event.Message)
+		}
+	case LogTypeClos:
+		fmt.Printf("PL|%s| close|\n", timestamp)
+	}
 }
 
 func (pl *protocolLogger) Interrupt() {
-	if pl.logAdapter != nil {
-		pl.logAdapter.logMessage(time.Now(), LogTypeInfo, "interrupted connection", []byte{})
+	if pl.settings.enabled {
+		pl.log(LogEvent{Timestamp: time.Now(), Type: LogTypeInfo, Message: "interrupted connection"})
 	}
-	fmt.Printf("PL|%s| info - interrupt connection\n", time.Now().Format("20060102 150405.0"))
 	pl.protocol.Interrupt()
 }
 
-func (pl *protocolLogger) logRead(n int, err error, datafull []byte) {
+func (pl *protocolLogger) logRead(session string, n int, err error, datafull []byte) {
 
 	if err != nil {
 		if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
@@ -42,102 +157,154 @@ func (pl *protocolLogger) logRead(n int, err error, datafull []byte) {
 			return
 		}
 
-		if pl.logAdapter != nil {
-			pl.logAdapter.logMessage(time.Now(), LogTypeFail, err.Error(), []byte{})
-		}
-
-		fmt.Printf("PL|%s| fail - '%s'\n", time.Now().Format("20060102 150405.0"), err.Error())
+		pl.log(LogEvent{Timestamp: time.Now(), Type: LogTypeRecv, Session: session, Payload: []byte{}, Message: err.Error(), Err: err})
 		return
 	}
 
-	peek := substr(makeBytesReadable(datafull[:n]), 0, 30)
-	if len(peek) > 30 {
-		peek = peek + "..."
-	}
+	payload := make([]byte, n)
+	copy(payload, datafull[:n])
+	pl.log(LogEvent{Timestamp: time.Now(), Type: LogTypeRecv, Session: session, Payload: payload, Message: peek(payload)})
+}
+
+func (pl *protocolLogger) logWrite(session string, n int, err error, datafull []byte) {
 
-	if pl.logAdapter != nil {
-		pl.logAdapter.logMessage(time.Now(), LogTypeRecv, peek, datafull)
+	if err != nil {
+		pl.log(LogEvent{Timestamp: time.Now(), Type: LogTypeSend, Session: session, Payload: []byte{}, Message: err.Error(), Err: err})
+		return
 	}
 
-	fmt.Printf("PL|%s| recv - (%d bytes) '%s' \n", time.Now().Format("20060102 150405.0"), n, peek)
+	payload := make([]byte, len(datafull))
+	copy(payload, datafull)
+	pl.log(LogEvent{Timestamp: time.Now(), Type: LogTypeSend, Session: session, Payload: payload, Message: peek(payload)})
 }
 
-func (pl *protocolLogger) logWrite(n int, err error, datafull []byte) {
+func (pl *protocolLogger) logClose(session string) {
+	pl.log(LogEvent{Timestamp: time.Now(), Type: LogTypeClos, Session: session, Payload: []byte{}, Message: session})
+}
 
-	if err != nil {
+func (pl *protocolLogger) Receive(conn net.Conn) ([]byte, error) {
+	return pl.protocol.Receive(pl.wrap(conn))
+}
 
-		if pl.logAdapter != nil {
-			pl.logAdapter.logMessage(time.Now(), LogTypeFail, err.Error(), []byte{})
-		}
+func (pl *protocolLogger) Send(conn net.Conn, data [][]byte) (int, error) {
+	return pl.protocol.Send(pl.wrap(conn), data)
+}
 
-		fmt.Printf("PL|%s| send - (error) '%s'\n", time.Now().Format("20060102 150405.0"), err.Error())
-		return
+func (pl *protocolLogger) wrap(conn net.Conn) net.Conn {
+	if !pl.settings.enabled && pl.settings.captureSink == nil {
+		return conn
 	}
 
-	peek := substr(makeBytesReadable(datafull), 0, 30)
-	if len(datafull) > 30 {
-		peek = peek + "..."
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	if pl.conn == conn {
+		return pl.wrappedConn
+	}
+
+	wrappedConn := conn
+	if pl.settings.captureSink != nil {
+		captureSink := pl.settings.captureSink
+		if pl.settings.redactor != nil {
+			captureSink = RedactCaptureSink(captureSink, pl.settings.redactor)
+		}
+		wrappedConn = WrapConnWithCaptureSink(wrappedConn, captureSink)
+	}
+	if pl.settings.enabled {
+		wrappedConn = wrapConnWithLogger(pl, wrappedConn)
 	}
-	if pl.logAdapter != nil {
-		pl.logAdapter.logMessage(time.Now(), LogTypeSend, peek, datafull)
+	pl.conn = conn
+	pl.wrappedConn = wrappedConn
+	return wrappedConn
+}
+
+// AddEventReporter is passed to the wrapped protocol if it reports events
+func (pl *protocolLogger) AddEventReporter(reporter EventReporter) {
+	if source, ok := pl.protocol.(EventSource); ok {
+		source.AddEventReporter(reporter)
 	}
-	fmt.Printf("PL|%s| send - (%d bytes) '%s'\n", time.Now().Format("20060102 150405.0"), n, peek)
 }
 
-func (pl *protocolLogger) logClose(peer string) {
+// Heartbeat is passed to the wrapped protocol if it supports heartbeats
+func (pl *protocolLogger) Heartbeat(conn net.Conn, timeout time.Duration) error {
+	if heartbeater, ok := pl.protocol.(Heartbeater); ok {
+		return heartbeater.Heartbeat(pl.wrap(conn), timeout)
+	}
+	return nil
+}
 
-	if pl.logAdapter != nil {
-		pl.logAdapter.logMessage(time.Now(), LogTypeClos, peer, []byte{})
+// Busy is passed to the wrapped protocol if it reports its transfers
+func (pl *protocolLogger) Busy() bool {
+	if busyReporter, ok := pl.protocol.(BusyReporter); ok {
+		return busyReporter.Busy()
 	}
+	return false
+}
 
-	fmt.Printf("PL|%s| close|\n", time.Now().Format("20060102 150405.0"))
+// SetJournal is passed to the wrapped protocol if it acknowledges messages before Receive returns them
+func (pl *protocolLogger) SetJournal(journal Journal) {
+	if journaled, ok := pl.protocol.(Journaled); ok {
+		journaled.SetJournal(journal)
+	}
 }
 
-func (pl *protocolLogger) Receive(conn net.Conn) ([]byte, error) {
-	if !pl.enableLog {
-		return pl.protocol.Receive(conn)
+// DeferAcknowledgement is passed to the wrapped protocol if it acknowledges messages
+func (pl *protocolLogger) DeferAcknowledgement() bool {
+	if acknowledger, ok := pl.protocol.(Acknowledger); ok {
+		return acknowledger.DeferAcknowledgement()
 	}
-	return pl.protocol.Receive(wrapConnWithLogger(pl, conn))
+	return false
 }
 
-func (pl *protocolLogger) Send(conn net.Conn, data [][]byte) (int, error) {
-	if !pl.enableLog {
-		return pl.protocol.Send(conn, data)
+// Acknowledge is passed to the wrapped protocol if it acknowledges messages
+func (pl *protocolLogger) Acknowledge(conn net.Conn, err error) (bool, error) {
+	if acknowledger, ok := pl.protocol.(Acknowledger); ok {
+		return acknowledger.Acknowledge(pl.wrap(conn), err)
 	}
-	return pl.protocol.Send(wrapConnWithLogger(pl, conn), data)
+	return false, nil
 }
 
 func (pl *protocolLogger) NewInstance() Implementation {
 	return &protocolLogger{
+		settings: pl.settings,
 		protocol: pl.protocol.NewInstance(),
 	}
 }
 
-func Logger(protocol Implementation) Implementation {
+// Logger logs the traffic of the protocol. Without settings, logging is enabled by the
+// environment-variable PROTOLOG_ENABLE (see DefaultProtocolLoggerSettings)
+func Logger(protocol Implementation, settings ...*ProtocolLoggerSettings) Implementation {
+
+	var theSettings *ProtocolLoggerSettings
+	if len(settings) >= 1 {
+		theSettings = settings[0]
+	} else {
+		theSettings = DefaultProtocolLoggerSettings()
+	}
+
 	protoLogger := &protocolLogger{
-		enableLog: os.Getenv("PROTOLOG_ENABLE") != "",
-		protocol:  protocol,
+		settings: theSettings,
+		protocol: protocol,
 	}
 
-	if protoLogger.enableLog {
-		fmt.Printf("PL|%s| start - protocol logging is enabled\n", time.Now().Format("20060102 150405.0"))
+	if theSettings.enabled {
+		protoLogger.log(LogEvent{Timestamp: time.Now(), Type: LogTypeInfo, Message: "protocol logging is enabled"})
 	}
 
 	return protoLogger
 }
 
+// LoggerWithAdapter is a shortcut for Logger with the default settings and the logAdapter
 func LoggerWithAdapter(protocol Implementation, logAdapter LogAdapter) Implementation {
-	protoLogger := &protocolLogger{
-		enableLog:  os.Getenv("PROTOLOG_ENABLE") != "",
-		protocol:   protocol,
-		logAdapter: logAdapter,
-	}
+	return Logger(protocol, DefaultProtocolLoggerSettings().SetLogAdapter(logAdapter))
+}
 
-	if protoLogger.enableLog {
-		fmt.Printf("PL|%s| start - protocol logging is enabled\n", time.Now().Format("20060102 150405.0"))
+func peek(payload []byte) string {
+	peek := substr(makeBytesReadable(payload), 0, 30)
+	if len(payload) > 30 {
+		peek = peek + "..."
 	}
-
-	return protoLogger
+	return peek
 }
 
 func makeBytesReadable(in []byte) string {
@@ -170,28 +337,29 @@ func substr(input string, start int, length int) string {
 type netConnLoggerSpy struct {
 	conn           net.Conn
 	protocolLogger *protocolLogger
+	redactors      *directionRedactors
 }
 
 func (ls *netConnLoggerSpy) Read(b []byte) (n int, err error) {
 	n, err = ls.conn.Read(b)
-	if ls.protocolLogger.enableLog {
-		ls.protocolLogger.logRead(n, err, b)
-	}
+	ls.protocolLogger.logRead(ls.session(), n, err, ls.redactors.redact(CaptureReceived, b[:n]))
 	return n, err
 }
 func (ls *netConnLoggerSpy) Write(b []byte) (n int, err error) {
 	n, err = ls.conn.Write(b)
-	if ls.protocolLogger.enableLog {
-		ls.protocolLogger.logWrite(n, err, b)
-	}
+	ls.protocolLogger.logWrite(ls.session(), n, err, ls.redactors.redact(CaptureSent, b))
 	return n, err
 }
 func (ls *netConnLoggerSpy) Close() error {
-	if ls.protocolLogger.enableLog {
-		ls.protocolLogger.logClose(ls.conn.RemoteAddr().String())
-	}
+	ls.protocolLogger.logClose(ls.session())
 	return ls.conn.Close()
 }
+func (ls *netConnLoggerSpy) session() string {
+	if addr := ls.conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
 func (ls *netConnLoggerSpy) LocalAddr() net.Addr {
 	return ls.conn.LocalAddr()
 }
@@ -212,5 +380,6 @@ func wrapConnWithLogger(pl *protocolLogger, con net.Conn) net.Conn {
 	return &netConnLoggerSpy{
 		conn:           con,
 		protocolLogger: pl,
+		redactors:      newDirectionRedactors(pl.settings.redactor),
 	}
 }
@@ -0,0 +1,30 @@
+//go:build go1.21
+
+package protocol
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogAdapter writes the protocol log to the logger. Sent and received data is logged with
+// level Debug, failures with level Warn.
+func SlogLogAdapter(logger *slog.Logger) LogAdapter {
+	return LogAdapterFunc(func(event LogEvent) {
+		level := slog.LevelInfo
+		attrs := []slog.Attr{
+			slog.Time("timestamp", event.Timestamp),
+			slog.String("type", string(event.Type)),
+			slog.String("session", event.Session),
+		}
+		switch {
+		case event.Err != nil:
+			level = slog.LevelWarn
+			attrs = append(attrs, slog.String("error", event.Err.Error()))
+		case event.Type == LogTypeSend || event.Type == LogTypeRecv:
+			level = slog.LevelDebug
+			attrs = append(attrs, slog.String("payload", makeBytesReadable(event.Payload)), slog.Int("bytes", len(event.Payload)))
+		}
+		logger.LogAttrs(context.Background(), level, event.Message, attrs...)
+	})
+}
@@ -0,0 +1,23 @@
+//go:build go1.21
+
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogAdapter(t *testing.T) {
+	var output bytes.Buffer
+	adapter := SlogLogAdapter(slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	adapter.Log(LogEvent{Type: LogTypeRecv, Session: "10.0.0.1:4000", Payload: []byte{}, Message: "connection reset", Err: errors.New("connection reset")})
+
+	assert.Contains(t, output.String(), `"level":"WARN"`)
+	assert.Contains(t, output.String(), `"session":"10.0.0.1:4000"`)
+	assert.Contains(t, output.String(), `"error":"connection reset"`)
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerWithSettingsLogsStructuredEvents(t *testing.T) {
+	events := make([]LogEvent, 0)
+	settings := DefaultProtocolLoggerSettings().Enable().DisablePrintToStdout().
+		SetLogAdapter(LogAdapterFunc(func(event LogEvent) {
+			events = append(events, event)
+		}))
+
+	// the settings must survive NewInstance
+	instance := Logger(LengthPrefixed(DefaultLengthPrefixedProtocolSettings().SetLengthFieldSize(2)), settings).NewInstance()
+
+	host, instrument := net.Pipe()
+	go func() {
+		instrument.Write([]byte{0x00, 0x40})
+		instrument.Write(bytes.Repeat([]byte{'x'}, 0x40))
+		instrument.Close()
+	}()
+
+	message, err := instance.Receive(host)
+	assert.Nil(t, err)
+	assert.Equal(t, 0x40, len(message))
+
+	_, err = instance.Receive(host)
+	assert.NotNil(t, err)
+
+	received := make([]byte, 0)
+	failed := 0
+	assert.Equal(t, LogTypeInfo, events[0].Type, "logging is enabled")
+	for _, event := range events[1:] {
+		assert.Equal(t, "pipe", event.Session)
+		assert.Equal(t, LogTypeRecv, event.Type)
+		assert.False(t, event.Timestamp.IsZero())
+		if event.Err != nil {
+			failed++
+			continue
+		}
+		received = append(received, event.Payload...)
+	}
+	// the full payload is logged, not only the peek in the message
+	assert.Equal(t, append([]byte{0x00, 0x40}, bytes.Repeat([]byte{'x'}, 0x40)...), received)
+	assert.Equal(t, 1, failed)
+}
+
+func TestLoggerDisabled(t *testing.T) {
+	logged := false
+	instance := Logger(LengthPrefixed(), DefaultProtocolLoggerSettings().Disable().
+		SetLogAdapter(LogAdapterFunc(func(event LogEvent) {
+			logged = true
+		})))
+
+	host, instrument := net.Pipe()
+	go func() {
+		instance.Send(instrument, [][]byte{[]byte("data")})
+	}()
+	buffer := make([]byte, 8)
+	_, err := host.Read(buffer)
+	assert.Nil(t, err)
+	assert.False(t, logged)
+}
+
+func TestZerologLogAdapter(t *testing.T) {
+	var output bytes.Buffer
+	adapter := ZerologLogAdapter(zerolog.New(&output))
+
+	adapter.Log(LogEvent{Type: LogTypeSend, Session: "10.0.0.1:4000", Payload: []byte("\u0002H|\r"), Message: "<STX>H|<CR>"})
+
+	assert.Contains(t, output.String(), `"level":"debug"`)
+	assert.Contains(t, output.String(), `"session":"10.0.0.1:4000"`)
+	assert.Contains(t, output.String(), `"payload":"<STX>H|<CR>"`)
+	assert.Contains(t, output.String(), `"bytes":4`)
+}
@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"github.com/rs/zerolog"
+)
+
+// ZerologLogAdapter writes the protocol log to the logger. Sent and received data is logged with
+// level Debug, failures with level Warn.
+func ZerologLogAdapter(logger zerolog.Logger) LogAdapter {
+	return LogAdapterFunc(func(event LogEvent) {
+		var entry *zerolog.Event
+		switch {
+		case event.Err != nil:
+			entry = logger.Warn().Err(event.Err)
+		case event.Type == LogTypeSend || event.Type == LogTypeRecv:
+			entry = logger.Debug().Str("payload", makeBytesReadable(event.Payload)).Int("bytes", len(event.Payload))
+		default:
+			entry = logger.Info()
+		}
+		entry.Time("timestamp", event.Timestamp).
+			Str("type", string(event.Type)).
+			Str("session", event.Session).
+			Msg(event.Message)
+	})
+}
@@ -13,6 +13,7 @@ type RawProtocolSettings struct {
 	flushTimeout_ms int
 	readTimeout_ms  int
 	maxBufferSize   int
+	heartbeat       []byte
 }
 
 type rawprotocol struct {
@@ -28,6 +29,13 @@ func DefaultRawProtocolSettings() *RawProtocolSettings {
 	return &rp
 }
 
+// SetHeartbeat sets the bytes written as heartbeat on idle connections, nil disables the heartbeat.
+// The peer is not expected to answer, an answer is received as data.
+func (s RawProtocolSettings) SetHeartbeat(probe []byte) *RawProtocolSettings {
+	s.heartbeat = probe
+	return &s
+}
+
 // Raw receiver - no changes to incoming data
 // maxBufferSize - bytes to store (prevent buffer overflow with this)
 // readTimeout_ms required to enable the flush timeout
@@ -118,6 +126,10 @@ func (proto *rawprotocol) Interrupt() {
 	// Not necessary for raw
 }
 
+func (proto *rawprotocol) Heartbeat(conn net.Conn, timeout time.Duration) error {
+	return writeHeartbeat(conn, proto.settings.heartbeat, timeout)
+}
+
 func (proto *rawprotocol) Send(conn net.Conn, data [][]byte) (int, error) {
 	//proto.blockReceivingMainloop.Lock()
 	var (
@@ -0,0 +1,367 @@
+package protocol
+
+import (
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
+)
+
+// RedactionMask replaces every masked character
+const RedactionMask byte = '*'
+
+// Redactor masks sensitive data (e.g. patient names) before it is logged or captured. Only
+// printable characters are masked, control characters and the length stay as they are.
+// The data of one connection and direction is passed in order but in arbitrary chunks, so
+// redactors may keep state between the calls.
+type Redactor interface {
+	// Redact returns the data with the sensitive parts masked. data itself is not modified
+	Redact(data []byte) []byte
+	// NewInstance returns a redactor with a fresh state for another connection or direction
+	NewInstance() Redactor
+}
+
+// DefaultASTMRedactionFields are the patient identifying fields of the ASTM P record:
+// the patient IDs, name, mother's maiden name, birthdate, address and phone number
+var DefaultASTMRedactionFields = map[string][]int{
+	"P": {3, 4, 5, 6, 7, 8, 11, 13},
+}
+
+// DefaultHL7RedactionFields are the patient identifying fields of the PID and NK1 segments
+var DefaultHL7RedactionFields = map[string][]int{
+	"PID": {2, 3, 4, 5, 6, 7, 9, 11, 13, 14, 19, 20},
+	"NK1": {2, 4, 5, 6},
+}
+
+// ASTMFieldRedactor masks fields of ASTM (LIS2-A2) records, e.g. {"P": {6, 8}} masks name and
+// birthdate of the patient. Fields are numbered like the standard, the record type is field 1.
+// The delimiters are taken from the header record. Lis1A1 framing (frame number, checksum) is
+// recognized and stays visible, as do all delimiters.
+func ASTMFieldRedactor(fields map[string][]int) Redactor {
+	return (&astmRedactor{fields: fieldSets(fields)}).NewInstance()
+}
+
+// HL7FieldRedactor masks fields of HL7 v2 segments, e.g. {"PID": {5, 7}} masks name and
+// birthdate of the patient. Fields are numbered like the standard (PID-5 is the name). The
+// delimiters are taken from the MSH segment, MLLP framing stays visible.
+func HL7FieldRedactor(fields map[string][]int) Redactor {
+	return (&hl7Redactor{fields: fieldSets(fields)}).NewInstance()
+}
+
+// RegexRedactor masks everything matching one of the patterns. The patterns are matched
+// within each chunk of data, a match that is split between two reads is not found.
+func RegexRedactor(patterns ...*regexp.Regexp) Redactor {
+	return &regexRedactor{patterns: patterns}
+}
+
+// ChainRedactors applies all redactors one after the other
+func ChainRedactors(redactors ...Redactor) Redactor {
+	return &redactorChain{redactors: redactors}
+}
+
+func fieldSets(fields map[string][]int) map[string]map[int]bool {
+	sets := make(map[string]map[int]bool)
+	for record, numbers := range fields {
+		sets[record] = make(map[int]bool)
+		for _, number := range numbers {
+			sets[record][number] = true
+		}
+	}
+	return sets
+}
+
+// delimitedState tracks the position within the records of the "|"-delimited formats
+type delimitedState struct {
+	fieldDelimiter  byte
+	otherDelimiters []byte
+	atRecordStart   bool
+	record          []byte // record type or segment name
+	field           int
+}
+
+func newDelimitedState(fieldDelimiter byte, otherDelimiters ...byte) delimitedState {
+	return delimitedState{
+		fieldDelimiter:  fieldDelimiter,
+		otherDelimiters: otherDelimiters,
+		atRecordStart:   true,
+		record:          make([]byte, 0, 3),
+	}
+}
+
+func (s *delimitedState) isDelimiter(b byte) bool {
+	if b == s.fieldDelimiter {
+		return true
+	}
+	for _, delimiter := range s.otherDelimiters {
+		if b == delimiter {
+			return true
+		}
+	}
+	return false
+}
+
+// isRedactable tells whether a character is masked, control characters are always kept
+func isRedactable(b byte) bool {
+	return b >= 0x20 && b != 0x7F
+}
+
+// ASTM ------------------------------------------------------------------------------------
+
+type astmRedactor struct {
+	fields map[string]map[int]bool
+	state  delimitedState
+	// number of delimiter definitions of the header record still to be read
+	delimitersToRead int
+	// lis1a1 framing: frame number after STX, checksum after ETX and ETB
+	expectFrameNumber bool
+	inTrailer         bool
+}
+
+func (r *astmRedactor) NewInstance() Redactor {
+	return &astmRedactor{
+		fields: r.fields,
+		state:  newDelimitedState('|', '\\', '^', '&'),
+	}
+}
+
+func (r *astmRedactor) Redact(data []byte) []byte {
+	redacted := make([]byte, len(data))
+	s := &r.state
+	for i, b := range data {
+		redacted[i] = b
+
+		switch {
+		case b == utilities.STX:
+			r.expectFrameNumber = true
+			r.inTrailer = false
+			continue
+		case b == utilities.ETX || b == utilities.ETB:
+			r.expectFrameNumber = false
+			r.inTrailer = true
+			continue
+		case b == utilities.CR || b == utilities.LF:
+			// the CR of the trailer does not end the record, it might continue in the next frame (ETB)
+			if !r.inTrailer {
+				s.atRecordStart = true
+				r.delimitersToRead = 0
+			}
+			continue
+		case !isRedactable(b) || r.inTrailer:
+			continue
+		case r.expectFrameNumber:
+			r.expectFrameNumber = false
+			if b >= '0' && b <= '7' {
+				continue
+			}
+		}
+
+		if s.atRecordStart {
+			s.atRecordStart = false
+			s.record = append(s.record[:0], b)
+			s.field = 1
+			if b == 'H' {
+				// H|\^& defines the field, repeat, component and escape delimiter
+				r.delimitersToRead = 4
+			}
+			continue
+		}
+
+		if r.delimitersToRead > 0 {
+			if r.delimitersToRead == 4 {
+				s.fieldDelimiter = b
+				s.otherDelimiters = s.otherDelimiters[:0]
+				s.field++
+			} else {
+				s.otherDelimiters = append(s.otherDelimiters, b)
+			}
+			r.delimitersToRead--
+			continue
+		}
+
+		if b == s.fieldDelimiter {
+			s.field++
+			continue
+		}
+		if !s.isDelimiter(b) && r.fields[string(s.record)][s.field] {
+			redacted[i] = RedactionMask
+		}
+	}
+	return redacted
+}
+
+// HL7 -------------------------------------------------------------------------------------
+
+type hl7Redactor struct {
+	fields map[string]map[int]bool
+	state  delimitedState
+	// the encoding characters of the MSH segment (MSH-2) are read
+	readingEncodingCharacters bool
+}
+
+func (r *hl7Redactor) NewInstance() Redactor {
+	return &hl7Redactor{
+		fields: r.fields,
+		state:  newDelimitedState('|', '^', '~', '\\', '&'),
+	}
+}
+
+func (r *hl7Redactor) Redact(data []byte) []byte {
+	redacted := make([]byte, len(data))
+	s := &r.state
+	for i, b := range data {
+		redacted[i] = b
+
+		if b == utilities.CR || b == utilities.LF || b == utilities.VT || b == utilities.FS {
+			// segment terminator and MLLP framing
+			s.atRecordStart = true
+			s.record = s.record[:0]
+			r.readingEncodingCharacters = false
+			continue
+		}
+		if !isRedactable(b) {
+			continue
+		}
+
+		if s.atRecordStart {
+			if len(s.record) < 3 {
+				s.record = append(s.record, b)
+				continue
+			}
+			s.atRecordStart = false
+			s.field = 0
+			if string(s.record) == "MSH" {
+				// MSH-1 is the field separator itself, MSH-2 the encoding characters
+				s.fieldDelimiter = b
+				s.otherDelimiters = s.otherDelimiters[:0]
+				s.field = 2
+				r.readingEncodingCharacters = true
+				continue
+			}
+		}
+
+		if b == s.fieldDelimiter {
+			s.field++
+			r.readingEncodingCharacters = false
+			continue
+		}
+		if r.readingEncodingCharacters {
+			s.otherDelimiters = append(s.otherDelimiters, b)
+			continue
+		}
+		if !s.isDelimiter(b) && r.fields[string(s.record)][s.field] {
+			redacted[i] = RedactionMask
+		}
+	}
+	return redacted
+}
+
+// Regex -----------------------------------------------------------------------------------
+
+type regexRedactor struct {
+	patterns []*regexp.Regexp
+}
+
+func (r *regexRedactor) NewInstance() Redactor {
+	return r // stateless
+}
+
+func (r *regexRedactor) Redact(data []byte) []byte {
+	redacted := make([]byte, len(data))
+	copy(redacted, data)
+	for _, pattern := range r.patterns {
+		for _, match := range pattern.FindAllIndex(data, -1) {
+			for i := match[0]; i < match[1]; i++ {
+				if isRedactable(redacted[i]) {
+					redacted[i] = RedactionMask
+				}
+			}
+		}
+	}
+	return redacted
+}
+
+// Chain -----------------------------------------------------------------------------------
+
+type redactorChain struct {
+	redactors []Redactor
+}
+
+func (r *redactorChain) NewInstance() Redactor {
+	instances := make([]Redactor, len(r.redactors))
+	for i, redactor := range r.redactors {
+		instances[i] = redactor.NewInstance()
+	}
+	return &redactorChain{redactors: instances}
+}
+
+func (r *redactorChain) Redact(data []byte) []byte {
+	for _, redactor := range r.redactors {
+		data = redactor.Redact(data)
+	}
+	return data
+}
+
+// Capture sinks ---------------------------------------------------------------------------
+
+// RedactCaptureSink masks the traffic with the redactor before it is passed to the sink
+func RedactCaptureSink(sink CaptureSink, redactor Redactor) CaptureSink {
+	return &redactingCaptureSink{sink: sink, redactor: redactor}
+}
+
+type redactingCaptureSink struct {
+	sink     CaptureSink
+	redactor Redactor
+}
+
+func (rs *redactingCaptureSink) OpenSession(local, remote net.Addr, timestamp time.Time) CaptureSession {
+	return &redactingCaptureSession{
+		session:   rs.sink.OpenSession(local, remote, timestamp),
+		redactors: newDirectionRedactors(rs.redactor),
+	}
+}
+
+type redactingCaptureSession struct {
+	session   CaptureSession
+	redactors *directionRedactors
+}
+
+func (rs *redactingCaptureSession) Record(timestamp time.Time, direction CaptureDirection, data []byte) {
+	rs.session.Record(timestamp, direction, rs.redactors.redact(direction, data))
+}
+
+func (rs *redactingCaptureSession) Close(timestamp time.Time) {
+	rs.session.Close(timestamp)
+}
+
+// directionRedactors keeps one redactor per direction of a connection, nil = no redaction
+type directionRedactors struct {
+	mutex    sync.Mutex
+	received Redactor
+	sent     Redactor
+}
+
+func newDirectionRedactors(redactor Redactor) *directionRedactors {
+	if redactor == nil {
+		return &directionRedactors{}
+	}
+	return &directionRedactors{
+		received: redactor.NewInstance(),
+		sent:     redactor.NewInstance(),
+	}
+}
+
+func (dr *directionRedactors) redact(direction CaptureDirection, data []byte) []byte {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+
+	redactor := dr.received
+	if direction == CaptureSent {
+		redactor = dr.sent
+	}
+	if redactor == nil {
+		return data
+	}
+	return redactor.Redact(data)
+}
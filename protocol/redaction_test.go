@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
+	"github.com/stretchr/testify/assert"
+)
+
+func redactInChunks(redactor Redactor, data []byte, chunkSize int) []byte {
+	result := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		result = append(result, redactor.Redact(chunk)...)
+		data = data[len(chunk):]
+	}
+	return result
+}
+
+func TestASTMFieldRedactor(t *testing.T) {
+	transmission := "\u0005" +
+		"\u00021H|\\^&|||Analyzer\r\u000359\r\n" +
+		"\u00022P|1|4711|777025164810||Doe^John||19700101|M\r\u0003A7\r\n" +
+		"\u00023O|1|SID1||^^^GLU\r\u000306\r\n" +
+		"\u00024L|1|N\r\u000306\r\n" +
+		"\u0004"
+	expected := "\u0005" +
+		"\u00021H|\\^&|||Analyzer\r\u000359\r\n" +
+		"\u00022P|1|****|************||***^****||********|M\r\u0003A7\r\n" +
+		"\u00023O|1|SID1||^^^GLU\r\u000306\r\n" +
+		"\u00024L|1|N\r\u000306\r\n" +
+		"\u0004"
+
+	redactor := ASTMFieldRedactor(DefaultASTMRedactionFields)
+	for _, chunkSize := range []int{1, 7, len(transmission)} {
+		assert.Equal(t, expected, string(redactInChunks(redactor.NewInstance(), []byte(transmission), chunkSize)), "chunk size %d", chunkSize)
+	}
+}
+
+func TestASTMFieldRedactorRecordSplitIntoFrames(t *testing.T) {
+	// intermediate frame (ETB), the record continues in the next frame
+	transmission := "\u00021H|\\^&\r\u000359\r\n" +
+		"\u00022P|1||7770\u001742\r\n" +
+		"\u0002325164810||Doe\r\u0003A7\r\n"
+	expected := "\u00021H|\\^&\r\u000359\r\n" +
+		"\u00022P|1||****\u001742\r\n" +
+		"\u00023********||***\r\u0003A7\r\n"
+
+	assert.Equal(t, expected, string(ASTMFieldRedactor(DefaultASTMRedactionFields).Redact([]byte(transmission))))
+}
+
+func TestASTMFieldRedactorDelimitersFromHeader(t *testing.T) {
+	transmission := "H!@#$\rP!1!!ID!!Doe#John\rL!1\r"
+	expected := "H!@#$\rP!1!!**!!***#****\rL!1\r"
+
+	assert.Equal(t, expected, string(ASTMFieldRedactor(map[string][]int{"P": {4, 6}}).Redact([]byte(transmission))))
+}
+
+func TestHL7FieldRedactor(t *testing.T) {
+	message := "\u000bMSH|^~\\&|LAB|HOSP|||20220301||ORU^R01|1|P|2.5\r" +
+		"PID|1||123456^^^HOSP||Doe^John||19700101|M\r" +
+		"OBX|1|NM|GLU||5.4|mmol/l\r" +
+		"\u001c\r"
+	expected := "\u000bMSH|^~\\&|LAB|HOSP|||20220301||ORU^R01|1|P|2.5\r" +
+		"PID|1||******^^^****||***^****||********|M\r" +
+		"OBX|1|NM|GLU||5.4|mmol/l\r" +
+		"\u001c\r"
+
+	redactor := HL7FieldRedactor(map[string][]int{"PID": {3, 5, 7}})
+	for _, chunkSize := range []int{1, 5, len(message)} {
+		assert.Equal(t, expected, string(redactInChunks(redactor.NewInstance(), []byte(message), chunkSize)), "chunk size %d", chunkSize)
+	}
+}
+
+func TestHL7FieldRedactorMSHFields(t *testing.T) {
+	// MSH-1 is the field separator, MSH-3 the first field after the encoding characters
+	message := "MSH#^~\\&#LAB#HOSP\r"
+	expected := "MSH#^~\\&#***#HOSP\r"
+
+	assert.Equal(t, expected, string(HL7FieldRedactor(map[string][]int{"MSH": {3}}).Redact([]byte(message))))
+}
+
+func TestRegexRedactor(t *testing.T) {
+	redactor := RegexRedactor(regexp.MustCompile(`\d{8}`), regexp.MustCompile(`Doe`))
+
+	redacted := redactor.Redact([]byte("P|1|Doe|19700101\r"))
+	assert.Equal(t, "P|1|***|********\r", string(redacted))
+}
+
+func TestChainRedactorsKeepsLength(t *testing.T) {
+	redactor := ChainRedactors(
+		ASTMFieldRedactor(map[string][]int{"P": {6}}),
+		RegexRedactor(regexp.MustCompile(`SID\d+`)),
+	).NewInstance()
+
+	data := []byte("P|1||||Doe^John\rO|1|SID1\u0003\r\n")
+	redacted := redactor.Redact(data)
+	assert.Equal(t, "P|1||||***^****\rO|1|****\u0003\r\n", string(redacted))
+	assert.Equal(t, "P|1||||Doe^John\rO|1|SID1\u0003\r\n", string(data), "the data itself is not modified")
+}
+
+func TestLoggerAndCaptureRedact(t *testing.T) {
+	directory := t.TempDir()
+	redactor := ASTMFieldRedactor(DefaultASTMRedactionFields)
+
+	var mutex sync.Mutex
+	logged := make([]byte, 0)
+	var sink captureSinkRecorder
+	instance := Logger(
+		Capture(Lis1A1Protocol(), DefaultCaptureSettings().SetDirectory(directory).SetRedactor(redactor)),
+		DefaultProtocolLoggerSettings().Enable().DisablePrintToStdout().SetRedactor(redactor).SetCaptureSink(&sink).
+			SetLogAdapter(LogAdapterFunc(func(event LogEvent) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if event.Type == LogTypeRecv {
+					logged = append(logged, event.Payload...)
+					assert.NotContains(t, event.Message, "777025164810")
+				}
+			})),
+	).NewInstance()
+
+	host, instrument := net.Pipe()
+	go func() {
+		answer := make([]byte, 1)
+		for i, frame := range lis1A1Session {
+			instrument.Write(frame)
+			if i < len(lis1A1Session)-1 {
+				instrument.Read(answer)
+			}
+		}
+	}()
+
+	message, err := instance.Receive(host)
+	assert.Nil(t, err)
+	// the protocol itself gets the original data
+	assert.Contains(t, string(message), "777025164810")
+	host.Close()
+
+	redacted := strings.Replace(string(concat(lis1A1Session)), "777025164810", "************", 1)
+	mutex.Lock()
+	assert.Equal(t, redacted, string(logged))
+	mutex.Unlock()
+	sink.mutex.Lock()
+	assert.Equal(t, redacted, string(sink.received))
+	sink.mutex.Unlock()
+
+	files, err := os.ReadDir(directory)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	records, err := ReadCaptureFile(filepath.Join(directory, files[0].Name()))
+	assert.Nil(t, err)
+	captured := make([]byte, 0)
+	for _, record := range records {
+		if record.Direction == CaptureReceived {
+			captured = append(captured, record.Data...)
+		}
+	}
+	assert.Equal(t, redacted, string(captured))
+	assert.Equal(t, utilities.ENQ, captured[0])
+}
+
+type captureSinkRecorder struct {
+	mutex    sync.Mutex
+	received []byte
+}
+
+func (r *captureSinkRecorder) OpenSession(local, remote net.Addr, timestamp time.Time) CaptureSession {
+	return r
+}
+
+func (r *captureSinkRecorder) Record(timestamp time.Time, direction CaptureDirection, data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if direction == CaptureReceived {
+		r.received = append(r.received, data...)
+	}
+}
+
+func (r *captureSinkRecorder) Close(timestamp time.Time) {}
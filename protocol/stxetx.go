@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 
 	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
 )
@@ -14,7 +15,7 @@ type STXETXProtocolSettings struct {
 type stxetx struct {
 	settings               *STXETXProtocolSettings
 	receiveQ               chan protocolMessage
-	receiveThreadIsRunning bool
+	receiveThreadIsRunning int32
 }
 
 func DefaultSTXETXProtocolSettings() *STXETXProtocolSettings {
@@ -34,7 +35,7 @@ func STXETX(settings ...*STXETXProtocolSettings) Implementation {
 	return &stxetx{
 		settings:               thesettings,
 		receiveQ:               make(chan protocolMessage, 1024),
-		receiveThreadIsRunning: false,
+		receiveThreadIsRunning: 0,
 	}
 }
 
@@ -42,7 +43,7 @@ func (proto *stxetx) NewInstance() Implementation {
 	return &stxetx{
 		settings:               proto.settings,
 		receiveQ:               make(chan protocolMessage, 1024),
-		receiveThreadIsRunning: false,
+		receiveThreadIsRunning: 0,
 	}
 }
 
@@ -68,13 +69,11 @@ func (proto *stxetx) Receive(conn net.Conn) ([]byte, error) {
 // asynchronous receiveloop
 func (proto *stxetx) ensureReceiveThreadRunning(conn net.Conn) {
 
-	if proto.receiveThreadIsRunning {
+	if !atomic.CompareAndSwapInt32(&proto.receiveThreadIsRunning, 0, 1) {
 		return
 	}
 
 	go func() {
-		proto.receiveThreadIsRunning = true
-
 		tcpReceiveBuffer := make([]byte, 4096)
 		receivedMsg := make([]byte, 0)
 
@@ -105,20 +104,20 @@ func (proto *stxetx) ensureReceiveThreadRunning(conn net.Conn) {
 
 					messageEOF := protocolMessage{Status: EOF, Data: []byte{}}
 					proto.receiveQ <- messageEOF
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					return
 				} else if err == io.EOF { // EOF = silent exit
 
 					messageEOF := protocolMessage{Status: EOF}
 					proto.receiveQ <- messageEOF
 
-					proto.receiveThreadIsRunning = false
+					atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 					return
 				}
 
 				messageERROR := protocolMessage{Status: ERROR, Data: []byte(err.Error())}
 				proto.receiveQ <- messageERROR
-				proto.receiveThreadIsRunning = false
+				atomic.StoreInt32(&proto.receiveThreadIsRunning, 0)
 				return
 			}
 
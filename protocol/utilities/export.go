@@ -0,0 +1,132 @@
+package utilities
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ExportDOT renders the rules as a Graphviz digraph. Every rule is one edge, labelled with its
+// symbols (ranges are compacted, control characters are named), the action code and a "+" if
+// the symbol is scanned into the buffer. Timer rules are labelled with their timeout.
+// Render with e.g. "dot -Tsvg".
+func ExportDOT(name string, rules []Rule) string {
+	var sb strings.Builder
+	if name == "" {
+		name = "fsm"
+	}
+	fmt.Fprintf(&sb, "digraph %s {\n", dotQuote(name))
+	sb.WriteString("  rankdir=LR;\n")
+	sb.WriteString("  node [shape=circle];\n")
+	for _, state := range exportStates(rules) {
+		shape := ""
+		if state == Init {
+			shape = ", shape=doublecircle"
+		}
+		fmt.Fprintf(&sb, "  s%d [label=\"%d\"%s];\n", state, state, shape)
+	}
+	for _, rule := range rules {
+		fmt.Fprintf(&sb, "  s%d -> s%d [label=%s];\n", rule.FromState, rule.ToState, dotQuote(edgeLabel(rule)))
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// ExportMermaid renders the rules as a Mermaid state diagram (stateDiagram-v2), labelled like ExportDOT
+func ExportMermaid(rules []Rule) string {
+	var sb strings.Builder
+	sb.WriteString("stateDiagram-v2\n")
+	fmt.Fprintf(&sb, "  [*] --> s%d\n", Init)
+	for _, rule := range rules {
+		fmt.Fprintf(&sb, "  s%d --> s%d : %s\n", rule.FromState, rule.ToState, mermaidEscape(edgeLabel(rule)))
+	}
+	return sb.String()
+}
+
+func exportStates(rules []Rule) []State {
+	seen := map[State]bool{Init: true}
+	states := []State{Init}
+	for _, rule := range rules {
+		for _, state := range []State{rule.FromState, rule.ToState} {
+			if !seen[state] {
+				seen[state] = true
+				states = append(states, state)
+			}
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+	return states
+}
+
+func edgeLabel(rule Rule) string {
+	label := describeSymbols(rule.Symbols)
+	if rule.Timeout > 0 {
+		label = "after " + rule.Timeout.String()
+	}
+	if rule.Scan {
+		label += " +"
+	}
+	if rule.ActionCode != Consumed {
+		label += " / " + string(rule.ActionCode)
+	}
+	return label
+}
+
+// describeSymbols lists the symbols sorted, consecutive symbols are compacted to ranges
+func describeSymbols(symbols []byte) string {
+	var present [256]bool
+	for _, symbol := range symbols {
+		present[symbol] = true
+	}
+
+	parts := make([]string, 0)
+	for i := 0; i < 256; i++ {
+		if !present[i] {
+			continue
+		}
+		j := i
+		for j+1 < 256 && present[j+1] {
+			j++
+		}
+		switch {
+		case j == i:
+			parts = append(parts, symbolName(byte(i)))
+		case j == i+1:
+			parts = append(parts, symbolName(byte(i)), symbolName(byte(j)))
+		default:
+			parts = append(parts, symbolName(byte(i))+"-"+symbolName(byte(j)))
+		}
+		i = j
+	}
+	return strings.Join(parts, ",")
+}
+
+func symbolName(symbol byte) string {
+	if name, ok := ASCIIMapNotPrintable[symbol]; ok {
+		return name
+	}
+	if symbol == ' ' || symbol >= 0x7F {
+		return fmt.Sprintf("0x%02X", symbol)
+	}
+	return string(symbol)
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// mermaidEscape replaces the characters that break a mermaid label with entity codes
+func mermaidEscape(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '<', '>', '"', '#', ';', ':', '{', '}', '|', '`':
+			fmt.Fprintf(&sb, "#%d;", r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,47 @@
+package utilities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var exportRules = []Rule{
+	{FromState: Init, Symbols: []byte{ENQ}, ToState: 1, ActionCode: Start},
+	{FromState: 1, Symbols: []byte("0123456789"), ToState: 1, Scan: true},
+	{FromState: 1, Symbols: []byte{'"', 'x'}, ToState: 1, Scan: true},
+	{FromState: 1, Symbols: []byte{ETX}, ToState: Init, ActionCode: Finished},
+	{FromState: 1, Timeout: 30 * time.Second, ToState: Init, ActionCode: Timeout},
+}
+
+func TestExportDOT(t *testing.T) {
+	assert.Equal(t, `digraph "lis" {
+  rankdir=LR;
+  node [shape=circle];
+  s0 [label="0", shape=doublecircle];
+  s1 [label="1"];
+  s0 -> s1 [label="<ENQ> / Start"];
+  s1 -> s1 [label="0-9 +"];
+  s1 -> s1 [label="\",x +"];
+  s1 -> s0 [label="<ETX> / Finished"];
+  s1 -> s0 [label="after 30s / Timeout"];
+}
+`, ExportDOT("lis", exportRules))
+}
+
+func TestExportMermaid(t *testing.T) {
+	assert.Equal(t, `stateDiagram-v2
+  [*] --> s0
+  s0 --> s1 : #60;ENQ#62; / Start
+  s1 --> s1 : 0-9 +
+  s1 --> s1 : #34;,x +
+  s1 --> s0 : #60;ETX#62; / Finished
+  s1 --> s0 : after 30s / Timeout
+`, CreateFSM(exportRules).ExportMermaid())
+}
+
+func TestDescribeSymbols(t *testing.T) {
+	assert.Equal(t, "<LF>,<CR>,0x20-0xFF", describeSymbols(PrintableChars8Bit))
+	assert.Equal(t, "A,B,x", describeSymbols([]byte("xBA")))
+}
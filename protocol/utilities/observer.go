@@ -0,0 +1,72 @@
+package utilities
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// TransitionEvent describes one byte pushed into the state machine. If no rule matched,
+// ActionCode is Error, Err is set and ToState equals FromState.
+type TransitionEvent struct {
+	Timestamp    time.Time
+	FromState    State
+	ToState      State
+	Token        byte // not set for timer rules
+	ActionCode   ActionCode
+	Scan         bool // the token was added to the buffer
+	Timer        bool // the transition was performed by a timer rule (see Expire)
+	BufferLength int  // length of the buffer after the transition
+	Err          error
+}
+
+// TransitionObserver receives an event for every transition of a state machine. It is called
+// synchronously from Push, slow observers slow down the protocol.
+type TransitionObserver interface {
+	Transition(event TransitionEvent)
+}
+
+// TransitionObserverFunc allows to use an ordinary function as TransitionObserver
+type TransitionObserverFunc func(event TransitionEvent)
+
+func (f TransitionObserverFunc) Transition(event TransitionEvent) {
+	f(event)
+}
+
+// ZerologTransitionObserver logs every transition with level Trace to the logger
+func ZerologTransitionObserver(logger zerolog.Logger) TransitionObserver {
+	return TransitionObserverFunc(func(event TransitionEvent) {
+		entry := logger.Trace()
+		if event.Err != nil {
+			entry = logger.Debug().Err(event.Err)
+		}
+		entry.Time("timestamp", event.Timestamp).
+			Int("from", int(event.FromState)).
+			Int("to", int(event.ToState)).
+			Str("token", makeBytesReadable([]byte{event.Token})).
+			Bool("timer", event.Timer).
+			Str("action", string(event.ActionCode)).
+			Bool("scan", event.Scan).
+			Int("bufferLength", event.BufferLength).
+			Msg("fsm transition")
+	})
+}
+
+// printTransitionObserver prints the transitions to stdout, used with PROTOLOG_ENABLE=extended
+type printTransitionObserver struct{}
+
+func (printTransitionObserver) Transition(event TransitionEvent) {
+	if event.Err != nil {
+		fmt.Printf(" F|%s| %3d -> ERR with token 0x%02x '%s' [%s]\n", event.Timestamp.Format("20060102 150405.0"),
+			event.FromState, event.Token, makeBytesReadable([]byte{event.Token}), event.Err)
+		return
+	}
+	if event.Timer {
+		fmt.Printf(" F|%s| %3d -> %3d on timeout [ActionCode:'%s', buffer:%d]\n", event.Timestamp.Format("20060102 150405.0"),
+			event.FromState, event.ToState, event.ActionCode, event.BufferLength)
+		return
+	}
+	fmt.Printf(" F|%s| %3d -> %3d with token 0x%02x '%s' [ActionCode:'%s', scan:%t, buffer:%d]\n", event.Timestamp.Format("20060102 150405.0"),
+		event.FromState, event.ToState, event.Token, makeBytesReadable([]byte{event.Token}), event.ActionCode, event.Scan, event.BufferLength)
+}
@@ -0,0 +1,140 @@
+package utilities
+
+import (
+	"fmt"
+	"sort"
+)
+
+type RuleIssueKind string
+
+const (
+	// OverlappingRules - two rules of the same state share symbols. For these symbols only the first rule is used
+	OverlappingRules RuleIssueKind = "OverlappingRules"
+	// ShadowedRule - all symbols of a rule are already used by earlier rules of the same state, it is never used.
+	// Also reported for a second timer rule of a state
+	ShadowedRule RuleIssueKind = "ShadowedRule"
+	// UnreachableState - there are rules for a state, but no rule leads there from the Init state
+	UnreachableState RuleIssueKind = "UnreachableState"
+	// DeadEndState - a rule leads to a state that has no rules. Every byte received there is an error
+	DeadEndState RuleIssueKind = "DeadEndState"
+)
+
+type RuleIssue struct {
+	Kind      RuleIssueKind
+	State     State
+	Rule      int    // index of the affected rule, -1 for issues of a state
+	OtherRule int    // index of the earlier rule for OverlappingRules and a shadowed timer rule, otherwise -1
+	Symbols   []byte // the symbols in question for OverlappingRules and ShadowedRule
+}
+
+func (issue RuleIssue) String() string {
+	switch issue.Kind {
+	case OverlappingRules:
+		return fmt.Sprintf("%s: rule %d and rule %d in state %d share the symbols '%s', rule %d wins",
+			issue.Kind, issue.OtherRule, issue.Rule, issue.State, prettyprint(issue.Symbols), issue.OtherRule)
+	case ShadowedRule:
+		if issue.OtherRule >= 0 {
+			return fmt.Sprintf("%s: rule %d in state %d is never used, rule %d is the timer rule of the state", issue.Kind, issue.Rule, issue.State, issue.OtherRule)
+		}
+		return fmt.Sprintf("%s: rule %d in state %d is never used, its symbols are used by earlier rules", issue.Kind, issue.Rule, issue.State)
+	case UnreachableState:
+		return fmt.Sprintf("%s: state %d can not be reached from the initial state", issue.Kind, issue.State)
+	case DeadEndState:
+		return fmt.Sprintf("%s: rule %d leads to state %d which has no rules", issue.Kind, issue.Rule, issue.State)
+	default:
+		return fmt.Sprintf("%s: state %d, rule %d", issue.Kind, issue.State, issue.Rule)
+	}
+}
+
+// ValidateRules reports rules that overlap or are never used, states that can not be reached
+// and states without any rule to leave them.
+func ValidateRules(rules []Rule) []RuleIssue {
+	issues := make([]RuleIssue, 0)
+
+	// first rule for every symbol of every state
+	firstRule := make(map[State]*[256]int)
+	// first timer rule of every state
+	firstTimer := make(map[State]int)
+	for i, rule := range rules {
+		owners, ok := firstRule[rule.FromState]
+		if !ok {
+			owners = &[256]int{}
+			for symbol := range owners {
+				owners[symbol] = -1
+			}
+			firstRule[rule.FromState] = owners
+		}
+
+		if rule.Timeout > 0 {
+			if other, ok := firstTimer[rule.FromState]; ok {
+				issues = append(issues, RuleIssue{Kind: ShadowedRule, State: rule.FromState, Rule: i, OtherRule: other})
+			} else {
+				firstTimer[rule.FromState] = i
+			}
+			continue
+		}
+
+		overlaps := make(map[int][]byte)
+		usedSymbols := 0
+		seen := [256]bool{}
+		for _, symbol := range rule.Symbols {
+			if seen[symbol] {
+				continue
+			}
+			seen[symbol] = true
+			if owners[symbol] == -1 {
+				owners[symbol] = i
+				usedSymbols++
+			} else {
+				overlaps[owners[symbol]] = append(overlaps[owners[symbol]], symbol)
+			}
+		}
+
+		if usedSymbols == 0 && len(rule.Symbols) > 0 {
+			issues = append(issues, RuleIssue{Kind: ShadowedRule, State: rule.FromState, Rule: i, OtherRule: -1, Symbols: rule.Symbols})
+			continue
+		}
+		otherRules := make([]int, 0, len(overlaps))
+		for other := range overlaps {
+			otherRules = append(otherRules, other)
+		}
+		sort.Ints(otherRules)
+		for _, other := range otherRules {
+			issues = append(issues, RuleIssue{Kind: OverlappingRules, State: rule.FromState, Rule: i, OtherRule: other, Symbols: overlaps[other]})
+		}
+	}
+
+	reachable := map[State]bool{Init: true}
+	queue := []State{Init}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for _, rule := range rules {
+			if rule.FromState == state && !reachable[rule.ToState] {
+				reachable[rule.ToState] = true
+				queue = append(queue, rule.ToState)
+			}
+		}
+	}
+
+	states := make([]State, 0, len(firstRule))
+	for state := range firstRule {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+	for _, state := range states {
+		if !reachable[state] {
+			issues = append(issues, RuleIssue{Kind: UnreachableState, State: state, Rule: -1, OtherRule: -1})
+		}
+	}
+
+	deadEnds := make(map[State]bool)
+	for i, rule := range rules {
+		if _, hasRules := firstRule[rule.ToState]; !hasRules && !deadEnds[rule.ToState] {
+			deadEnds[rule.ToState] = true
+			issues = append(issues, RuleIssue{Kind: DeadEndState, State: rule.ToState, Rule: i, OtherRule: -1})
+		}
+	}
+
+	return issues
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 var (
@@ -22,6 +24,7 @@ const (
 	Error           ActionCode = "Error"
 	RequestFinished ActionCode = "RequestFinished"
 	Finished        ActionCode = "Finished"
+	Timeout         ActionCode = "Timeout"
 )
 
 type State int
@@ -32,32 +35,127 @@ const (
 
 // The rule describes the transtion from each state to another. The transition
 // is performed with every new character.
+// A rule with a Timeout is a timer rule: it is performed when no character arrived within
+// the timeout after entering the state or after the last character. Its Symbols are ignored.
 type Rule struct {
-	FromState  State      // Current state
-	Symbols    []byte     // Any of these symbols will trigger this transition
-	ToState    State      // Target state of transition
-	ActionCode ActionCode // Define an action to perform when this rule is used
-	Scan       bool       // If enabled the character is added to the buffer
+	FromState  State         // Current state
+	Symbols    []byte        // Any of these symbols will trigger this transition
+	ToState    State         // Target state of transition
+	ActionCode ActionCode    // Define an action to perform when this rule is used
+	Scan       bool          // If enabled the character is added to the buffer
+	Timeout    time.Duration // If set, the rule is performed by Expire instead of a character
+}
+
+// Clock is the source of time for the timer rules, replace it in tests (see SetClock)
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
 }
 
 type FiniteStateMachine interface {
 	Push(token byte) ([]byte, ActionCode, error)
 	ResetBuffer()
 	Init()
+	// SetTransitionObserver replaces the observer that receives an event for every transition. nil disables it.
+	SetTransitionObserver(observer TransitionObserver)
+	// SetClock replaces the clock used for timer rules, by default the system time
+	SetClock(clock Clock)
+	// Deadline returns when the timer rule of the current state expires. ok is false if the
+	// current state has no timer rule
+	Deadline() (deadline time.Time, ok bool)
+	// Expire performs the timer rule of the current state if its deadline has passed. Like Push it
+	// returns the buffer with the action code of the rule. expired is false if no rule was performed
+	Expire() (buffer []byte, action ActionCode, expired bool)
+	// ExportDOT renders the rules as a Graphviz digraph (see ExportDOT)
+	ExportDOT(name string) string
+	// ExportMermaid renders the rules as a Mermaid state diagram (see ExportMermaid)
+	ExportMermaid() string
+}
+
+// A transitionRow holds the rule for every possible byte in one state, nil = no rule
+type transitionRow struct {
+	symbols [256]*compiledRule
+	timer   *compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	toRow *transitionRow // row of the target state, nil if there are no rules for it
 }
 
 type fsm struct {
 	rules         []Rule
+	table         map[State]*transitionRow
+	currentRow    *transitionRow
 	currentState  State
 	currentBuffer []byte
+	observer      TransitionObserver
+	clock         Clock
+	// last character or entering the state, only maintained for states with a timer rule
+	lastActivity time.Time
 }
 
+// CreateFSM compiles the rules into a transition table with one row per state. When multiple
+// rules of a state match the same symbol, the first rule wins. Issues found in the rules are
+// logged (see ValidateRules).
+// With the environment-variable PROTOLOG_ENABLE=extended every transition is printed to stdout.
 func CreateFSM(data []Rule) FiniteStateMachine {
-	return &fsm{
+	for _, issue := range ValidateRules(data) {
+		if issue.Kind == OverlappingRules {
+			log.Debug().Str("issue", issue.String()).Msg("fsm rules")
+		} else {
+			log.Warn().Str("issue", issue.String()).Msg("fsm rules")
+		}
+	}
+
+	table := compileRules(data)
+	machine := &fsm{
 		rules:         data,
+		table:         table,
+		currentRow:    table[Init],
 		currentBuffer: make([]byte, 0),
 		currentState:  Init,
+		clock:         systemClock{},
 	}
+	machine.lastActivity = machine.clock.Now()
+	if os.Getenv("PROTOLOG_ENABLE") == "extended" {
+		machine.observer = printTransitionObserver{}
+	}
+	return machine
+}
+
+func compileRules(rules []Rule) map[State]*transitionRow {
+	table := make(map[State]*transitionRow)
+	for _, rule := range rules {
+		if _, ok := table[rule.FromState]; !ok {
+			table[rule.FromState] = &transitionRow{}
+		}
+	}
+
+	for _, rule := range rules {
+		row := table[rule.FromState]
+		compiled := &compiledRule{
+			Rule:  rule,
+			toRow: table[rule.ToState],
+		}
+		if rule.Timeout > 0 {
+			if row.timer == nil {
+				row.timer = compiled
+			}
+			continue
+		}
+		for _, symbol := range rule.Symbols {
+			if row.symbols[symbol] == nil {
+				row.symbols[symbol] = compiled
+			}
+		}
+	}
+	return table
 }
 
 // Helper function to shorten strings to 15 characters for log-printing
@@ -75,31 +173,55 @@ func prettyprint(datain []byte) string {
 
 func (s *fsm) Push(token byte) ([]byte, ActionCode, error) {
 
-	rule, err := s.findMatchingRule(token)
-
-	if os.Getenv("PROTOLOG_ENABLE") == "extended" {
-		fmt.Printf(" F|%s| %3d -> %3d with token 0x%02x '%s' [%d->%d, Symbols:'%s', ActionCode:'%s', scan:%t]\n",
-			time.Now().Format("20060102 150405.0"),
-			s.currentState,
-			rule.ToState,
-			token,
-			makeBytesReadable([]byte{token}),
-			rule.FromState,
-			rule.ToState,
-			prettyprint(rule.Symbols),
-			rule.ActionCode,
-			rule.Scan)
+	var rule Rule
+	var err error
+	var compiled *compiledRule
+	if s.currentRow != nil {
+		compiled = s.currentRow.symbols[token]
+	}
+	if compiled != nil {
+		rule = compiled.Rule
+	} else {
+		err = fmt.Errorf(`%w : "%s" ascii: %q currentBuffer: "%s" , status of fsm: %d`, ErrInvalidCharacter, string(token), token, string(s.currentBuffer), s.currentState)
 	}
 
 	if err != nil {
+		if s.observer != nil {
+			s.observer.Transition(TransitionEvent{
+				Timestamp:    s.clock.Now(),
+				FromState:    s.currentState,
+				ToState:      s.currentState,
+				Token:        token,
+				ActionCode:   Error,
+				BufferLength: len(s.currentBuffer),
+				Err:          err,
+			})
+		}
 		return nil, Error, err
 	}
 
+	fromState := s.currentState
 	if rule.Scan {
 		s.currentBuffer = append(s.currentBuffer, token)
 	}
 
 	s.currentState = rule.ToState
+	s.currentRow = compiled.toRow
+	if s.currentRow != nil && s.currentRow.timer != nil {
+		s.lastActivity = s.clock.Now()
+	}
+
+	if s.observer != nil {
+		s.observer.Transition(TransitionEvent{
+			Timestamp:    s.clock.Now(),
+			FromState:    fromState,
+			ToState:      rule.ToState,
+			Token:        token,
+			ActionCode:   rule.ActionCode,
+			Scan:         rule.Scan,
+			BufferLength: len(s.currentBuffer),
+		})
+	}
 
 	if rule.ActionCode != Consumed {
 		return s.currentBuffer, rule.ActionCode, nil
@@ -112,15 +234,65 @@ func (s *fsm) ResetBuffer() {
 	s.currentBuffer = make([]byte, 0)
 }
 
-func (s *fsm) findMatchingRule(token byte) (Rule, error) {
-	for _, rule := range s.rules {
-		if rule.FromState == s.currentState && s.containsSymbol(rule.Symbols, token) {
-			return rule, nil
-		}
+func (s *fsm) SetTransitionObserver(observer TransitionObserver) {
+	s.observer = observer
+}
+
+func (s *fsm) ExportDOT(name string) string {
+	return ExportDOT(name, s.rules)
+}
+
+func (s *fsm) ExportMermaid() string {
+	return ExportMermaid(s.rules)
+}
+
+func (s *fsm) SetClock(clock Clock) {
+	s.clock = clock
+	s.lastActivity = clock.Now()
+}
+
+func (s *fsm) Deadline() (time.Time, bool) {
+	if s.currentRow == nil || s.currentRow.timer == nil {
+		return time.Time{}, false
+	}
+	return s.lastActivity.Add(s.currentRow.timer.Timeout), true
+}
+
+func (s *fsm) Expire() ([]byte, ActionCode, bool) {
+	deadline, ok := s.Deadline()
+	if !ok {
+		return []byte{}, Consumed, false
+	}
+	now := s.clock.Now()
+	if now.Before(deadline) {
+		return []byte{}, Consumed, false
+	}
+
+	timer := s.currentRow.timer
+	fromState := s.currentState
+	s.currentState = timer.ToState
+	s.currentRow = timer.toRow
+	s.lastActivity = now
+
+	if s.observer != nil {
+		s.observer.Transition(TransitionEvent{
+			Timestamp:    now,
+			FromState:    fromState,
+			ToState:      timer.ToState,
+			ActionCode:   timer.ActionCode,
+			Timer:        true,
+			BufferLength: len(s.currentBuffer),
+		})
+	}
+
+	if timer.ActionCode != Consumed {
+		return s.currentBuffer, timer.ActionCode, true
 	}
-	return Rule{}, fmt.Errorf(`%w : "%s" ascii: %q currentBuffer: "%s" , status of fsm: %d`, ErrInvalidCharacter, string(token), token, string(s.currentBuffer), s.currentState)
+	return []byte{}, Consumed, true
 }
 
 func (s *fsm) Init() {
 	s.currentState = Init
+	s.currentRow = s.table[Init]
+	s.lastActivity = s.clock.Now()
 }
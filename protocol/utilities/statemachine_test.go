@@ -2,6 +2,7 @@ package utilities
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -120,3 +121,228 @@ func TestBasic(t *testing.T) {
 	}
 
 }
+
+func TestFirstMatchingRuleWins(t *testing.T) {
+	automate := CreateFSM([]Rule{
+		{FromState: Init, Symbols: []byte("0123"), ToState: 1, ActionCode: "Digit"},
+		{FromState: Init, Symbols: PrintableChars8Bit, ToState: 2, ActionCode: "Other"},
+		{FromState: 1, Symbols: PrintableChars8Bit, ToState: Init},
+	})
+
+	_, action, err := automate.Push('1')
+	assert.Nil(t, err)
+	assert.Equal(t, ActionCode("Digit"), action)
+
+	_, _, err = automate.Push('x')
+	assert.Nil(t, err)
+
+	_, action, err = automate.Push('x')
+	assert.Nil(t, err)
+	assert.Equal(t, ActionCode("Other"), action)
+
+	// state 2 has no rules
+	_, action, err = automate.Push('x')
+	assert.ErrorIs(t, err, ErrInvalidCharacter)
+	assert.Equal(t, Error, action)
+
+	automate.Init()
+	_, action, err = automate.Push('3')
+	assert.Nil(t, err)
+	assert.Equal(t, ActionCode("Digit"), action)
+}
+
+func TestValidateRules(t *testing.T) {
+	issues := ValidateRules([]Rule{
+		{FromState: Init, Symbols: []byte{ENQ}, ToState: 1},
+		{FromState: Init, Symbols: []byte{ENQ, EOT}, ToState: Init},
+		{FromState: 1, Symbols: []byte("0123"), ToState: 2, Scan: true},
+		{FromState: 1, Symbols: []byte("01"), ToState: 3},
+		{FromState: 2, Symbols: []byte{EOT}, ToState: Init},
+		{FromState: 4, Symbols: []byte{EOT}, ToState: Init},
+	})
+
+	assert.Equal(t, []RuleIssue{
+		{Kind: OverlappingRules, State: Init, Rule: 1, OtherRule: 0, Symbols: []byte{ENQ}},
+		{Kind: ShadowedRule, State: 1, Rule: 3, OtherRule: -1, Symbols: []byte("01")},
+		{Kind: UnreachableState, State: 4, Rule: -1, OtherRule: -1},
+		{Kind: DeadEndState, State: 3, Rule: 3, OtherRule: -1},
+	}, issues)
+}
+
+// lis1A1LikeRules has the same shape as the LIS1A1 receive rules: a catch-all rule in the Init state
+// and long symbol lists for the text of a frame
+var lis1A1LikeRules = []Rule{
+	{FromState: Init, Symbols: []byte{EOT}, ToState: Init},
+	{FromState: Init, Symbols: Exclude(PrintableChars8Bit, []byte{ENQ}), ToState: Init},
+	{FromState: Init, Symbols: []byte{ENQ}, ToState: 1},
+	{FromState: 1, Symbols: []byte{STX}, ToState: 99},
+	{FromState: 99, Symbols: []byte("01234567"), ToState: 2, Scan: true},
+	{FromState: 2, Symbols: PrintableChars8Bit, ToState: 2, Scan: true},
+	{FromState: 2, Symbols: []byte{ETX}, ToState: 10, ActionCode: LineReceived},
+	{FromState: 10, Symbols: []byte("0123456789ABCDEFabcdef"), ToState: 10, Scan: true},
+	{FromState: 10, Symbols: []byte{CR}, ToState: 11, ActionCode: CheckSum},
+	{FromState: 11, Symbols: []byte{LF}, ToState: 12},
+	{FromState: 12, Symbols: []byte{STX}, ToState: 99},
+	{FromState: 12, Symbols: []byte{EOT}, ToState: Init, ActionCode: Finished},
+}
+
+// linearFSM is the former implementation of the FSM that searches all rules for every byte. It is
+// kept as reference for the benchmarks.
+type linearFSM struct {
+	rules        []Rule
+	currentState State
+	buffer       []byte
+}
+
+func (s *linearFSM) Push(token byte) ActionCode {
+	for _, rule := range s.rules {
+		if rule.FromState != s.currentState {
+			continue
+		}
+		for _, symbol := range rule.Symbols {
+			if symbol == token {
+				if rule.Scan {
+					s.buffer = append(s.buffer, token)
+				}
+				s.currentState = rule.ToState
+				return rule.ActionCode
+			}
+		}
+	}
+	return Error
+}
+
+func benchmarkTransmission() []byte {
+	transmission := []byte("idle noise before the transmission starts")
+	transmission = append(transmission, ENQ)
+	for i := 0; i < 100; i++ {
+		transmission = append(transmission, STX)
+		transmission = append(transmission, []byte("1R|1|^^^SARSCOV2IGG|0,18|Ratio|||||F||||20200811095913")...)
+		transmission = append(transmission, ETX, '3', 'B', CR, LF)
+	}
+	return append(transmission, EOT)
+}
+
+func BenchmarkTableFSM(b *testing.B) {
+	transmission := benchmarkTransmission()
+	automate := CreateFSM(lis1A1LikeRules)
+	b.SetBytes(int64(len(transmission)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, token := range transmission {
+			if _, action, _ := automate.Push(token); action != Ok {
+				automate.ResetBuffer()
+			}
+		}
+	}
+}
+
+func BenchmarkLinearFSM(b *testing.B) {
+	transmission := benchmarkTransmission()
+	automate := &linearFSM{rules: lis1A1LikeRules}
+	b.SetBytes(int64(len(transmission)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, token := range transmission {
+			if action := automate.Push(token); action != Ok {
+				automate.buffer = automate.buffer[:0]
+			}
+		}
+	}
+}
+
+func TestTransitionObserver(t *testing.T) {
+	events := make([]TransitionEvent, 0)
+	automate := CreateFSM([]Rule{
+		{FromState: Init, Symbols: []byte{STX}, ToState: 1},
+		{FromState: 1, Symbols: []byte("abc"), ToState: 1, Scan: true},
+		{FromState: 1, Symbols: []byte{ETX}, ToState: Init, ActionCode: Finished},
+	})
+	automate.SetTransitionObserver(TransitionObserverFunc(func(event TransitionEvent) {
+		events = append(events, event)
+	}))
+
+	for _, token := range []byte{STX, 'a', 'b', ETX} {
+		_, _, err := automate.Push(token)
+		assert.Nil(t, err)
+	}
+	_, _, err := automate.Push('x')
+	assert.ErrorIs(t, err, ErrInvalidCharacter)
+
+	assert.Equal(t, 5, len(events))
+	assert.Equal(t, State(1), events[0].ToState)
+	assert.Equal(t, byte('b'), events[2].Token)
+	assert.True(t, events[2].Scan)
+	assert.Equal(t, 2, events[2].BufferLength)
+	assert.Equal(t, State(1), events[3].FromState)
+	assert.Equal(t, Init, events[3].ToState)
+	assert.Equal(t, Finished, events[3].ActionCode)
+	assert.Equal(t, Error, events[4].ActionCode)
+	assert.Equal(t, Init, events[4].ToState)
+	assert.ErrorIs(t, events[4].Err, ErrInvalidCharacter)
+
+	automate.SetTransitionObserver(nil)
+	_, _, err = automate.Push(STX)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(events))
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestTimerRules(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)}
+	automate := CreateFSM([]Rule{
+		{FromState: Init, Symbols: []byte{STX}, ToState: 1},
+		{FromState: 1, Symbols: []byte("abc"), ToState: 1, Scan: true},
+		{FromState: 1, Symbols: []byte{ETX}, ToState: Init, ActionCode: Finished},
+		{FromState: 1, Timeout: 30 * time.Second, ToState: Init, ActionCode: Timeout},
+	})
+	automate.SetClock(clock)
+
+	_, ok := automate.Deadline()
+	assert.False(t, ok, "no timer rule in the initial state")
+	_, _, expired := automate.Expire()
+	assert.False(t, expired)
+
+	automate.Push(STX)
+	deadline, ok := automate.Deadline()
+	assert.True(t, ok)
+	assert.Equal(t, clock.now.Add(30*time.Second), deadline)
+
+	// every byte restarts the timer
+	clock.now = clock.now.Add(20 * time.Second)
+	automate.Push('a')
+	clock.now = clock.now.Add(20 * time.Second)
+	_, _, expired = automate.Expire()
+	assert.False(t, expired)
+
+	clock.now = clock.now.Add(10 * time.Second)
+	buffer, action, expired := automate.Expire()
+	assert.True(t, expired)
+	assert.Equal(t, Timeout, action)
+	assert.Equal(t, "a", string(buffer))
+
+	// back in the initial state
+	automate.ResetBuffer()
+	_, ok = automate.Deadline()
+	assert.False(t, ok)
+	_, _, err := automate.Push('a')
+	assert.ErrorIs(t, err, ErrInvalidCharacter)
+}
+
+func TestValidateTimerRules(t *testing.T) {
+	issues := ValidateRules([]Rule{
+		{FromState: Init, Symbols: []byte{STX}, ToState: 1},
+		{FromState: 1, Timeout: time.Second, ToState: Init, ActionCode: Timeout},
+		{FromState: 1, Timeout: time.Minute, ToState: Init},
+	})
+	assert.Equal(t, []RuleIssue{
+		{Kind: ShadowedRule, State: 1, Rule: 2, OtherRule: 1},
+	}, issues)
+}
@@ -1,14 +1,5 @@
 package utilities
 
-func (s *fsm) containsSymbol(symbols []byte, symbol byte) bool {
-	for _, x := range symbols {
-		if x == symbol {
-			return true
-		}
-	}
-	return false
-}
-
 func substr(input string, start int, length int) string {
 	asRunes := []rune(input)
 
@@ -35,6 +26,17 @@ func makeBytesReadable(in []byte) string {
 	return ret
 }
 
+// Exclude returns the symbols without the excluded ones
+func Exclude(symbols []byte, excluded []byte) []byte {
+	ret := make([]byte, 0, len(symbols))
+	for _, symbol := range symbols {
+		if !Contains(symbol, excluded) {
+			ret = append(ret, symbol)
+		}
+	}
+	return ret
+}
+
 func Contains[T comparable](item T, items []T) bool {
 	for i := range items {
 		if item == items[i] {
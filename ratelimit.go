@@ -0,0 +1,86 @@
+package bloodlabnet
+
+import (
+	"sync"
+	"time"
+)
+
+// connectionRateLimiter is a token bucket per remote address. Every connection takes a token, the
+// tokens are refilled with rate per second up to burst.
+type connectionRateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	// lastCleanup is the time the full buckets were removed
+	lastCleanup time.Time
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newConnectionRateLimiter(rate float64, burst int) *connectionRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &connectionRateLimiter{
+		rate:        rate,
+		burst:       float64(burst),
+		buckets:     make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+// allow takes a token of the remote address, false if there is none left. Without limit all
+// connections are allowed.
+func (limiter *connectionRateLimiter) allow(remoteIP string, now time.Time) bool {
+	if limiter == nil {
+		return true
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.cleanup(now)
+
+	bucket, ok := limiter.buckets[remoteIP]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, lastRefill: now}
+		limiter.buckets[remoteIP] = bucket
+	}
+	limiter.refill(bucket, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (limiter *connectionRateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(bucket.lastRefill); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * limiter.rate
+		if bucket.tokens > limiter.burst {
+			bucket.tokens = limiter.burst
+		}
+		bucket.lastRefill = now
+	}
+}
+
+// cleanup removes the buckets that are full again, they are the same as new ones
+func (limiter *connectionRateLimiter) cleanup(now time.Time) {
+	refillTime := time.Duration(limiter.burst / limiter.rate * float64(time.Second))
+	if now.Sub(limiter.lastCleanup) < refillTime {
+		return
+	}
+	for remoteIP, bucket := range limiter.buckets {
+		if now.Sub(bucket.lastRefill) >= refillTime {
+			delete(limiter.buckets, remoteIP)
+		}
+	}
+	limiter.lastCleanup = now
+}
@@ -0,0 +1,166 @@
+package bloodlabnet
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol"
+)
+
+const defaultSendQueueCapacity = 100
+
+// sendQueueBusyRetry is how often a queued message checks whether the protocol finished its transfer
+const sendQueueBusyRetry = 50 * time.Millisecond
+
+var (
+	// ErrSendQueueFull is the result of Enqueue with RejectWhenFull, or of the dropped message with DropOldestWhenFull
+	ErrSendQueueFull = errors.New("the send queue is full")
+	// ErrSessionClosed is the result of the messages that were still queued when the session ended
+	ErrSessionClosed = errors.New("the session is closed")
+)
+
+// SendResult is the outcome of a queued message, N and Err as returned by Session.Send
+type SendResult struct {
+	N   int
+	Err error
+}
+
+type queuedMessage struct {
+	data   [][]byte
+	result chan SendResult
+}
+
+func (m *queuedMessage) done(n int, err error) {
+	m.result <- SendResult{N: n, Err: err}
+	close(m.result)
+}
+
+// sendQueue sends the messages of a session in order from its own goroutine. A message waits while the
+// protocol is busy with a transfer (see protocol.BusyReporter), e.g. until the EOT of a LIS1A1 transfer.
+type sendQueue struct {
+	messages         chan *queuedMessage
+	policy           SendQueueFullPolicy
+	lowLevelProtocol protocol.Implementation
+	// enqueueMutex makes dropping the oldest message and enqueueing one step
+	enqueueMutex sync.Mutex
+	closed       chan struct{}
+	closeOnce    sync.Once
+	startOnce    sync.Once
+}
+
+func newSendQueue(capacity int, policy SendQueueFullPolicy, lowLevelProtocol protocol.Implementation) *sendQueue {
+	if capacity <= 0 {
+		capacity = defaultSendQueueCapacity
+	}
+	return &sendQueue{
+		messages:         make(chan *queuedMessage, capacity),
+		policy:           policy,
+		lowLevelProtocol: lowLevelProtocol,
+		closed:           make(chan struct{}),
+	}
+}
+
+func (q *sendQueue) enqueue(data [][]byte) (<-chan SendResult, error) {
+	message := &queuedMessage{data: data, result: make(chan SendResult, 1)}
+
+	select {
+	case <-q.closed:
+		return nil, ErrSessionClosed
+	default:
+	}
+
+	switch q.policy {
+	case RejectWhenFull:
+		select {
+		case q.messages <- message:
+		default:
+			return nil, ErrSendQueueFull
+		}
+	case DropOldestWhenFull:
+		q.enqueueMutex.Lock()
+		for queued := false; !queued; {
+			select {
+			case q.messages <- message:
+				queued = true
+			default:
+				select {
+				case oldest := <-q.messages:
+					oldest.done(0, ErrSendQueueFull)
+				default:
+					// the sender took one in the meantime
+				}
+			}
+		}
+		q.enqueueMutex.Unlock()
+	default:
+		select {
+		case q.messages <- message:
+		case <-q.closed:
+			return nil, ErrSessionClosed
+		}
+	}
+
+	// closed while enqueueing, nobody else takes the message
+	select {
+	case <-q.closed:
+		q.drain()
+	default:
+	}
+	return message.result, nil
+}
+
+// start runs the sender once, send is Session.Send
+func (q *sendQueue) start(send func(data [][]byte) (int, error)) {
+	q.startOnce.Do(func() { go q.run(send) })
+}
+
+func (q *sendQueue) run(send func(data [][]byte) (int, error)) {
+	for {
+		select {
+		case <-q.closed:
+			q.drain()
+			return
+		case message := <-q.messages:
+			if !q.waitUntilIdle() {
+				message.done(0, ErrSessionClosed)
+				q.drain()
+				return
+			}
+			message.done(send(message.data))
+		}
+	}
+}
+
+// waitUntilIdle is false if the queue was closed while the protocol was busy
+func (q *sendQueue) waitUntilIdle() bool {
+	busyReporter, ok := q.lowLevelProtocol.(protocol.BusyReporter)
+	if !ok {
+		return true
+	}
+	for busyReporter.Busy() {
+		select {
+		case <-q.closed:
+			return false
+		case <-time.After(sendQueueBusyRetry):
+		}
+	}
+	return true
+}
+
+func (q *sendQueue) drain() {
+	for {
+		select {
+		case message := <-q.messages:
+			message.done(0, ErrSessionClosed)
+		default:
+			return
+		}
+	}
+}
+
+// close may be called more than once, the queued messages get ErrSessionClosed
+func (q *sendQueue) close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+	q.drain()
+}
@@ -0,0 +1,82 @@
+package bloodlabnet
+
+import (
+	"sort"
+	"sync"
+)
+
+// sessionRegistry holds the active sessions of a server. It can be used from the accept loop,
+// the session goroutines and the administration at the same time.
+type sessionRegistry struct {
+	mutex    sync.RWMutex
+	lastID   uint64
+	sessions map[uint64]*tcpServerSession
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[uint64]*tcpServerSession)}
+}
+
+// add assigns the session a unique ID, IDs are never reused
+func (registry *sessionRegistry) add(session *tcpServerSession) uint64 {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.lastID++
+	session.id = registry.lastID
+	registry.sessions[session.id] = session
+	return session.id
+}
+
+// remove is false if the session was not registered, it may be called more than once for a session
+func (registry *sessionRegistry) remove(session *tcpServerSession) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registered, ok := registry.sessions[session.id]; !ok || registered != session {
+		return false
+	}
+	delete(registry.sessions, session.id)
+	return true
+}
+
+func (registry *sessionRegistry) get(id uint64) (*tcpServerSession, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	session, ok := registry.sessions[id]
+	return session, ok
+}
+
+func (registry *sessionRegistry) count() int {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return len(registry.sessions)
+}
+
+// all returns a copy of the sessions, the oldest first
+func (registry *sessionRegistry) all() []*tcpServerSession {
+	return registry.filter(func(*tcpServerSession) bool { return true })
+}
+
+// byIP returns the sessions of the remote address, the oldest first
+func (registry *sessionRegistry) byIP(remoteIP string) []*tcpServerSession {
+	return registry.filter(func(session *tcpServerSession) bool { return session.remoteAddr == remoteIP })
+}
+
+// byPeer returns the sessions with the identity of the peer, the oldest first
+func (registry *sessionRegistry) byPeer(peerID string) []*tcpServerSession {
+	return registry.filter(func(session *tcpServerSession) bool { return session.peerID == peerID })
+}
+
+func (registry *sessionRegistry) filter(accept func(session *tcpServerSession) bool) []*tcpServerSession {
+	registry.mutex.RLock()
+	sessions := make([]*tcpServerSession, 0, len(registry.sessions))
+	for _, session := range registry.sessions {
+		if accept(session) {
+			sessions = append(sessions, session)
+		}
+	}
+	registry.mutex.RUnlock()
+
+	// the IDs are assigned in the order the sessions started
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	return sessions
+}
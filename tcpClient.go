@@ -1,13 +1,17 @@
 package bloodlabnet
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blutspende/go-bloodlab-net/protocol"
+	"github.com/rs/zerolog/log"
 )
 
 /*
@@ -22,10 +26,41 @@ type tcpClientConnectionAndSession struct {
 	lowLevelProtocol protocol.Implementation
 	proxy            ConnectionType
 	timingConfig     TCPClientConfiguration
-	conn             net.Conn
-	connected        bool
-	isStopped        bool
-	handler          Handler
+	isStopped        int32
+	sendMutex        sync.Mutex
+	// connectMutex serializes the connects of Run, Send and Receive
+	connectMutex sync.Mutex
+	// reconnect is 1 if the connection was closed by IdleTimeout or MaxSessionLifetime, reconnectMutex
+	// is held while it is closed
+	reconnect      int32
+	reconnectMutex sync.Mutex
+	attributes     Attributes
+
+	// stateMutex guards the fields below, they are changed by Run, Stop and the timers of the connection
+	stateMutex sync.Mutex
+	conn       net.Conn
+	connected  bool
+	handler    Handler
+	remoteIP   string
+	tracer     *sessionTracer
+	stats      *sessionStats
+	heartbeat  *heartbeat
+	limits     *sessionLimits
+	// sessionID counts the connections
+	sessionID   uint64
+	connectTime time.Time
+	// sendQueue is created by Enqueue and closed by Stop, the messages stay queued while reconnecting
+	sendQueue *sendQueue
+}
+
+// clientState is a copy of the guarded fields
+type clientState struct {
+	conn     net.Conn
+	handler  Handler
+	remoteIP string
+	tracer   *sessionTracer
+	stats    *sessionStats
+	limits   *sessionLimits
 }
 
 func CreateNewTCPClient(hostname string, port int,
@@ -46,7 +81,7 @@ func CreateNewTCPClient(hostname string, port int,
 		proxy:            proxy,
 		timingConfig:     clientConfiguration,
 		connected:        false,
-		isStopped:        false,
+		isStopped:        0,
 		handler:          nil, // is set by run
 	}
 }
@@ -60,35 +95,76 @@ func (s *tcpClientConnectionAndSession) WaitReady() bool {
 // On disconnect from server the client will forever retry to connect.
 // Call Stop() will exit the loop
 func (s *tcpClientConnectionAndSession) Run(handler Handler) {
-	s.handler = handler
-	s.isStopped = false
+	handler = withMetrics(handler, s.timingConfig.Metrics)
+	s.setHandler(handler)
+	atomic.StoreInt32(&s.isStopped, 0)
+	acknowledgementDeferred := deferAcknowledgement(s.lowLevelProtocol)
 
 	s.Connect()
-	for !s.isStopped && s.IsAlive() {
+	for !s.stopped() && s.IsAlive() {
 		s.ensureConnected()
 		data, err := s.Receive()
 		if err != nil {
+			if atomic.LoadInt32(&s.reconnect) == 1 {
+				s.reconnectMutex.Lock()
+				atomic.StoreInt32(&s.reconnect, 0)
+				s.ensureConnected()
+				s.reconnectMutex.Unlock()
+				continue
+			}
 			if err == io.EOF {
 				s.Close()
 				break
 			} else {
-				if s.handler != nil {
-					s.handler.Error(s, ErrorReceive, err)
-				}
+				handler.Error(s, ErrorReceive, err)
 			}
 		} else {
-			handler.DataReceived(s, data, time.Now())
+			tracer := s.state().tracer
+			tracer.startHandling(len(data))
+			err = handler.DataReceived(s, data, time.Now())
+			tracer.endHandling(err)
+			acknowledge(s.lowLevelProtocol, acknowledgementDeferred, s.state().conn, &s.sendMutex, handler, s, err)
 		}
 	}
 
-	s.handler = nil
+	s.setHandler(nil)
 }
 
 func (s *tcpClientConnectionAndSession) Stop() {
-	s.isStopped = true
+	atomic.StoreInt32(&s.isStopped, 1)
+	s.stateMutex.Lock()
+	queue := s.sendQueue
+	s.sendQueue = nil
+	s.stateMutex.Unlock()
+	if queue != nil {
+		queue.close()
+	}
 	s.Close()
 }
 
+func (s *tcpClientConnectionAndSession) stopped() bool {
+	return atomic.LoadInt32(&s.isStopped) == 1
+}
+
+func (s *tcpClientConnectionAndSession) state() clientState {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return clientState{
+		conn:     s.conn,
+		handler:  s.handler,
+		remoteIP: s.remoteIP,
+		tracer:   s.tracer,
+		stats:    s.stats,
+		limits:   s.limits,
+	}
+}
+
+func (s *tcpClientConnectionAndSession) setHandler(handler Handler) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.handler = handler
+}
+
 func (instance *tcpClientConnectionAndSession) FindSessionsByIp(ip string) []Session {
 	sessions := make([]Session, 0)
 
@@ -99,14 +175,14 @@ func (instance *tcpClientConnectionAndSession) FindSessionsByIp(ip string) []Ses
 }
 
 func (s *tcpClientConnectionAndSession) RemoteAddress() (string, error) {
-	if s.conn != nil {
+	if s.state().conn != nil {
 		if err := s.ensureConnected(); err != nil {
 			return "", err
 		}
 	}
 
-	if s.conn != nil {
-		host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if conn := s.state().conn; conn != nil {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 		return host, err
 	} else {
 		return "", nil
@@ -114,15 +190,31 @@ func (s *tcpClientConnectionAndSession) RemoteAddress() (string, error) {
 }
 
 func (s *tcpClientConnectionAndSession) Close() error {
-	if s.conn != nil {
-		if s.handler != nil {
-			s.handler.Disconnected(s)
+	return s.closeWithReason(DisconnectClosed)
+}
+
+// closeWithReason notifies the handler only once, no matter how many goroutines close the connection
+func (s *tcpClientConnectionAndSession) closeWithReason(reason DisconnectReason) error {
+	s.stateMutex.Lock()
+	conn, handler, remoteIP := s.conn, s.handler, s.remoteIP
+	heartbeat, limits := s.heartbeat, s.limits
+	s.conn = nil
+	s.stateMutex.Unlock()
+
+	heartbeat.Stop()
+	limits.Stop()
+	if conn != nil {
+		if handler != nil {
+			notifyDisconnected(handler, s, reason)
+		}
+		s.attributes.clear()
+		err := conn.Close()
+		if s.timingConfig.Metrics != nil {
+			s.timingConfig.Metrics.SessionClosed(remoteIP)
 		}
-		err := s.conn.Close()
-		s.conn = nil
 		if err != nil {
-			if s.handler != nil {
-				s.handler.Error(s, ErrorDisconnect, err)
+			if handler != nil {
+				handler.Error(s, ErrorDisconnect, err)
 			}
 			return err
 		}
@@ -130,21 +222,65 @@ func (s *tcpClientConnectionAndSession) Close() error {
 	return nil
 }
 
+func (s *tcpClientConnectionAndSession) Context() context.Context {
+	return s.state().tracer.context()
+}
+
 func (s *tcpClientConnectionAndSession) IsAlive() bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
 	if s.conn != nil && s.connected {
 		return true
 	}
 	return false
 }
 
+func (s *tcpClientConnectionAndSession) ID() uint64 {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.sessionID
+}
+
+func (s *tcpClientConnectionAndSession) ConnectTime() time.Time {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.connectTime
+}
+
+// LocalAddr is nil while the client is not connected
+func (s *tcpClientConnectionAndSession) LocalAddr() net.Addr {
+	if conn := s.state().conn; conn != nil {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr is nil while the client is not connected
+func (s *tcpClientConnectionAndSession) RemoteAddr() net.Addr {
+	if conn := s.state().conn; conn != nil {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// ProxySource is always nil, the PROXY protocol is only read by servers
+func (s *tcpClientConnectionAndSession) ProxySource() net.Addr {
+	return nil
+}
+
+// Attributes are cleared when a connection is closed
+func (s *tcpClientConnectionAndSession) Attributes() *Attributes {
+	return &s.attributes
+}
+
 func (s *tcpClientConnectionAndSession) WaitTermination() error {
 	return errors.New("client connections can not be passively observed for disconnect")
 }
 
 func (s *tcpClientConnectionAndSession) Connect() error {
 	if err := s.ensureConnected(); err != nil {
-		if s.handler != nil {
-			go s.handler.Error(s, ErrorConnect, fmt.Errorf("failed to connect - %w", err))
+		if handler := s.state().handler; handler != nil {
+			go handler.Error(s, ErrorConnect, fmt.Errorf("failed to connect - %w", err))
 		}
 		return err
 	}
@@ -154,13 +290,24 @@ func (s *tcpClientConnectionAndSession) Connect() error {
 func (s *tcpClientConnectionAndSession) Receive() ([]byte, error) {
 
 	if err := s.ensureConnected(); err != nil {
-		if s.handler != nil {
-			s.handler.Error(s, ErrorReceive, fmt.Errorf("failed to reconnect %w", err))
+		if handler := s.state().handler; handler != nil {
+			handler.Error(s, ErrorReceive, fmt.Errorf("failed to reconnect %w", err))
 		}
 		return nil, err
 	}
 
-	return s.lowLevelProtocol.Receive(s.conn)
+	state := s.state()
+	if state.conn == nil {
+		return nil, net.ErrClosed
+	}
+	data, err := s.lowLevelProtocol.Receive(state.conn)
+	if err == nil {
+		state.stats.messageReceived()
+	}
+	if err == nil && s.timingConfig.Metrics != nil {
+		s.timingConfig.Metrics.MessageReceived(state.remoteIP, len(data))
+	}
+	return data, err
 }
 
 func (s *tcpClientConnectionAndSession) Send(data [][]byte) (int, error) {
@@ -169,23 +316,71 @@ func (s *tcpClientConnectionAndSession) Send(data [][]byte) (int, error) {
 		return 0, err
 	}
 
-	return s.lowLevelProtocol.Send(s.conn, data)
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	state := s.state()
+	if state.limits.isClosing() {
+		return 0, errSessionClosing
+	}
+	if state.conn == nil {
+		return 0, net.ErrClosed
+	}
+
+	state.tracer.startSend(messageSize(data))
+	n, err := s.lowLevelProtocol.Send(state.conn, data)
+	state.tracer.endSend(err)
+	if err == nil {
+		state.stats.messageSent()
+	}
+	if err == nil && s.timingConfig.Metrics != nil {
+		s.timingConfig.Metrics.MessageSent(state.remoteIP, messageSize(data))
+	}
+	return n, err
+}
+
+func (s *tcpClientConnectionAndSession) Enqueue(data [][]byte) (<-chan SendResult, error) {
+	s.stateMutex.Lock()
+	if s.sendQueue == nil {
+		s.sendQueue = newSendQueue(s.timingConfig.SendQueueCapacity, s.timingConfig.SendQueueFullPolicy, s.lowLevelProtocol)
+		s.sendQueue.start(s.Send)
+	}
+	queue := s.sendQueue
+	s.stateMutex.Unlock()
+	return queue.enqueue(data)
 }
 
+// ensureConnected calls the Connected event of the handler after a new connection was made
 func (s *tcpClientConnectionAndSession) ensureConnected() error {
-	if s.connected || s.isStopped {
-		// fmt.Printf("Return due to connected:%t and stopped:%t conn is nil?:%t\n", s.connected, s.isStopped, s.conn == nil)
-		return nil
+	connected, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if handler := s.state().handler; connected && handler != nil {
+		handler.Connected(s)
+	}
+	return nil
+}
+
+// connect is true if it made a new connection
+func (s *tcpClientConnectionAndSession) connect() (bool, error) {
+	s.connectMutex.Lock()
+	defer s.connectMutex.Unlock()
+
+	s.stateMutex.Lock()
+	connected, handler := s.connected, s.handler
+	s.stateMutex.Unlock()
+	if connected || s.stopped() {
+		return false, nil
 	}
 
 	dialer := &net.Dialer{}
 	if s.timingConfig.SourceIP != "" {
 		sourceIP, err := net.ResolveTCPAddr("tcp", s.timingConfig.SourceIP+":0")
 		if err != nil {
-			if s.handler != nil {
-				s.handler.Error(s, ErrorConnect, err)
+			if handler != nil {
+				handler.Error(s, ErrorConnect, err)
 			}
-			return err
+			return false, err
 		} else {
 			dialer.LocalAddr = sourceIP
 		}
@@ -193,17 +388,55 @@ func (s *tcpClientConnectionAndSession) ensureConnected() error {
 
 	conn, err := dialer.Dial("tcp", s.hostname+fmt.Sprintf(":%d", s.port))
 	if err != nil {
-		if s.handler != nil {
-			s.handler.Error(s, ErrorConnect, err)
+		if handler != nil {
+			handler.Error(s, ErrorConnect, err)
 		}
-		return err
+		return false, err
+	}
+	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if err := applyKeepAlive(conn, s.timingConfig.KeepAlive); err != nil {
+		log.Warn().Err(err).Str("ip", remoteIP).Msg("failed to enable tcp keepalive")
+	}
+	if s.timingConfig.Metrics != nil {
+		s.timingConfig.Metrics.SessionOpened(remoteIP)
+	}
+	stats := &sessionStats{}
+	conn = &meteredConn{Conn: conn, metrics: s.timingConfig.Metrics, stats: stats, remoteIP: remoteIP}
+
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if s.tracer == nil {
+		// the protocol instance stays the same for all connections
+		s.tracer = newSessionTracer(s.timingConfig.TracerProvider, remoteIP)
+		s.tracer.observe(s.lowLevelProtocol)
 	}
+	conn = s.tracer.wrapConn(conn)
 	s.conn = conn
 	s.connected = true
-
-	if s.handler != nil {
-		s.handler.Connected(s)
+	s.remoteIP = remoteIP
+	s.stats = stats
+	s.sessionID++
+	s.connectTime = time.Now()
+
+	if s.timingConfig.EnableHeartbeat {
+		s.heartbeat = startHeartbeat(s.lowLevelProtocol, conn, s.timingConfig.PollInterval, s.timingConfig.HeartbeatTimeout,
+			stats, s.connectTime, &s.sendMutex, func(err error) {
+				log.Warn().Err(err).Str("ip", remoteIP).Msg("tcp client server does not respond, closing")
+				s.closeWithReason(DisconnectNotResponding)
+			})
 	}
-
-	return nil
+	s.limits = startSessionLimits(s.timingConfig.IdleTimeout, s.timingConfig.MaxSessionLifetime, s.lowLevelProtocol,
+		stats, s.connectTime, &s.sendMutex, func(reason DisconnectReason) {
+			log.Info().Str("ip", remoteIP).Str("reason", string(reason)).Msg("tcp client connection expired, reconnecting")
+			s.reconnectMutex.Lock()
+			defer s.reconnectMutex.Unlock()
+			atomic.StoreInt32(&s.reconnect, 1)
+			s.closeWithReason(reason)
+			// the next Receive or Send connects again
+			s.stateMutex.Lock()
+			s.connected = false
+			s.stateMutex.Unlock()
+		})
+
+	return true, nil
 }
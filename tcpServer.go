@@ -2,13 +2,15 @@ package bloodlabnet
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/blutspende/go-bloodlab-net/protocol/utilities"
 	"io"
 	"math/rand"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blutspende/go-bloodlab-net/protocol"
@@ -22,13 +24,16 @@ type tcpServerInstance struct {
 	connectionType     ConnectionType
 	maxConnections     int
 	config             TCPServerConfiguration
-	isRunning          bool
-	sessionCount       int
+	isRunning          int32
+	listenerMutex      sync.Mutex
 	listener           net.Listener
 	handler            Handler
 	mainLoopActive     *sync.WaitGroup
-	sessions           []*tcpServerSession
+	sessions           *sessionRegistry
 	waitRunningChannel chan bool
+	ipFilter           *IPFilter
+	rateLimiter        *connectionRateLimiter
+	accepting          int32
 }
 
 // --------------------------------------------------------------------------------------------
@@ -86,17 +91,31 @@ func CreateNewTCPServerInstance(listeningPort int, protocolReceiveve protocol.Im
 		timingConfig = DefaultTCPServerSettings
 	}
 
+	ipFilter := timingConfig.IPFilter
+	if ipFilter == nil {
+		ipFilter = NewIPFilter(DenyWins)
+	}
+	for _, blacklisted := range timingConfig.BlackListedIPAddresses {
+		if strings.TrimSpace(blacklisted) == "" {
+			continue
+		}
+		if err := ipFilter.Deny(blacklisted); err != nil {
+			log.Warn().Err(err).Msg("ignoring invalid entry of the blacklist")
+		}
+	}
+
 	return &tcpServerInstance{
 		listeningPort:      listeningPort,
 		LowLevelProtocol:   protocolReceiveve,
 		maxConnections:     maxConnections,
 		connectionType:     connectionType,
 		config:             timingConfig,
-		sessionCount:       0,
 		handler:            nil,
 		mainLoopActive:     &sync.WaitGroup{},
-		sessions:           make([]*tcpServerSession, 0),
+		sessions:           newSessionRegistry(),
 		waitRunningChannel: make(chan bool),
+		ipFilter:           ipFilter,
+		rateLimiter:        newConnectionRateLimiter(timingConfig.ConnectionRatePerIP, timingConfig.ConnectionBurstPerIP),
 	}
 
 }
@@ -107,13 +126,17 @@ func (instance *tcpServerInstance) WaitReady() bool {
 }
 
 func (instance *tcpServerInstance) Stop() {
-	instance.isRunning = false
-	instance.listener.Close()
+	atomic.StoreInt32(&instance.isRunning, 0)
+	instance.listenerMutex.Lock()
+	if instance.listener != nil {
+		instance.listener.Close()
+	}
+	instance.listenerMutex.Unlock()
 	instance.mainLoopActive.Wait()
 }
 
 func (instance *tcpServerInstance) Send(data [][]byte) (int, error) {
-	return 0, errors.New("server instance can not send data. What are you looking for, a broadcast to all clients that are connected ? ")
+	return 0, errors.New("server instance can not send data, use Broadcast to send to the connected clients")
 }
 
 func (instance *tcpServerInstance) Receive() ([]byte, error) {
@@ -121,22 +144,30 @@ func (instance *tcpServerInstance) Receive() ([]byte, error) {
 }
 
 func (instance *tcpServerInstance) Run(handler Handler) {
-	var err error
-	instance.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", instance.listeningPort))
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", instance.listeningPort))
 	if err != nil {
 		panic(fmt.Errorf("can not start TCP-Server: %w", err))
 	}
+	instance.listenerMutex.Lock()
+	instance.listener = listener
+	instance.listenerMutex.Unlock()
+	handler = withMetrics(handler, instance.config.Metrics)
 	instance.handler = handler
+	if instance.config.InboundJournal != nil {
+		// before new messages of the instruments
+		instance.config.InboundJournal.replay(handler)
+	}
 
 	rand.Seed(time.Now().Unix())
 
-	proxyListener := &proxyproto.Listener{Listener: instance.listener}
+	proxyListener := &proxyproto.Listener{Listener: listener}
 	defer proxyListener.Close()
 
-	instance.isRunning = true
+	atomic.StoreInt32(&instance.isRunning, 1)
+	instance.setAccepting(true)
 	instance.mainLoopActive.Add(1)
 
-	for instance.isRunning {
+	for instance.running() {
 
 		// if any thread waits for notification that the loop is running, this is it
 		select {
@@ -147,19 +178,49 @@ func (instance *tcpServerInstance) Run(handler Handler) {
 
 		connection, err := proxyListener.Accept()
 		if err != nil {
-			if instance.handler != nil && instance.isRunning {
+			if instance.handler != nil && instance.running() {
 				go instance.handler.Error(nil, ErrorAccept, err)
 			}
 			continue
 		}
 
 		remoteIPAddress, _, _ := net.SplitHostPort(connection.RemoteAddr().String())
+		localAddr, remoteAddr, proxySource := connectionAddresses(connection)
 
-		if utilities.Contains(remoteIPAddress, instance.config.BlackListedIPAddresses) {
+		if err := applyKeepAlive(connection, instance.config.KeepAlive); err != nil {
+			log.Warn().Err(err).Str("ip", remoteIPAddress).Msg("failed to enable tcp keepalive")
+		}
+
+		if permitted, reason := instance.ipFilter.check(remoteIPAddress); !permitted {
 			connection.Close()
-			log.Trace().Str("ip", remoteIPAddress).Msg("incoming connection from blacklisted ip address closed")
+			if instance.config.Metrics != nil {
+				instance.config.Metrics.ConnectionRejected(remoteIPAddress, reason)
+			}
+			if instance.handler != nil {
+				go instance.handler.Error(nil, ErrorIPFiltered, fmt.Errorf("connection from %s rejected by the ip filter (%s)", remoteIPAddress, reason))
+			}
+			log.Debug().Str("ip", remoteIPAddress).Str("reason", string(reason)).Msg("incoming connection rejected by the ip filter")
 			continue
 		}
+		if !instance.rateLimiter.allow(remoteIPAddress, time.Now()) {
+			connection.Close()
+			if instance.config.Metrics != nil {
+				instance.config.Metrics.ConnectionRejected(remoteIPAddress, RejectRateLimited)
+			}
+			if instance.handler != nil {
+				go instance.handler.Error(nil, ErrorConnectionRate, fmt.Errorf("connection rate of %s exceeded", remoteIPAddress))
+			}
+			log.Warn().Str("remoteIP", remoteIPAddress).Msg("connection rate exceeded, forcing disconnect")
+			continue
+		}
+		if instance.config.CaptureSink != nil {
+			// proxyproto provides the source and destination of the proxy header as addresses
+			connection = protocol.WrapConnWithCaptureSink(connection, instance.config.CaptureSink)
+		}
+		stats := &sessionStats{}
+		connection = &meteredConn{Conn: connection, metrics: instance.config.Metrics, stats: stats, remoteIP: remoteIPAddress}
+		tracer := newSessionTracer(instance.config.TracerProvider, remoteIPAddress)
+		connection = tracer.wrapConn(connection)
 		bufferedConn := newBufferedConn(connection)
 
 		// Portscanners and other players disconnect rather quickly; The first Byte sent breaks this delay
@@ -171,8 +232,42 @@ func (instance *tcpServerInstance) Run(handler Handler) {
 			}
 		}
 
-		if instance.sessionCount >= instance.maxConnections {
+		replacesSession := false
+		peerID := instance.peerIdentity(remoteIPAddress, connection)
+		if instance.config.SingleSessionPerPeer {
+			for _, previous := range instance.sessions.byPeer(peerID) {
+				log.Info().Str("remoteIP", remoteIPAddress).Str("peer", peerID).Uint64("session", previous.id).
+					Msg("peer reconnected, closing its previous session")
+				instance.replaceSession(previous)
+				replacesSession = true
+			}
+		}
+		if sessionsOfIP := instance.sessions.byIP(remoteIPAddress); instance.config.MaxConnectionsPerIP > 0 &&
+			len(sessionsOfIP) >= instance.config.MaxConnectionsPerIP {
+
+			if instance.config.PerIPLimitPolicy != CloseOldestSession {
+				connection.Close()
+				if instance.config.Metrics != nil {
+					instance.config.Metrics.ConnectionRejected(remoteIPAddress, RejectMaxConnectionsPerIP)
+				}
+				if instance.handler != nil {
+					go instance.handler.Error(nil, ErrorConnectionLimit, fmt.Errorf("max connections of %s reached", remoteIPAddress))
+				}
+				log.Warn().Str("remoteIP", remoteIPAddress).Msg("max connections per ip reached, forcing disconnect")
+				continue
+			}
+			// the sessions are ordered by their start
+			log.Info().Str("remoteIP", remoteIPAddress).Uint64("session", sessionsOfIP[0].id).
+				Msg("max connections per ip reached, closing the oldest session")
+			instance.replaceSession(sessionsOfIP[0])
+			replacesSession = true
+		}
+
+		if !replacesSession && instance.sessions.count() >= instance.maxConnections {
 			connection.Close()
+			if instance.config.Metrics != nil {
+				instance.config.Metrics.ConnectionRejected(remoteIPAddress, RejectMaxConnections)
+			}
 			if instance.handler != nil {
 				go instance.handler.Error(nil, ErrorMaxConnections, nil)
 			}
@@ -184,49 +279,77 @@ func (instance *tcpServerInstance) Run(handler Handler) {
 		if err != nil {
 			instance.handler.Error(session, ErrorCreateSession, fmt.Errorf("error creating a new TCP session - %w", err))
 		} else {
-			waitStartup := &sync.Mutex{}
-			waitStartup.Lock()
+			session.tracer = tracer
+			session.stats = stats
+			session.peerID = peerID
+			session.localAddr = localAddr
+			session.remoteSocketAddr = remoteAddr
+			session.proxySource = proxySource
+			session.limits = startSessionLimits(instance.config.IdleTimeout, instance.config.MaxSessionLifetime,
+				session.lowLevelProtocol, session.stats, session.connectTime, session.blockedForSending,
+				func(reason DisconnectReason) {
+					log.Info().Str("ip", session.remoteAddr).Str("reason", string(reason)).Msg("tcp server session expired, closing")
+					session.closeWithReason(reason)
+				})
+			tracer.observe(session.lowLevelProtocol)
+			// registered before the next connection is accepted, so that it counts for the limits
+			instance.sessions.add(session)
 			go func() {
-				instance.sessions = append(instance.sessions, session)
-				instance.sessionCount++
-				waitStartup.Unlock()
+				if instance.config.Metrics != nil {
+					instance.config.Metrics.SessionOpened(session.remoteAddr)
+					defer instance.config.Metrics.SessionClosed(session.remoteAddr)
+				}
 				instance.tcpSession(session)
-				instance.sessionCount--
-				instance.sessions = removeSessionFromList(instance.sessions, session)
+				instance.sessions.remove(session)
 			}()
-			waitStartup.Lock() // wait for the startup to update the sessioncounter
 		}
 	}
 
-	for _, x := range instance.sessions {
-		x.Close()
+	instance.setAccepting(false)
+	for _, x := range instance.sessions.all() {
+		x.closeWithReason(DisconnectServerStopped)
 	}
-	instance.listener.Close()
+	listener.Close()
 
 	instance.handler = nil
 	instance.mainLoopActive.Done()
 }
 
-func removeSessionFromList(connections []*tcpServerSession, which *tcpServerSession) []*tcpServerSession {
+// replaceSession closes a session for a new connection. It is removed from the sessions at once, its
+// receive loop may take a while to end.
+func (instance *tcpServerInstance) replaceSession(session *tcpServerSession) {
+	instance.sessions.remove(session)
+	session.closeWithReason(DisconnectReplaced)
+}
 
-	ret := make([]*tcpServerSession, 0)
+func (instance *tcpServerInstance) peerIdentity(remoteIP string, conn net.Conn) string {
+	if instance.config.PeerIdentity != nil {
+		return instance.config.PeerIdentity(remoteIP, conn)
+	}
+	return remoteIP
+}
 
-	for _, x := range connections {
-		if x != which {
-			ret = append(ret, x)
-		}
+func (instance *tcpServerInstance) running() bool {
+	return atomic.LoadInt32(&instance.isRunning) == 1
+}
+
+func (instance *tcpServerInstance) setAccepting(accepting bool) {
+	var value int32
+	if accepting {
+		value = 1
 	}
+	atomic.StoreInt32(&instance.accepting, value)
+}
 
-	return ret
+func (instance *tcpServerInstance) isAccepting() bool {
+	return atomic.LoadInt32(&instance.accepting) == 1
 }
 
 func (instance *tcpServerInstance) FindSessionsByIp(ip string) []Session {
 	sessions := make([]Session, 0)
 
-	for _, x := range instance.sessions {
-		if x.remoteAddr == ip {
-			sessions = append(sessions, x)
-		}
+	for _, x := range instance.sessions.byIP(ip) {
+		sessions = append(sessions, x)
 	}
 
 	return sessions
@@ -234,7 +357,7 @@ func (instance *tcpServerInstance) FindSessionsByIp(ip string) []Session {
 
 type tcpServerSession struct {
 	conn                BufferedConn
-	isRunning           bool
+	isRunning           int32
 	sessionActive       *sync.WaitGroup
 	config              TCPServerConfiguration
 	remoteAddr          string
@@ -242,8 +365,20 @@ type tcpServerSession struct {
 	handler             Handler
 	blockedForSending   *sync.Mutex
 	blockedForReceiving *sync.Mutex
-	hasDataToSend       bool
-	dataToSend          *[]byte
+	sendQueue           *sendQueue
+	tracer              *sessionTracer
+	id                  uint64
+	connectTime         time.Time
+	stats               *sessionStats
+	peerID              string
+	limits              *sessionLimits
+	localAddr           net.Addr
+	remoteSocketAddr    net.Addr
+	proxySource         net.Addr
+	attributes          *Attributes
+	journal             *sessionJournal
+	// acknowledgementDeferred is true if the result of DataReceived is passed to the peer
+	acknowledgementDeferred bool
 }
 
 func createTcpServerSession(conn BufferedConn, handler Handler,
@@ -252,7 +387,7 @@ func createTcpServerSession(conn BufferedConn, handler Handler,
 
 	session := &tcpServerSession{
 		conn:                conn,
-		isRunning:           true,
+		isRunning:           1,
 		sessionActive:       &sync.WaitGroup{},
 		lowLevelProtocol:    protocolReceive,
 		config:              timingConfiguration,
@@ -260,28 +395,53 @@ func createTcpServerSession(conn BufferedConn, handler Handler,
 		remoteAddr:          remoteAddress,
 		blockedForSending:   &sync.Mutex{},
 		blockedForReceiving: &sync.Mutex{},
-		hasDataToSend:       false,
-		dataToSend:          nil,
+		sendQueue:           newSendQueue(timingConfiguration.SendQueueCapacity, timingConfiguration.SendQueueFullPolicy, protocolReceive),
+		connectTime:         time.Now(),
+		stats:               &sessionStats{},
+		attributes:          &Attributes{},
+		journal:             newSessionJournal(timingConfiguration.InboundJournal, remoteAddress),
+	}
+	if journaled, ok := protocolReceive.(protocol.Journaled); ok && session.journal != nil {
+		journaled.SetJournal(session.journal)
 	}
+	session.acknowledgementDeferred = deferAcknowledgement(protocolReceive)
 	return session, nil
 }
 
 func (instance *tcpServerInstance) tcpSession(session *tcpServerSession) error {
-	log.Debug().Str("ip", session.remoteAddr).Msg("tcp server session started")
+	log.Debug().Str("ip", session.remoteAddr).Uint64("session", session.id).Msg("tcp server session started")
 
 	session.sessionActive.Add(1)
 	defer session.sessionActive.Done()
 
+	// after the Disconnected event
+	defer session.attributes.clear()
+	defer session.sendQueue.close()
 	defer session.Close()
+	defer session.limits.Stop()
 
 	if err := session.handler.Connected(session); err != nil {
 		// connection handler declined this session
 		return err
 	}
+	session.sendQueue.start(session.Send)
+	if session.config.Outbox != nil {
+		go session.config.Outbox.deliver(session.peerID, session.Enqueue, session.sendQueue.closed)
+	}
+
+	if session.config.EnableHeartbeat {
+		heartbeat := startHeartbeat(session.lowLevelProtocol, session.conn, session.config.PollInterval,
+			session.config.HeartbeatTimeout, session.stats, session.connectTime, session.blockedForSending,
+			func(err error) {
+				log.Warn().Err(err).Str("ip", session.remoteAddr).Msg("tcp server session peer does not respond, closing")
+				session.closeWithReason(DisconnectNotResponding)
+			})
+		defer heartbeat.Stop()
+	}
 
 	for {
 
-		if !session.isRunning || !instance.isRunning {
+		if !session.IsAlive() || !instance.running() {
 			log.Warn().Msg("Exit tcp server in general (bad idea) !!!! ++++ ----")
 			break
 		}
@@ -297,8 +457,7 @@ func (instance *tcpServerInstance) tcpSession(session *tcpServerSession) error {
 			if err == io.EOF {
 				// EOF is not an error, its a disconnect in TCP-terms: clean exit
 				log.Debug().Str("ip", session.remoteAddr).Msg("tcp server session disconnect")
-				session.handler.Disconnected(session)
-				session.isRunning = false
+				session.closeWithReason(DisconnectRemote)
 				break
 			}
 			log.Error().Err(err).Str("ip", session.remoteAddr).Msg("tcp server session error")
@@ -308,20 +467,48 @@ func (instance *tcpServerInstance) tcpSession(session *tcpServerSession) error {
 			// Important detail : the read loop is over when DataReceived event occurs. This means
 			// that at this point we can also send data
 			log.Debug().Str("ip", session.remoteAddr).Int("length (bytes)", len(data)).Msg("tcp server session data received")
-			session.handler.DataReceived(session, data, time.Now())
+			if session.config.Metrics != nil {
+				session.config.Metrics.MessageReceived(session.remoteAddr, len(data))
+			}
+			session.stats.messageReceived()
+			session.tracer.startHandling(len(data))
+			err := session.handler.DataReceived(session, data, time.Now())
+			session.tracer.endHandling(err)
+			refused := acknowledge(session.lowLevelProtocol, session.acknowledgementDeferred, session.conn,
+				session.blockedForSending, session.handler, session, err)
+			session.journal.received(data, err, refused)
 		}
 
 	}
-	log.Debug().Str("ip", session.remoteAddr).Msg("tcp server session ended")
+	log.Debug().Str("ip", session.remoteAddr).Uint64("session", session.id).Msg("tcp server session ended")
 	return nil
 }
 
 func (session *tcpServerSession) IsAlive() bool {
-	return session.isRunning
+	return atomic.LoadInt32(&session.isRunning) == 1
 }
 
 func (session *tcpServerSession) Send(data [][]byte) (int, error) {
-	return session.lowLevelProtocol.Send(session.conn, data)
+	session.blockedForSending.Lock()
+	defer session.blockedForSending.Unlock()
+	if session.limits.isClosing() {
+		return 0, errSessionClosing
+	}
+
+	session.tracer.startSend(messageSize(data))
+	n, err := session.lowLevelProtocol.Send(session.conn, data)
+	session.tracer.endSend(err)
+	if err == nil {
+		session.stats.messageSent()
+	}
+	if err == nil && session.config.Metrics != nil {
+		session.config.Metrics.MessageSent(session.remoteAddr, messageSize(data))
+	}
+	return n, err
+}
+
+func (session *tcpServerSession) Enqueue(data [][]byte) (<-chan SendResult, error) {
+	return session.sendQueue.enqueue(data)
 }
 
 func (session *tcpServerSession) Receive() ([]byte, error) {
@@ -329,14 +516,18 @@ func (session *tcpServerSession) Receive() ([]byte, error) {
 }
 
 func (session *tcpServerSession) Close() error {
-	if session.IsAlive() {
-		if session.handler != nil {
-			session.handler.Disconnected(session)
-		}
-		session.conn.Close()
-		session.isRunning = false
+	return session.closeWithReason(DisconnectClosed)
+}
+
+// closeWithReason notifies the handler only once, no matter how many goroutines close the session
+func (session *tcpServerSession) closeWithReason(reason DisconnectReason) error {
+	if !atomic.CompareAndSwapInt32(&session.isRunning, 1, 0) {
 		return nil
 	}
+	if session.handler != nil {
+		notifyDisconnected(session.handler, session, reason)
+	}
+	session.conn.Close()
 	return nil
 }
 
@@ -344,6 +535,34 @@ func (session *tcpServerSession) WaitTermination() error {
 	return errors.New("not implemented yet")
 }
 
+func (session *tcpServerSession) Context() context.Context {
+	return session.tracer.context()
+}
+
 func (session *tcpServerSession) RemoteAddress() (string, error) {
 	return session.remoteAddr, nil
 }
+
+func (session *tcpServerSession) ID() uint64 {
+	return session.id
+}
+
+func (session *tcpServerSession) ConnectTime() time.Time {
+	return session.connectTime
+}
+
+func (session *tcpServerSession) LocalAddr() net.Addr {
+	return session.localAddr
+}
+
+func (session *tcpServerSession) RemoteAddr() net.Addr {
+	return session.remoteSocketAddr
+}
+
+func (session *tcpServerSession) ProxySource() net.Addr {
+	return session.proxySource
+}
+
+func (session *tcpServerSession) Attributes() *Attributes {
+	return session.attributes
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -169,21 +170,28 @@ func TestClientRemoteAddress(t *testing.T) {
 // Test if the session really is freed when the client disconnects (Stop method)
 // --------------------------------------------------------------------------------------------
 type ClientTestSession struct {
+	mutex                    sync.Mutex
 	receiveBuffer            string
 	connectionEventOccured   bool
 	disconnectedEventOccured bool
 }
 
 func (s *ClientTestSession) Connected(session Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.connectionEventOccured = true
 	return nil
 }
 
 func (s *ClientTestSession) Disconnected(session Session) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.disconnectedEventOccured = true
 }
 
 func (s *ClientTestSession) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.receiveBuffer = s.receiveBuffer + string(fileData)
 	return nil
 }
@@ -205,10 +213,10 @@ func TestClientRun(t *testing.T) {
 	session.connectionEventOccured = false
 	session.receiveBuffer = ""
 
-	var eventLoopIsActive = true
+	var eventLoopIsActive int32 = 1
 	go func() {
 		tcpClient.Run(&session)
-		eventLoopIsActive = false
+		atomic.StoreInt32(&eventLoopIsActive, 0)
 	}()
 
 	//TODO: Waiting is not a good solution, instead check the state of the loop with timeout
@@ -221,16 +229,20 @@ func TestClientRun(t *testing.T) {
 
 	time.Sleep(time.Second * 1) // TODO: Wait data beeing sent
 
+	session.mutex.Lock()
 	assert.True(t, session.connectionEventOccured, "The event 'connected' was triggered")
 	assert.Equal(t, session.receiveBuffer, TESTSTRING)
+	session.mutex.Unlock()
 
 	// Stop and then check if the client really was disconnected from the server
 	tcpClient.Stop()
 
 	time.Sleep(time.Second * 1) // TODO: Wait data beeing sent
 
-	assert.False(t, eventLoopIsActive, "Eventloop did terminated")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&eventLoopIsActive), "Eventloop did terminated")
+	session.mutex.Lock()
 	assert.True(t, session.disconnectedEventOccured, "The event 'Disconnected' was triggered")
+	session.mutex.Unlock()
 }
 
 type lis1a1Handler struct {
@@ -295,3 +307,80 @@ func TestLis1A1ProtocolClient(t *testing.T) {
 	tcpServer.Stop()
 	tcpClient.Stop()
 }
+
+type reconnectHandler struct {
+	connected    chan bool
+	disconnected chan DisconnectReason
+}
+
+func (s *reconnectHandler) Connected(session Session) error {
+	s.connected <- true
+	return nil
+}
+
+func (s *reconnectHandler) Disconnected(session Session) {
+}
+
+func (s *reconnectHandler) DisconnectedWithReason(session Session, reason DisconnectReason) {
+	s.disconnected <- reason
+}
+
+func (s *reconnectHandler) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
+	return nil
+}
+
+func (s *reconnectHandler) Error(session Session, errorType ErrorType, err error) {
+}
+
+func TestClientReconnectsAfterMaxSessionLifetime(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:4028")
+	assert.Nil(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	config := DefaultTCPClientSettings
+	config.MaxSessionLifetime = 300 * time.Millisecond
+	tcpClient := CreateNewTCPClient("127.0.0.1", 4028,
+		protocol.Raw(protocol.DefaultRawProtocolSettings()),
+		NoLoadBalancer,
+		config)
+
+	handler := &reconnectHandler{connected: make(chan bool, 10), disconnected: make(chan DisconnectReason, 10)}
+	go tcpClient.Run(handler)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handler.connected:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("the client did not connect")
+		}
+		select {
+		case conn := <-accepted:
+			defer conn.Close()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("the server did not accept the connection")
+		}
+		assert.Equal(t, uint64(i+1), tcpClient.ID(), "every connection is a new session")
+		assert.Equal(t, 0, tcpClient.Attributes().Len(), "cleared with the previous connection")
+		tcpClient.Attributes().Set("instrument", "analyzer-1")
+		if i == 0 {
+			select {
+			case reason := <-handler.disconnected:
+				assert.Equal(t, DisconnectMaxLifetime, reason)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("the connection did not expire")
+			}
+		}
+	}
+
+	tcpClient.Stop()
+}
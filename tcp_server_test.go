@@ -1,9 +1,16 @@
 package bloodlabnet
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,11 +20,17 @@ import (
 
 	"github.com/blutspende/go-bloodlab-net/protocol"
 
+	"github.com/pires/go-proxyproto"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type testSessionMock struct {
+	// mutex guards the fields that the events of the sessions change
+	mutex                            sync.Mutex
 	errorThatWillbeReturnedOnConnect error
 	receiveQ                         chan []byte
 	lastConnectedIp                  string
@@ -32,17 +45,25 @@ func (s *testSessionMock) Connected(session Session) error {
 		return s.errorThatWillbeReturnedOnConnect
 	}
 
-	s.lastConnectedIp, _ = session.RemoteAddress()
+	ip, _ := session.RemoteAddress()
+	s.mutex.Lock()
+	s.lastConnectedIp = ip
+	s.mutex.Unlock()
 	s.signalReady <- true
 	return nil
 }
 
 func (s *testSessionMock) Disconnected(session Session) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.didReceiveDisconnectMessage = true
 }
 
 func (s *testSessionMock) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
-	s.lastConnectedIp, _ = session.RemoteAddress()
+	ip, _ := session.RemoteAddress()
+	s.mutex.Lock()
+	s.lastConnectedIp = ip
+	s.mutex.Unlock()
 	s.receiveQ <- fileData
 
 	anResponse := make([][]byte, 0)
@@ -53,9 +74,30 @@ func (s *testSessionMock) DataReceived(session Session, fileData []byte, receive
 }
 
 func (s *testSessionMock) Error(session Session, errorType ErrorType, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.occuredErrorTypes = append(s.occuredErrorTypes, errorType)
 }
 
+func (s *testSessionMock) connectedIp() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastConnectedIp
+}
+
+func (s *testSessionMock) disconnected() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.didReceiveDisconnectMessage
+}
+
+// errorTypes returns a copy of the occured errors
+func (s *testSessionMock) errorTypes() []ErrorType {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]ErrorType{}, s.occuredErrorTypes...)
+}
+
 // --------------------------------------------------------------------------------------------
 // The server is expected to buffer received data. When a timeout occurs and the connection is
 // closed, that buffer needs to be flushed to its handler. With the Raw Protocol the change
@@ -69,7 +111,7 @@ func TestRawDataProtocolWithTimeoutFlushMs(t *testing.T) {
 	handler.receiveQ = make(chan []byte, 500)
 	handler.signalReady = make(chan bool)
 
-	isServerHalted := false
+	serverHalted := make(chan bool, 1)
 
 	// run the mainloop, observe that it closes later
 	waitRunning := sync.Mutex{}
@@ -77,7 +119,7 @@ func TestRawDataProtocolWithTimeoutFlushMs(t *testing.T) {
 	go func() {
 		waitRunning.Unlock()
 		tcpServer.Run(&handler)
-		isServerHalted = true
+		serverHalted <- true
 	}()
 	waitRunning.Lock()
 	// allow time for the server to startup. This could be better handled with a status (TODO)
@@ -90,10 +132,16 @@ func TestRawDataProtocolWithTimeoutFlushMs(t *testing.T) {
 		t.Fail()
 		os.Exit(1)
 	}
+
+	// send data to server, expect it to receive it. The session starts with the first byte.
+	const TESTSTRING = "Hello its me"
+	_, err = clientConn.Write([]byte(TESTSTRING))
+	assert.Nil(t, err)
+
 	select {
 	case isReady := <-handler.signalReady:
 		if isReady {
-			assert.Equal(t, "127.0.0.1", handler.lastConnectedIp)
+			assert.Equal(t, "127.0.0.1", handler.connectedIp())
 		}
 	case <-time.After(2 * time.Second):
 		{
@@ -101,11 +149,6 @@ func TestRawDataProtocolWithTimeoutFlushMs(t *testing.T) {
 		}
 	}
 
-	// send data to server, expect it to receive it
-	const TESTSTRING = "Hello its me"
-	_, err = clientConn.Write([]byte(TESTSTRING))
-	assert.Nil(t, err)
-
 	select { // expecting to receive the same string
 	case receivedMsg := <-handler.receiveQ:
 		assert.NotNil(t, receivedMsg, "Received a valid response")
@@ -126,10 +169,14 @@ func TestRawDataProtocolWithTimeoutFlushMs(t *testing.T) {
 
 	time.Sleep(time.Second * 1)
 
-	assert.True(t, handler.didReceiveDisconnectMessage, "Disconnect message was send")
+	assert.True(t, handler.disconnected(), "Disconnect message was send")
 
 	tcpServer.Stop()
-	assert.True(t, isServerHalted, "Server has been stopped")
+	select {
+	case <-serverHalted:
+	case <-time.After(time.Second):
+		t.Errorf("Server has not been stopped")
+	}
 }
 
 // --------------------------------------------------------------------------------------------
@@ -201,22 +248,22 @@ func TestTCPServerMaxConnections(t *testing.T) {
 	go tcpServer.Run(handlerTcp)
 	tcpServer.WaitReady()
 
-	conn1, err1 := net.Dial("tcp", "127.0.0.1:4002")
-	assert.Nil(t, err1)
-	assert.NotNil(t, conn1)
-
-	conn2, err2 := net.Dial("tcp", "127.0.0.1:4002")
-	assert.Nil(t, err2)
-	assert.NotNil(t, conn2)
-
-	conn3, err3 := net.Dial("tcp", "127.0.0.1:4002")
-	assert.Nil(t, err3)
-	assert.NotNil(t, conn3)
+	// the sessions start with the first byte
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:4002")
+		if assert.Nil(t, err) {
+			_, err = conn.Write([]byte("x"))
+			assert.Nil(t, err)
+			defer conn.Close()
+		}
+	}
 
 	// sessions for the clients start asynchronous, we need to wait for the process to start in order to count the clients
 	time.Sleep(time.Second * 1)
 
-	assert.Equal(t, ErrorMaxConnections, handlerTcp.occuredErrorTypes[0])
+	if errorTypes := handlerTcp.errorTypes(); assert.NotEmpty(t, errorTypes) {
+		assert.Equal(t, ErrorMaxConnections, errorTypes[0])
+	}
 
 	tcpServer.Stop()
 }
@@ -243,11 +290,17 @@ func TestTCPServerIdentifyRemoteAddress(t *testing.T) {
 	conn1, err1 := net.Dial("tcp", "127.0.0.1:4005")
 	assert.Nil(t, err1)
 	assert.NotNil(t, conn1)
+	// the session starts with the first byte
+	_, err1 = conn1.Write([]byte("x"))
+	assert.Nil(t, err1)
 
 	// sessions for the clients start asynchronous, we need to wait for the process to start in order to count the clients
 	time.Sleep(time.Second * 1) // sessions start async, therefor a short waitign is required
 
-	assert.Equal(t, "127.0.0.1", handlerTcp.lastConnectedIp)
+	assert.Equal(t, "127.0.0.1", handlerTcp.connectedIp())
+
+	conn1.Close()
+	tcpServer.Stop()
 }
 
 // --------------------------------------------------------------------------------------------
@@ -536,3 +589,1778 @@ func TestTCPServerDeclineConnection(t *testing.T) {
 
 	tcpServer.Stop()
 }
+
+type captureSinkMock struct {
+	mutex  sync.Mutex
+	local  net.Addr
+	remote net.Addr
+	data   []byte
+	closed chan bool
+}
+
+func (s *captureSinkMock) OpenSession(local, remote net.Addr, timestamp time.Time) protocol.CaptureSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.local, s.remote = local, remote
+	return s
+}
+
+func (s *captureSinkMock) Record(timestamp time.Time, direction protocol.CaptureDirection, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data = append(s.data, []byte(direction)...)
+	s.data = append(s.data, data...)
+}
+
+func (s *captureSinkMock) Close(timestamp time.Time) {
+	s.closed <- true
+}
+
+// --------------------------------------------------------------------------------------------
+// The capture sink of the server records the traffic of the connection including the first
+// bytes that are read before the session is created
+// --------------------------------------------------------------------------------------------
+func TestTCPServerCaptureSink(t *testing.T) {
+	sink := &captureSinkMock{closed: make(chan bool, 1)}
+	config := DefaultTCPServerSettings
+	config.CaptureSink = sink
+
+	tcpServer := CreateNewTCPServerInstance(4016,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &testSessionMock{
+		receiveQ:          make(chan []byte, 500),
+		signalReady:       make(chan bool, 100),
+		occuredErrorTypes: make([]ErrorType, 0),
+	}
+
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4016")
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002data\u0003"))
+	assert.Nil(t, err)
+
+	select {
+	case receivedMsg := <-handler.receiveQ:
+		assert.Equal(t, "data", string(receivedMsg))
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+	response := make([]byte, 0)
+	buffer := make([]byte, 100)
+	for !strings.HasSuffix(string(response), "\u0003") {
+		n, err := clientConn.Read(buffer)
+		assert.Nil(t, err)
+		response = append(response, buffer[:n]...)
+	}
+	clientConn.Close()
+
+	select {
+	case <-sink.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("capture session was not closed")
+	}
+
+	sink.mutex.Lock()
+	assert.Equal(t, clientConn.LocalAddr().String(), sink.remote.String())
+	assert.Equal(t, clientConn.RemoteAddr().String(), sink.local.String())
+	assert.Equal(t, "rx\u0002data\u0003tx"+string(response), string(sink.data))
+	sink.mutex.Unlock()
+
+	tcpServer.Stop()
+}
+
+type metricsRecorderMock struct {
+	mutex            sync.Mutex
+	opened           int
+	closed           chan bool
+	rejected         []RejectReason
+	bytesReceived    int
+	bytesSent        int
+	messagesReceived int
+	messagesSent     int
+	handled          int
+}
+
+func (m *metricsRecorderMock) SessionOpened(remoteIP string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.opened++
+}
+func (m *metricsRecorderMock) SessionClosed(remoteIP string) {
+	m.closed <- true
+}
+func (m *metricsRecorderMock) ConnectionRejected(remoteIP string, reason RejectReason) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rejected = append(m.rejected, reason)
+}
+func (m *metricsRecorderMock) BytesReceived(remoteIP string, n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.bytesReceived += n
+}
+func (m *metricsRecorderMock) BytesSent(remoteIP string, n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.bytesSent += n
+}
+func (m *metricsRecorderMock) MessageReceived(remoteIP string, size int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messagesReceived++
+}
+func (m *metricsRecorderMock) MessageSent(remoteIP string, size int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messagesSent++
+}
+func (m *metricsRecorderMock) MessageHandled(remoteIP string, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.handled++
+}
+func (m *metricsRecorderMock) Error(remoteIP string, errorType ErrorType) {}
+
+func TestTCPServerMetrics(t *testing.T) {
+	metrics := &metricsRecorderMock{closed: make(chan bool, 1)}
+	config := DefaultTCPServerSettings
+	config.Metrics = metrics
+
+	tcpServer := CreateNewTCPServerInstance(4017,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &testSessionMock{
+		receiveQ:          make(chan []byte, 500),
+		signalReady:       make(chan bool, 100),
+		occuredErrorTypes: make([]ErrorType, 0),
+	}
+
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4017")
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002data\u0003"))
+	assert.Nil(t, err)
+
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+	response := make([]byte, 0)
+	buffer := make([]byte, 100)
+	for !strings.HasSuffix(string(response), "\u0003") {
+		n, err := clientConn.Read(buffer)
+		assert.Nil(t, err)
+		response = append(response, buffer[:n]...)
+	}
+	clientConn.Close()
+
+	select {
+	case <-metrics.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("session was not closed")
+	}
+
+	metrics.mutex.Lock()
+	assert.Equal(t, 1, metrics.opened)
+	assert.Equal(t, 6, metrics.bytesReceived)
+	assert.Equal(t, len(response), metrics.bytesSent)
+	assert.Equal(t, 1, metrics.messagesReceived)
+	assert.Equal(t, 1, metrics.messagesSent)
+	assert.Equal(t, 1, metrics.handled)
+	assert.Empty(t, metrics.rejected)
+	metrics.mutex.Unlock()
+
+	tcpServer.Stop()
+}
+
+type tracingHandlerMock struct {
+	testSessionMock
+	spanContexts chan trace.SpanContext
+}
+
+func (s *tracingHandlerMock) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
+	s.spanContexts <- trace.SpanContextFromContext(session.Context())
+	return s.testSessionMock.DataReceived(session, fileData, receiveTimestamp)
+}
+
+func TestTCPServerTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	config := DefaultTCPServerSettings
+	config.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	tcpServer := CreateNewTCPServerInstance(4018,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &tracingHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+		spanContexts: make(chan trace.SpanContext, 1),
+	}
+
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4018")
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002da"))
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = clientConn.Write([]byte("ta\u0003"))
+	assert.Nil(t, err)
+
+	var handlerSpanContext trace.SpanContext
+	select {
+	case handlerSpanContext = <-handler.spanContexts:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+	response := make([]byte, 0)
+	buffer := make([]byte, 100)
+	for !strings.HasSuffix(string(response), "\u0003") {
+		n, err := clientConn.Read(buffer)
+		assert.Nil(t, err)
+		response = append(response, buffer[:n]...)
+	}
+	clientConn.Close()
+	tcpServer.Stop()
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	receive, handle, send := spans["bloodlabnet.receive"], spans["bloodlabnet.handle"], spans["bloodlabnet.send"]
+	assert.True(t, handlerSpanContext.IsValid())
+	assert.Equal(t, handle.SpanContext.SpanID(), handlerSpanContext.SpanID(), "the context of the session carries the handle span")
+	assert.Equal(t, receive.SpanContext.SpanID(), handle.Parent.SpanID())
+	assert.Equal(t, handle.SpanContext.SpanID(), send.Parent.SpanID(), "sent from the handler")
+	assert.Equal(t, receive.SpanContext.TraceID(), send.SpanContext.TraceID())
+	// from the first byte of the message
+	assert.GreaterOrEqual(t, receive.EndTime.Sub(receive.StartTime), 50*time.Millisecond)
+}
+
+func TestTCPServerAdminHandler(t *testing.T) {
+	tcpServer := CreateNewTCPServerInstance(4019,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		DefaultTCPServerSettings)
+
+	adminHandler, err := AdminHandler(tcpServer)
+	assert.Nil(t, err)
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		adminHandler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/healthz").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, request(http.MethodGet, "/readyz").Code)
+
+	handler := &testSessionMock{
+		receiveQ:          make(chan []byte, 500),
+		signalReady:       make(chan bool, 100),
+		occuredErrorTypes: make([]ErrorType, 0),
+	}
+
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/readyz").Code)
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4019")
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002data\u0003"))
+	assert.Nil(t, err)
+
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+	response := make([]byte, 0)
+	buffer := make([]byte, 100)
+	for !strings.HasSuffix(string(response), "\u0003") {
+		n, err := clientConn.Read(buffer)
+		assert.Nil(t, err)
+		response = append(response, buffer[:n]...)
+	}
+
+	recorder := request(http.MethodGet, "/sessions")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var sessions []SessionInfo
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &sessions))
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "127.0.0.1", sessions[0].RemoteAddress)
+	assert.Equal(t, "stxetx", sessions[0].Protocol)
+	assert.Equal(t, int64(6), sessions[0].BytesIn)
+	assert.Equal(t, int64(len(response)), sessions[0].BytesOut)
+	assert.Equal(t, int64(1), sessions[0].MessagesIn)
+	assert.Equal(t, int64(1), sessions[0].MessagesOut)
+	assert.False(t, sessions[0].LastActivity.Before(sessions[0].ConnectTime))
+
+	administration := tcpServer.(TCPServerAdministration)
+	assert.Equal(t, 1, administration.SessionCount())
+	session, ok := administration.SessionByID(sessions[0].ID)
+	assert.True(t, ok)
+	assert.True(t, session.IsAlive())
+	_, ok = administration.SessionByID(sessions[0].ID + 1)
+	assert.False(t, ok)
+	visited := 0
+	administration.ForEachSession(func(session Session) bool {
+		visited++
+		return true
+	})
+	assert.Equal(t, 1, visited)
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPut, "/blacklist/10.0.0.1").Code)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPut, "/blacklist/2001:db8::/32").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, "/blacklist/not-an-ip").Code)
+	recorder = request(http.MethodGet, "/blacklist")
+	assert.JSONEq(t, `["10.0.0.1", "2001:db8::/32"]`, recorder.Body.String())
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/blacklist/10.0.0.1").Code)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/blacklist/2001:db8::/32").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/blacklist/10.0.0.1").Code)
+	recorder = request(http.MethodGet, "/blacklist")
+	assert.JSONEq(t, `[]`, recorder.Body.String())
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPut, "/allowlist/127.0.0.0/8").Code)
+	recorder = request(http.MethodGet, "/allowlist")
+	assert.JSONEq(t, `["127.0.0.0/8"]`, recorder.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, fmt.Sprintf("/sessions/%d", sessions[0].ID+1)).Code)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, fmt.Sprintf("/sessions/%d", sessions[0].ID)).Code)
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = clientConn.Read(buffer)
+	assert.NotNil(t, err)
+	clientConn.Close()
+
+	tcpServer.Stop()
+}
+
+func TestSessionRegistry(t *testing.T) {
+	registry := newSessionRegistry()
+	first := &tcpServerSession{remoteAddr: "10.0.0.1", peerID: "analyzer-1"}
+	second := &tcpServerSession{remoteAddr: "10.0.0.2", peerID: "analyzer-2"}
+	third := &tcpServerSession{remoteAddr: "10.0.0.1", peerID: "analyzer-3"}
+	for _, session := range []*tcpServerSession{first, second, third} {
+		registry.add(session)
+	}
+
+	assert.Equal(t, 3, registry.count())
+	assert.Equal(t, []*tcpServerSession{first, second, third}, registry.all())
+	assert.Equal(t, []*tcpServerSession{first, third}, registry.byIP("10.0.0.1"))
+	assert.Equal(t, []*tcpServerSession{second}, registry.byPeer("analyzer-2"))
+	session, ok := registry.get(second.id)
+	assert.True(t, ok)
+	assert.Same(t, second, session)
+
+	assert.True(t, registry.remove(first))
+	assert.False(t, registry.remove(first), "removed twice")
+	_, ok = registry.get(first.id)
+	assert.False(t, ok)
+	assert.Equal(t, 2, registry.count())
+
+	// the IDs stay unique while sessions come and go
+	var wg sync.WaitGroup
+	ids := make(chan uint64, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := &tcpServerSession{remoteAddr: "10.0.0.3"}
+			ids <- registry.add(session)
+			registry.byIP("10.0.0.3")
+			registry.remove(session)
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	unique := make(map[uint64]bool)
+	for id := range ids {
+		assert.False(t, unique[id], "id %d was assigned twice", id)
+		unique[id] = true
+	}
+	assert.Equal(t, 2, registry.count())
+}
+
+func TestIPFilter(t *testing.T) {
+	filter := NewIPFilter(DenyWins)
+	assert.True(t, filter.Permits("10.1.2.3"))
+
+	assert.Nil(t, filter.Deny("10.0.0.0/8", "2001:db8::/32"))
+	assert.False(t, filter.Permits("10.1.2.3"))
+	assert.False(t, filter.Permits("::ffff:10.1.2.3"))
+	assert.False(t, filter.Permits("2001:db8::1"))
+	assert.True(t, filter.Permits("192.168.1.1"))
+	assert.True(t, filter.Permits("2001:db9::1"))
+
+	assert.NotNil(t, filter.Allow("192.168.1.0/24", "not-an-ip"))
+	assert.Empty(t, filter.AllowList())
+
+	assert.Nil(t, filter.Allow("192.168.1.0/24", "10.1.2.3"))
+	assert.True(t, filter.Permits("192.168.1.1"))
+	assert.False(t, filter.Permits("192.168.2.1"))
+	assert.False(t, filter.Permits("10.1.2.3"), "the denylist wins")
+
+	filter = NewIPFilter(AllowWins)
+	assert.Nil(t, filter.Deny("10.0.0.0/8"))
+	assert.Nil(t, filter.Allow("10.1.2.3"))
+	assert.True(t, filter.Permits("10.1.2.3"), "the allowlist wins")
+	assert.False(t, filter.Permits("10.1.2.4"))
+
+	assert.Equal(t, []string{"10.0.0.0/8"}, filter.DenyList())
+	assert.True(t, filter.RemoveDenied("10.0.0.0/8"))
+	assert.False(t, filter.RemoveDenied("10.0.0.0/8"))
+	assert.Nil(t, filter.SetAllowList([]string{"fd00::/8"}))
+	assert.Equal(t, []string{"fd00::/8"}, filter.AllowList())
+	assert.False(t, filter.Permits("10.1.2.3"))
+	assert.True(t, filter.Permits("fd00::1"))
+}
+
+type ipFilterHandlerMock struct {
+	testSessionMock
+	errors chan error
+}
+
+func (s *ipFilterHandlerMock) Error(session Session, errorType ErrorType, err error) {
+	if errorType == ErrorIPFiltered {
+		s.errors <- err
+	}
+}
+
+func TestTCPServerIPFilter(t *testing.T) {
+	config := DefaultTCPServerSettings
+	config.IPFilter = NewIPFilter(DenyWins)
+	config.BlackListedIPAddresses = []string{"127.0.0.0/8"}
+
+	tcpServer := CreateNewTCPServerInstance(4020,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &ipFilterHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+		errors: make(chan error, 10),
+	}
+
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4020")
+	assert.Nil(t, err)
+	// the proxy protocol listener reads the remote address with the first bytes
+	_, err = clientConn.Write([]byte("\u0002data\u0003"))
+	assert.Nil(t, err)
+	select {
+	case err := <-handler.errors:
+		assert.Contains(t, err.Error(), "127.0.0.1")
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the connection was not rejected")
+	}
+	clientConn.Close()
+
+	// the filter can be changed while the server is running
+	assert.True(t, config.IPFilter.RemoveDenied("127.0.0.0/8"))
+	assert.Nil(t, config.IPFilter.Allow("127.0.0.1"))
+
+	clientConn, err = net.Dial("tcp", "127.0.0.1:4020")
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002data\u0003"))
+	assert.Nil(t, err)
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+	clientConn.Close()
+
+	tcpServer.Stop()
+}
+
+func TestConnectionRateLimiter(t *testing.T) {
+	limiter := newConnectionRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.allow("10.0.0.1", now))
+	}
+	assert.False(t, limiter.allow("10.0.0.1", now))
+	assert.True(t, limiter.allow("10.0.0.2", now), "the limit is per remote address")
+
+	assert.True(t, limiter.allow("10.0.0.1", now.Add(500*time.Millisecond)))
+	assert.False(t, limiter.allow("10.0.0.1", now.Add(500*time.Millisecond)))
+
+	// full buckets are removed
+	limiter.allow("10.0.0.3", now.Add(time.Minute))
+	assert.Len(t, limiter.buckets, 1)
+
+	noLimit := newConnectionRateLimiter(0, 0)
+	assert.True(t, noLimit.allow("10.0.0.1", now))
+}
+
+type connectionLimitHandlerMock struct {
+	testSessionMock
+	errors chan ErrorType
+}
+
+func (s *connectionLimitHandlerMock) Error(session Session, errorType ErrorType, err error) {
+	s.errors <- errorType
+}
+
+func newConnectionLimitHandlerMock() *connectionLimitHandlerMock {
+	return &connectionLimitHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+		errors: make(chan ErrorType, 10),
+	}
+}
+
+func dialAndSend(t *testing.T, address string) net.Conn {
+	clientConn, err := net.Dial("tcp", address)
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002data\u0003"))
+	assert.Nil(t, err)
+	return clientConn
+}
+
+func assertConnectionClosedByServer(t *testing.T, clientConn net.Conn) {
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 100)
+	for {
+		if _, err := clientConn.Read(buffer); err != nil {
+			assert.False(t, errors.Is(err, os.ErrDeadlineExceeded), "the server did not close the connection")
+			return
+		}
+	}
+}
+
+func TestTCPServerMaxConnectionsPerIP(t *testing.T) {
+	config := DefaultTCPServerSettings
+	config.MaxConnectionsPerIP = 1
+	tcpServer := CreateNewTCPServerInstance(4021,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := newConnectionLimitHandlerMock()
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	firstConn := dialAndSend(t, "127.0.0.1:4021")
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+
+	secondConn := dialAndSend(t, "127.0.0.1:4021")
+	select {
+	case errorType := <-handler.errors:
+		assert.Equal(t, ErrorConnectionLimit, errorType)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the connection was not rejected")
+	}
+	assertConnectionClosedByServer(t, secondConn)
+	assert.Len(t, tcpServer.FindSessionsByIp("127.0.0.1"), 1)
+
+	firstConn.Close()
+	secondConn.Close()
+	tcpServer.Stop()
+}
+
+func TestTCPServerCloseOldestSessionPerIP(t *testing.T) {
+	config := DefaultTCPServerSettings
+	config.MaxConnectionsPerIP = 1
+	config.PerIPLimitPolicy = CloseOldestSession
+	tcpServer := CreateNewTCPServerInstance(4022,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		1,
+		config)
+
+	handler := newConnectionLimitHandlerMock()
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	firstConn := dialAndSend(t, "127.0.0.1:4022")
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+
+	// replacing the session is possible although the server is at maxConnections
+	secondConn := dialAndSend(t, "127.0.0.1:4022")
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the new connection was not accepted")
+	}
+	assertConnectionClosedByServer(t, firstConn)
+	assert.Empty(t, handler.errors)
+
+	firstConn.Close()
+	secondConn.Close()
+	tcpServer.Stop()
+}
+
+func TestTCPServerConnectionRatePerIP(t *testing.T) {
+	config := DefaultTCPServerSettings
+	config.ConnectionRatePerIP = 0.1
+	config.ConnectionBurstPerIP = 1
+	tcpServer := CreateNewTCPServerInstance(4023,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := newConnectionLimitHandlerMock()
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	firstConn := dialAndSend(t, "127.0.0.1:4023")
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+	firstConn.Close()
+
+	secondConn := dialAndSend(t, "127.0.0.1:4023")
+	select {
+	case errorType := <-handler.errors:
+		assert.Equal(t, ErrorConnectionRate, errorType)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the connection was not rejected")
+	}
+	assertConnectionClosedByServer(t, secondConn)
+	secondConn.Close()
+
+	tcpServer.Stop()
+}
+
+type disconnectReasonHandlerMock struct {
+	testSessionMock
+	reasons chan DisconnectReason
+}
+
+func (s *disconnectReasonHandlerMock) DisconnectedWithReason(session Session, reason DisconnectReason) {
+	s.reasons <- reason
+}
+
+func TestTCPServerSingleSessionPerPeer(t *testing.T) {
+	config := DefaultTCPServerSettings
+	config.SingleSessionPerPeer = true
+	tcpServer := CreateNewTCPServerInstance(4024,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &disconnectReasonHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+		reasons: make(chan DisconnectReason, 10),
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	firstConn := dialAndSend(t, "127.0.0.1:4024")
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+	firstSessions := tcpServer.FindSessionsByIp("127.0.0.1")
+	assert.Len(t, firstSessions, 1)
+
+	secondConn := dialAndSend(t, "127.0.0.1:4024")
+	select {
+	case reason := <-handler.reasons:
+		assert.Equal(t, DisconnectReplaced, reason)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the previous session was not closed")
+	}
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the new connection was not accepted")
+	}
+	assertConnectionClosedByServer(t, firstConn)
+
+	sessions := tcpServer.FindSessionsByIp("127.0.0.1")
+	assert.Len(t, sessions, 1)
+	assert.NotSame(t, firstSessions[0], sessions[0])
+	assert.True(t, sessions[0].IsAlive())
+
+	secondConn.Close()
+	select {
+	case reason := <-handler.reasons:
+		assert.Equal(t, DisconnectRemote, reason)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the session did not end")
+	}
+
+	firstConn.Close()
+	tcpServer.Stop()
+}
+
+func TestTCPServerHeartbeat(t *testing.T) {
+	config := DefaultTCPServerSettings
+	config.EnableHeartbeat = true
+	config.PollInterval = 200 * time.Millisecond
+	config.HeartbeatTimeout = 200 * time.Millisecond
+	config.KeepAlive = KeepAliveConfiguration{Idle: time.Minute, Interval: 10 * time.Second, Count: 3}
+	tcpServer := CreateNewTCPServerInstance(4025,
+		protocol.Lis1A1Protocol(protocol.DefaultLis1A1ProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &disconnectReasonHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+		reasons: make(chan DisconnectReason, 10),
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4025")
+	assert.Nil(t, err)
+	// the proxy protocol listener reads the remote address with the first bytes, EOT is ignored when idle
+	_, err = clientConn.Write([]byte{utilities.EOT})
+	assert.Nil(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// the instrument answers the first heartbeat
+	buffer := make([]byte, 1)
+	_, err = clientConn.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(utilities.ENQ), buffer[0])
+	_, err = clientConn.Write([]byte{utilities.ACK})
+	assert.Nil(t, err)
+	_, err = clientConn.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(utilities.EOT), buffer[0])
+
+	// ... but not the second one
+	_, err = clientConn.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(utilities.ENQ), buffer[0])
+
+	select {
+	case reason := <-handler.reasons:
+		assert.Equal(t, DisconnectNotResponding, reason)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the session was not closed")
+	}
+	assertConnectionClosedByServer(t, clientConn)
+
+	clientConn.Close()
+	tcpServer.Stop()
+}
+
+type busyProtocolMock struct {
+	protocol.Implementation
+	busy int32
+}
+
+func (p *busyProtocolMock) Busy() bool {
+	return atomic.LoadInt32(&p.busy) == 1
+}
+
+func TestSessionLimitsWaitForTheEndOfTheTransfer(t *testing.T) {
+	busyProtocol := &busyProtocolMock{Implementation: protocol.Raw(), busy: 1}
+	expired := make(chan DisconnectReason, 1)
+	limits := startSessionLimits(0, 10*time.Millisecond, busyProtocol, &sessionStats{}, time.Now(), &sync.Mutex{},
+		func(reason DisconnectReason) { expired <- reason })
+	defer limits.Stop()
+
+	select {
+	case <-expired:
+		t.Fatalf("the session expired during a transfer")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.False(t, limits.isClosing())
+
+	atomic.StoreInt32(&busyProtocol.busy, 0)
+	select {
+	case reason := <-expired:
+		assert.Equal(t, DisconnectMaxLifetime, reason)
+	case <-time.After(2 * sessionLimitsBusyRetry):
+		t.Fatalf("the session did not expire")
+	}
+	assert.True(t, limits.isClosing())
+}
+
+func TestTCPServerIdleTimeout(t *testing.T) {
+	config := DefaultTCPServerSettings
+	config.IdleTimeout = 300 * time.Millisecond
+	tcpServer := CreateNewTCPServerInstance(4027,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &disconnectReasonHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+		reasons: make(chan DisconnectReason, 10),
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn := dialAndSend(t, "127.0.0.1:4027")
+	select {
+	case <-handler.receiveQ:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+	}
+	start := time.Now()
+
+	select {
+	case reason := <-handler.reasons:
+		assert.Equal(t, DisconnectIdleTimeout, reason)
+		assert.True(t, time.Since(start) >= 200*time.Millisecond, "the messages are activity")
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the session did not expire")
+	}
+	assertConnectionClosedByServer(t, clientConn)
+
+	clientConn.Close()
+	tcpServer.Stop()
+}
+
+type attributesHandlerMock struct {
+	testSessionMock
+	sessions     chan Session
+	attributesAt chan int
+}
+
+func (s *attributesHandlerMock) Connected(session Session) error {
+	s.sessions <- session
+	return nil
+}
+
+func (s *attributesHandlerMock) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
+	count, _ := session.Attributes().Get("messages")
+	messages, _ := count.(int)
+	session.Attributes().Set("messages", messages+1)
+	s.receiveQ <- fileData
+	return nil
+}
+
+func (s *attributesHandlerMock) Disconnected(session Session) {
+	s.attributesAt <- session.Attributes().Len()
+}
+
+func TestTCPServerSessionIdentity(t *testing.T) {
+	tcpServer := CreateNewTCPServerInstance(4029,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		DefaultTCPServerSettings)
+
+	handler := &attributesHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+		sessions:     make(chan Session, 10),
+		attributesAt: make(chan int, 10),
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	// behind a load balancer
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4029")
+	assert.Nil(t, err)
+	header := proxyproto.HeaderProxyFromAddrs(1,
+		&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 51000}, &net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 4029})
+	_, err = header.WriteTo(clientConn)
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002first\u0003\u0002second\u0003"))
+	assert.Nil(t, err)
+	// directly
+	directConn := dialAndSend(t, "127.0.0.1:4029")
+
+	var proxied, direct Session
+	for i := 0; i < 2; i++ {
+		select {
+		case session := <-handler.sessions:
+			if session.ProxySource() != nil {
+				proxied = session
+			} else {
+				direct = session
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("the session did not start")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handler.receiveQ:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+		}
+	}
+	if !assert.NotNil(t, proxied) || !assert.NotNil(t, direct) {
+		return
+	}
+
+	assert.NotEqual(t, proxied.ID(), direct.ID())
+	assert.NotZero(t, proxied.ID())
+	assert.WithinDuration(t, time.Now(), proxied.ConnectTime(), 2*time.Second)
+	assert.Equal(t, "10.1.2.3:51000", proxied.ProxySource().String())
+	assert.Equal(t, clientConn.LocalAddr().String(), proxied.RemoteAddr().String(), "the load balancer")
+	assert.Equal(t, clientConn.RemoteAddr().String(), proxied.LocalAddr().String())
+	ip, _ := proxied.RemoteAddress()
+	assert.Equal(t, "10.1.2.3", ip)
+	assert.Equal(t, directConn.LocalAddr().String(), direct.RemoteAddr().String())
+
+	messages, ok := proxied.Attributes().Get("messages")
+	assert.True(t, ok)
+	assert.Equal(t, 2, messages, "kept between the messages")
+	assert.Equal(t, []string{"messages"}, proxied.Attributes().Keys())
+
+	clientConn.Close()
+	select {
+	case attributes := <-handler.attributesAt:
+		assert.Equal(t, 1, attributes, "available during the Disconnected event")
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the session did not end")
+	}
+	assert.Eventually(t, func() bool { return proxied.Attributes().Len() == 0 }, 2*time.Second, 10*time.Millisecond)
+
+	directConn.Close()
+	tcpServer.Stop()
+}
+
+type profileHandlerMock struct {
+	testSessionMock
+}
+
+func (s *profileHandlerMock) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
+	// the instruments identify themselves with the first message
+	session.Attributes().Set("profile", string(fileData))
+	s.receiveQ <- fileData
+	return nil
+}
+
+func TestTCPServerBroadcast(t *testing.T) {
+	config := DefaultTCPServerSettings
+	config.BroadcastParallelism = 2
+	tcpServer := CreateNewTCPServerInstance(4030,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &profileHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	profiles := []string{"cobas", "sysmex", "cobas"}
+	clientConns := make([]net.Conn, 0)
+	for _, profile := range profiles {
+		clientConn, err := net.Dial("tcp", "127.0.0.1:4030")
+		assert.Nil(t, err)
+		_, err = clientConn.Write([]byte("\u0002" + profile + "\u0003"))
+		assert.Nil(t, err)
+		clientConns = append(clientConns, clientConn)
+		select {
+		case <-handler.receiveQ:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timout waiting on valid response. This means the Server was unable to receive this message ")
+		}
+	}
+	readMessage := func(clientConn net.Conn) string {
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		response := make([]byte, 0)
+		buffer := make([]byte, 100)
+		for !strings.HasSuffix(string(response), "\u0003") {
+			n, err := clientConn.Read(buffer)
+			if err != nil {
+				return err.Error()
+			}
+			response = append(response, buffer[:n]...)
+		}
+		return string(response)
+	}
+
+	server := tcpServer.(Broadcaster)
+	results := server.Broadcast(context.Background(), [][]byte{[]byte("cancel order 4711")}, SessionsWithAttribute("profile", "cobas"))
+	if assert.Len(t, results, 2) {
+		for _, result := range results {
+			assert.Nil(t, result.Err)
+			profile, _ := result.Session.Attributes().Get("profile")
+			assert.Equal(t, "cobas", profile)
+		}
+		assert.Less(t, results[0].Session.ID(), results[1].Session.ID(), "in the order the sessions connected")
+	}
+	assert.Equal(t, "\u0002cancel order 4711\r\u0003", readMessage(clientConns[0]))
+	assert.Equal(t, "\u0002cancel order 4711\r\u0003", readMessage(clientConns[2]))
+
+	// a peer that is busy with a transfer does not delay the others
+	busy := tcpServer.(*tcpServerInstance).sessions.all()[0]
+	busy.blockedForSending.Lock()
+	done := make(chan []BroadcastResult)
+	go func() {
+		done <- server.Broadcast(context.Background(), [][]byte{[]byte("maintenance")}, SessionsOfIP("127.0.0.1"))
+	}()
+	assert.Equal(t, "\u0002maintenance\r\u0003", readMessage(clientConns[1]))
+	assert.Equal(t, "\u0002maintenance\r\u0003", readMessage(clientConns[2]))
+	select {
+	case <-done:
+		t.Fatalf("the broadcast did not wait for the busy session")
+	default:
+	}
+	busy.blockedForSending.Unlock()
+	select {
+	case results := <-done:
+		assert.Len(t, results, 3)
+		for _, result := range results {
+			assert.Nil(t, result.Err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the broadcast did not finish")
+	}
+	assert.Equal(t, "\u0002maintenance\r\u0003", readMessage(clientConns[0]))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = server.Broadcast(ctx, [][]byte{[]byte("too late")}, nil)
+	assert.Len(t, results, 3)
+	for _, result := range results {
+		assert.ErrorIs(t, result.Err, context.Canceled)
+	}
+
+	for _, clientConn := range clientConns {
+		clientConn.Close()
+	}
+	tcpServer.Stop()
+}
+
+func TestSendQueue(t *testing.T) {
+	busyProtocol := &busyProtocolMock{Implementation: protocol.Raw(), busy: 1}
+	sent := make(chan string, 10)
+	send := func(data [][]byte) (int, error) {
+		sent <- string(data[0])
+		return len(data[0]), nil
+	}
+
+	queue := newSendQueue(2, BlockWhenFull, busyProtocol)
+	queue.start(send)
+	first, err := queue.enqueue([][]byte{[]byte("first")})
+	assert.Nil(t, err)
+	second, err := queue.enqueue([][]byte{[]byte("second")})
+	assert.Nil(t, err)
+	select {
+	case <-sent:
+		t.Fatalf("sent during a transfer")
+	case <-time.After(100 * time.Millisecond):
+	}
+	atomic.StoreInt32(&busyProtocol.busy, 0)
+	assert.Equal(t, SendResult{N: 5}, <-first)
+	assert.Equal(t, SendResult{N: 6}, <-second)
+	assert.Equal(t, "first", <-sent)
+	assert.Equal(t, "second", <-sent)
+	queue.close()
+	_, err = queue.enqueue([][]byte{[]byte("third")})
+	assert.ErrorIs(t, err, ErrSessionClosed)
+
+	// the senders are not started, the queues stay full
+	rejecting := newSendQueue(1, RejectWhenFull, busyProtocol)
+	queued, err := rejecting.enqueue([][]byte{[]byte("first")})
+	assert.Nil(t, err)
+	_, err = rejecting.enqueue([][]byte{[]byte("second")})
+	assert.ErrorIs(t, err, ErrSendQueueFull)
+	rejecting.close()
+	assert.ErrorIs(t, (<-queued).Err, ErrSessionClosed, "the queued messages are not lost")
+
+	dropping := newSendQueue(1, DropOldestWhenFull, busyProtocol)
+	oldest, err := dropping.enqueue([][]byte{[]byte("first")})
+	assert.Nil(t, err)
+	newest, err := dropping.enqueue([][]byte{[]byte("second")})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, (<-oldest).Err, ErrSendQueueFull)
+	dropping.close()
+	assert.ErrorIs(t, (<-newest).Err, ErrSessionClosed)
+}
+
+func TestTCPServerEnqueueWaitsForTheEndOfTheTransfer(t *testing.T) {
+	tcpServer := CreateNewTCPServerInstance(4031,
+		protocol.Lis1A1Protocol(protocol.DefaultLis1A1ProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		DefaultTCPServerSettings)
+
+	handler := &profileHandlerMock{
+		testSessionMock: testSessionMock{
+			receiveQ:          make(chan []byte, 500),
+			signalReady:       make(chan bool, 100),
+			occuredErrorTypes: make([]ErrorType, 0),
+		},
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4031")
+	assert.Nil(t, err)
+	readByte := func(timeout time.Duration) (byte, error) {
+		clientConn.SetReadDeadline(time.Now().Add(timeout))
+		buffer := make([]byte, 1)
+		_, err := clientConn.Read(buffer)
+		return buffer[0], err
+	}
+
+	// the instrument starts a transfer
+	_, err = clientConn.Write([]byte{utilities.ENQ})
+	assert.Nil(t, err)
+	answer, err := readByte(2 * time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(utilities.ACK), answer)
+
+	sessions := tcpServer.(*tcpServerInstance).sessions.all()
+	if !assert.Len(t, sessions, 1) {
+		return
+	}
+	result, err := sessions[0].Enqueue([][]byte{[]byte("H|\\^&|||"), []byte("L|1|N")})
+	assert.Nil(t, err)
+
+	_, err = readByte(300 * time.Millisecond)
+	assert.NotNil(t, err, "nothing is sent during the transfer of the instrument")
+
+	_, err = clientConn.Write([]byte{utilities.EOT})
+	assert.Nil(t, err)
+
+	// the queued message is sent after the transfer
+	answer, err = readByte(2 * time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(utilities.ENQ), answer)
+	_, err = clientConn.Write([]byte{utilities.ACK})
+	assert.Nil(t, err)
+	for {
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buffer := make([]byte, 512)
+		n, err := clientConn.Read(buffer)
+		if !assert.Nil(t, err) {
+			break
+		}
+		if n == 1 && buffer[0] == utilities.EOT {
+			break
+		}
+		_, err = clientConn.Write([]byte{utilities.ACK})
+		assert.Nil(t, err)
+	}
+
+	select {
+	case sendResult := <-result:
+		assert.Nil(t, sendResult.Err)
+		assert.Greater(t, sendResult.N, 0)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no result of the queued message")
+	}
+
+	clientConn.Close()
+	tcpServer.Stop()
+}
+
+func TestOutbox(t *testing.T) {
+	path := t.TempDir() + "/outbox.journal"
+	results := make(chan OutboxResult, 10)
+	settings := DefaultOutboxSettings().
+		SetMaxAttempts(2).
+		SetRetryDelay(10*time.Millisecond, 20*time.Millisecond).
+		SetResultHandler(func(result OutboxResult) { results <- result })
+
+	outbox, err := OpenOutbox(path, settings)
+	assert.Nil(t, err)
+	for _, order := range []string{"order 1", "order 2", "unsendable", "order 3"} {
+		_, err := outbox.Put("analyzer-1", [][]byte{[]byte(order)})
+		assert.Nil(t, err)
+	}
+	_, err = outbox.Put("analyzer-2", [][]byte{[]byte("other analyzer")})
+	assert.Nil(t, err)
+	assert.Nil(t, outbox.Close())
+	_, err = outbox.Put("analyzer-1", [][]byte{[]byte("too late")})
+	assert.ErrorIs(t, err, ErrOutboxClosed)
+
+	// the messages survive a restart
+	outbox, err = OpenOutbox(path, settings)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, outbox.Pending("analyzer-1"))
+	assert.Equal(t, 1, outbox.Pending("analyzer-2"))
+
+	sent := make([]string, 0)
+	failedOnce := false
+	enqueue := func(data [][]byte) (<-chan SendResult, error) {
+		result := make(chan SendResult, 1)
+		switch message := string(data[0]); {
+		case message == "unsendable", message == "order 2" && !failedOnce:
+			failedOnce = failedOnce || message == "order 2"
+			result <- SendResult{Err: errors.New("no acknowledgement")}
+		default:
+			sent = append(sent, message)
+			result <- SendResult{N: len(message)}
+		}
+		return result, nil
+	}
+	sessionClosed := make(chan struct{})
+	delivered := make(chan struct{})
+	go func() {
+		outbox.deliver("analyzer-1", enqueue, sessionClosed)
+		close(delivered)
+	}()
+
+	expected := []struct {
+		message  string
+		attempts int
+		failed   bool
+	}{{"order 1", 1, false}, {"order 2", 2, false}, {"unsendable", 2, true}, {"order 3", 1, false}}
+	for i, expect := range expected {
+		select {
+		case result := <-results:
+			assert.Equal(t, uint64(i+1), result.ID)
+			assert.Equal(t, "analyzer-1", result.Peer)
+			assert.Equal(t, expect.message, string(result.Data[0]))
+			assert.Equal(t, expect.attempts, result.Attempts)
+			assert.Equal(t, expect.failed, result.Err != nil)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no result for %s", expect.message)
+		}
+	}
+	assert.Equal(t, 0, outbox.Pending("analyzer-1"))
+
+	// a message for the connected peer is delivered at once
+	_, err = outbox.Put("analyzer-1", [][]byte{[]byte("order 4")})
+	assert.Nil(t, err)
+	select {
+	case result := <-results:
+		assert.Nil(t, result.Err)
+		assert.Equal(t, uint64(6), result.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no result for order 4")
+	}
+	close(sessionClosed)
+	<-delivered
+	assert.Equal(t, []string{"order 1", "order 2", "order 3", "order 4"}, sent)
+	assert.Nil(t, outbox.Close())
+
+	// only the message of the other peer is left, the IDs are not reused
+	outbox, err = OpenOutbox(path, settings)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, outbox.Pending("analyzer-1"))
+	assert.Equal(t, 1, outbox.Pending("analyzer-2"))
+	id, err := outbox.Put("analyzer-1", [][]byte{[]byte("order 5")})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), id)
+	assert.Nil(t, outbox.Close())
+
+	// a crash while writing leaves an incomplete last line
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	_, err = file.WriteString(`{"op":"put","id":8,"peer":"analyzer-1","da`)
+	assert.Nil(t, err)
+	file.Close()
+	outbox, err = OpenOutbox(path, settings)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, outbox.Pending("analyzer-1"))
+	assert.Nil(t, outbox.Close())
+}
+
+func TestTCPServerOutbox(t *testing.T) {
+	results := make(chan OutboxResult, 10)
+	outbox, err := OpenOutbox(t.TempDir()+"/outbox.journal", DefaultOutboxSettings().
+		SetResultHandler(func(result OutboxResult) { results <- result }))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer outbox.Close()
+	// the instrument is offline
+	_, err = outbox.Put("127.0.0.1", [][]byte{[]byte("order 4711")})
+	assert.Nil(t, err)
+
+	config := DefaultTCPServerSettings
+	config.Outbox = outbox
+	tcpServer := CreateNewTCPServerInstance(4032,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &testSessionMock{
+		receiveQ:          make(chan []byte, 500),
+		signalReady:       make(chan bool, 100),
+		occuredErrorTypes: make([]ErrorType, 0),
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4032")
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002hello\u0003"))
+	assert.Nil(t, err)
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := make([]byte, 0)
+	buffer := make([]byte, 100)
+	// the mock handler answers the message of the instrument as well, in either order
+	for !strings.Contains(string(response), "\u0002order 4711\r\u0003") {
+		n, err := clientConn.Read(buffer)
+		if !assert.Nil(t, err) {
+			break
+		}
+		response = append(response, buffer[:n]...)
+	}
+
+	select {
+	case result := <-results:
+		assert.Nil(t, result.Err)
+		assert.Equal(t, "127.0.0.1", result.Peer)
+		assert.Equal(t, 1, result.Attempts)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no result of the outbox message")
+	}
+	assert.Equal(t, 0, outbox.Pending("127.0.0.1"))
+
+	clientConn.Close()
+	tcpServer.Stop()
+}
+
+func TestInboundJournal(t *testing.T) {
+	path := t.TempDir() + "/inbound.journal"
+	journal, err := OpenInboundJournal(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	sessionJournal := newSessionJournal(journal, "10.0.0.1")
+	assert.Nil(t, sessionJournal.Record([]byte("H|1\r"), false))
+	assert.Nil(t, sessionJournal.Record([]byte("L|1\r"), true))
+	// an aborted transfer, acknowledged but never passed to the handler
+	assert.Nil(t, sessionJournal.Record([]byte("H|2\r"), false))
+	assert.Nil(t, sessionJournal.Record([]byte("H|3\rL|1\r"), false))
+	assert.Nil(t, sessionJournal.Record([]byte("H|4\r"), false))
+	assert.Nil(t, sessionJournal.Record([]byte("L|1\r"), true))
+
+	sessionJournal.received([]byte("H|1\rL|1\r"), nil, false)
+	sessionJournal.received([]byte("H|3\rL|1\r"), nil, false)
+	sessionJournal.received([]byte("H|4\rL|1\r"), errors.New("database not available"), false)
+	assert.Nil(t, journal.Close())
+
+	journal, err = OpenInboundJournal(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	unhandled := journal.Unhandled()
+	if assert.Len(t, unhandled, 2) {
+		assert.Equal(t, JournalEntry{ID: 2, Peer: "10.0.0.1", Data: []byte("H|2\r"), Received: unhandled[0].Received}, unhandled[0])
+		assert.Equal(t, "H|4\rL|1\r", string(unhandled[1].Data))
+	}
+
+	handler := &journalHandlerMock{sessions: make(chan Session, 10), data: make(chan string, 10), fail: "H|2\r"}
+	journal.replay(handler)
+	assert.Equal(t, "H|2\r", <-handler.data)
+	assert.Equal(t, "H|4\rL|1\r", <-handler.data)
+	session := <-handler.sessions
+	assert.False(t, session.IsAlive())
+	remoteIP, _ := session.RemoteAddress()
+	assert.Equal(t, "10.0.0.1", remoteIP)
+	_, err = session.Send([][]byte{[]byte("ACK")})
+	assert.ErrorIs(t, err, ErrSessionClosed)
+	if unhandled := journal.Unhandled(); assert.Len(t, unhandled, 1, "the entry the handler failed on is kept") {
+		assert.Equal(t, uint64(2), unhandled[0].ID)
+	}
+
+	handler.fail = ""
+	journal.replay(handler)
+	assert.Len(t, journal.Unhandled(), 0)
+	assert.Nil(t, journal.Close())
+
+	// the IDs are not reused
+	journal, err = OpenInboundJournal(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	id, err := journal.record("10.0.0.1", []byte("H|5\r"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), id)
+	assert.Nil(t, journal.Close())
+}
+
+type journalHandlerMock struct {
+	testSessionMock
+	sessions chan Session
+	data     chan string
+	fail     string
+}
+
+func (s *journalHandlerMock) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
+	s.sessions <- session
+	s.data <- string(fileData)
+	if string(fileData) == s.fail {
+		return errors.New("database not available")
+	}
+	return nil
+}
+
+func TestTCPServerInboundJournal(t *testing.T) {
+	path := t.TempDir() + "/inbound.journal"
+	journal, err := OpenInboundJournal(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	// acknowledged to the instrument before the process crashed
+	_, err = journal.record("127.0.0.1", []byte("H|1\rL|1\r"))
+	assert.Nil(t, err)
+	assert.Nil(t, journal.Close())
+	journal, err = OpenInboundJournal(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer journal.Close()
+
+	config := DefaultTCPServerSettings
+	config.InboundJournal = journal
+	tcpServer := CreateNewTCPServerInstance(4033,
+		protocol.Lis1A1Protocol(protocol.DefaultLis1A1ProtocolSettings().DisableStrictChecksum()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &journalHandlerMock{
+		testSessionMock: testSessionMock{signalReady: make(chan bool, 100)},
+		sessions:        make(chan Session, 10),
+		data:            make(chan string, 10),
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	// replayed before the server accepts connections
+	select {
+	case data := <-handler.data:
+		assert.Equal(t, "H|1\rL|1\r", data)
+		assert.False(t, (<-handler.sessions).IsAlive())
+	default:
+		t.Fatalf("the unhandled message was not passed to the handler")
+	}
+	assert.Len(t, journal.Unhandled(), 0)
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4033")
+	assert.Nil(t, err)
+	expectACK := func() {
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buffer := make([]byte, 1)
+		_, err := clientConn.Read(buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, byte(utilities.ACK), buffer[0])
+	}
+	_, err = clientConn.Write([]byte{utilities.ENQ})
+	assert.Nil(t, err)
+	expectACK()
+	_, err = clientConn.Write([]byte("\u00021H|2\u000300\r\n"))
+	assert.Nil(t, err)
+	expectACK()
+	assert.Len(t, journal.Unhandled(), 0, "the message is recorded with its terminator record")
+	_, err = clientConn.Write([]byte("\u00022L|1\u000300\r\n"))
+	assert.Nil(t, err)
+	expectACK()
+
+	// recorded before the ACK, handled when DataReceived returned
+	if unhandled := journal.Unhandled(); assert.Len(t, unhandled, 1) {
+		assert.Equal(t, "H|2\rL|1\r", string(unhandled[0].Data))
+		assert.Equal(t, "127.0.0.1", unhandled[0].Peer)
+	}
+	_, err = clientConn.Write([]byte{utilities.EOT})
+	assert.Nil(t, err)
+	select {
+	case data := <-handler.data:
+		assert.Equal(t, "H|2\rL|1\r", data)
+		assert.True(t, (<-handler.sessions).IsAlive())
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the message was not passed to the handler")
+	}
+	assert.Eventually(t, func() bool { return len(journal.Unhandled()) == 0 }, time.Second, 10*time.Millisecond)
+
+	clientConn.Close()
+	tcpServer.Stop()
+}
+
+type acknowledgementHandlerMock struct {
+	testSessionMock
+	failures  int32
+	data      chan string
+	sendError chan error
+}
+
+func (s *acknowledgementHandlerMock) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
+	_, err := session.Send([][]byte{[]byte("H|1\rL|1\r")})
+	s.sendError <- err
+	s.data <- string(fileData)
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return errors.New("database not available")
+	}
+	return nil
+}
+
+func TestTCPServerHandlerErrorRefusesTheMessage(t *testing.T) {
+	tcpServer := CreateNewTCPServerInstance(4034,
+		protocol.Lis1A1Protocol(protocol.DefaultLis1A1ProtocolSettings().DisableStrictChecksum().EnableAcknowledgement()),
+		NoLoadBalancer,
+		100,
+		DefaultTCPServerSettings)
+
+	handler := &acknowledgementHandlerMock{
+		testSessionMock: testSessionMock{signalReady: make(chan bool, 100)},
+		failures:        1,
+		data:            make(chan string, 10),
+		sendError:       make(chan error, 10),
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4034")
+	if !assert.Nil(t, err) {
+		return
+	}
+	expect := func(expected byte) {
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buffer := make([]byte, 1)
+		_, err := clientConn.Read(buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, buffer[0])
+	}
+	_, err = clientConn.Write([]byte{utilities.ENQ})
+	assert.Nil(t, err)
+	expect(utilities.ACK)
+	_, err = clientConn.Write([]byte("\u00021H|1\u000300\r\n"))
+	assert.Nil(t, err)
+	expect(utilities.ACK)
+
+	// the handler fails, the terminator frame is refused
+	_, err = clientConn.Write([]byte("\u00022L|1\u000300\r\n"))
+	assert.Nil(t, err)
+	expect(utilities.NAK)
+	assert.Equal(t, "H|1\rL|1\r", <-handler.data)
+	assert.ErrorIs(t, <-handler.sendError, protocol.ErrAcknowledgementPending, "sending would interrupt the transfer")
+
+	// the instrument repeats the frame, the handler succeeds
+	_, err = clientConn.Write([]byte("\u00022L|1\u000300\r\n"))
+	assert.Nil(t, err)
+	expect(utilities.ACK)
+	assert.Equal(t, "H|1\rL|1\r", <-handler.data)
+	<-handler.sendError
+
+	_, err = clientConn.Write([]byte{utilities.EOT})
+	assert.Nil(t, err)
+	select {
+	case data := <-handler.data:
+		t.Errorf("the message was passed to the handler again: %q", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	clientConn.Close()
+	tcpServer.Stop()
+}
+
+func TestTCPServerKeepsAnAcknowledgedMessageTheHandlerFailedOn(t *testing.T) {
+	journal, err := OpenInboundJournal(t.TempDir() + "/inbound.journal")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer journal.Close()
+
+	config := DefaultTCPServerSettings
+	config.InboundJournal = journal
+	tcpServer := CreateNewTCPServerInstance(4036,
+		protocol.Lis1A1Protocol(protocol.DefaultLis1A1ProtocolSettings().DisableStrictChecksum().EnableAcknowledgement()),
+		NoLoadBalancer,
+		100,
+		config)
+
+	handler := &journalHandlerMock{
+		testSessionMock: testSessionMock{signalReady: make(chan bool, 100)},
+		sessions:        make(chan Session, 10),
+		data:            make(chan string, 10),
+		fail:            "H|1\r",
+	}
+	go tcpServer.Run(handler)
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4036")
+	if !assert.Nil(t, err) {
+		return
+	}
+	expectACK := func() {
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buffer := make([]byte, 1)
+		_, err := clientConn.Read(buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, byte(utilities.ACK), buffer[0])
+	}
+	_, err = clientConn.Write([]byte{utilities.ENQ})
+	assert.Nil(t, err)
+	expectACK()
+	_, err = clientConn.Write([]byte("\u00021H|1\u000300\r\n"))
+	assert.Nil(t, err)
+	expectACK()
+
+	// without terminator record the message is passed with the EOT, its frame was acknowledged already
+	_, err = clientConn.Write([]byte{utilities.EOT})
+	assert.Nil(t, err)
+	select {
+	case data := <-handler.data:
+		assert.Equal(t, "H|1\r", data)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the message was not passed to the handler")
+	}
+
+	assert.Eventually(t, func() bool {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+		return len(handler.occuredErrorTypes) == 1 && handler.occuredErrorTypes[0] == ErrorDataReceived
+	}, time.Second, 10*time.Millisecond, "the error was not passed to the instrument")
+	if unhandled := journal.Unhandled(); assert.Len(t, unhandled, 1, "the instrument does not send the message again") {
+		assert.Equal(t, "H|1\r", string(unhandled[0].Data))
+	}
+
+	clientConn.Close()
+	tcpServer.Stop()
+}
+
+// upperCaseMiddleware changes the payload and drops the keep-alive messages of an instrument
+type upperCaseMiddleware struct {
+	Handler
+	order *[]string
+}
+
+func (m *upperCaseMiddleware) DataReceived(session Session, data []byte, receiveTimestamp time.Time) error {
+	*m.order = append(*m.order, "upper case")
+	if string(data) == "ping" {
+		return nil
+	}
+	return m.Handler.DataReceived(session, []byte(strings.ToUpper(string(data))), receiveTimestamp)
+}
+
+func TestChain(t *testing.T) {
+	handler := &testSessionMock{receiveQ: make(chan []byte, 10), signalReady: make(chan bool, 10)}
+	order := make([]string, 0)
+	events := make([]HandlerEvent, 0)
+	chained := Chain(handler,
+		TimeHandler(func(session Session, event HandlerEvent, duration time.Duration) {
+			order = append(order, "timing")
+			events = append(events, event)
+		}),
+		func(next Handler) Handler { return &upperCaseMiddleware{Handler: next, order: &order} },
+	)
+
+	session := &replayedSession{entry: JournalEntry{Peer: "127.0.0.1"}}
+	assert.Nil(t, chained.DataReceived(session, []byte("hello"), time.Now()))
+	assert.Equal(t, "HELLO", string(<-handler.receiveQ))
+	assert.Equal(t, []string{"upper case", "timing"}, order, "the first middleware is the outermost")
+
+	assert.Nil(t, chained.DataReceived(session, []byte("ping"), time.Now()))
+	assert.Len(t, handler.receiveQ, 0, "the middleware dropped the message")
+
+	assert.Nil(t, chained.Connected(session))
+	chained.Error(session, ErrorReceive, errors.New("connection reset"))
+	notifyDisconnected(chained, session, DisconnectRemote)
+	assert.Equal(t, []HandlerEvent{HandlerDataReceived, HandlerDataReceived, HandlerConnected, HandlerError, HandlerDisconnected}, events)
+	assert.Equal(t, []ErrorType{ErrorReceive}, handler.occuredErrorTypes)
+	assert.True(t, handler.didReceiveDisconnectMessage)
+}
+
+type panickingHandlerMock struct {
+	testSessionMock
+}
+
+func (s *panickingHandlerMock) DataReceived(session Session, fileData []byte, receiveTimestamp time.Time) error {
+	if string(fileData) == "panic" {
+		var attributes map[string]string
+		attributes["crash"] = "assignment to entry in nil map"
+	}
+	return s.testSessionMock.DataReceived(session, fileData, receiveTimestamp)
+}
+
+func TestTCPServerRecoverPanics(t *testing.T) {
+	tcpServer := CreateNewTCPServerInstance(4035,
+		protocol.STXETX(protocol.DefaultSTXETXProtocolSettings()),
+		NoLoadBalancer,
+		100,
+		DefaultTCPServerSettings)
+
+	handler := &panickingHandlerMock{testSessionMock{
+		receiveQ:          make(chan []byte, 10),
+		signalReady:       make(chan bool, 100),
+		occuredErrorTypes: make([]ErrorType, 0),
+	}}
+	go tcpServer.Run(Chain(handler, RecoverPanics()))
+	tcpServer.WaitReady()
+
+	clientConn, err := net.Dial("tcp", "127.0.0.1:4035")
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = clientConn.Write([]byte("\u0002panic\u0003"))
+	assert.Nil(t, err)
+	_, err = clientConn.Write([]byte("\u0002hello\u0003"))
+	assert.Nil(t, err)
+
+	// the session survived the panic
+	select {
+	case data := <-handler.receiveQ:
+		assert.Equal(t, "hello", string(data))
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the message after the panic was not passed to the handler")
+	}
+	handler.mutex.Lock()
+	assert.Equal(t, []ErrorType{ErrorDataReceived}, handler.occuredErrorTypes, "the panic is the error of DataReceived")
+	handler.mutex.Unlock()
+
+	clientConn.Close()
+	tcpServer.Stop()
+}
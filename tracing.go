@@ -0,0 +1,189 @@
+package bloodlabnet
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/blutspende/go-bloodlab-net"
+
+// sessionTracer creates the spans of a session:
+//   - bloodlabnet.receive from the first byte of a message until it is passed to the handler
+//   - bloodlabnet.handle around DataReceived, its context is Session.Context
+//   - bloodlabnet.send around Session.Send with the events of the protocol (e.g. ENQ/ACK, retries)
+//
+// Without a TracerProvider all methods do nothing.
+type sessionTracer struct {
+	tracer   trace.Tracer
+	remoteIP string
+
+	mutex         sync.Mutex
+	firstByte     time.Time
+	handleContext context.Context
+	sendSpan      trace.Span
+	// events of the protocol while receiving, they are added to the next receive span
+	pendingEvents []pendingEvent
+}
+
+type pendingEvent struct {
+	timestamp time.Time
+	event     protocol.ProtocolEvent
+}
+
+func newSessionTracer(tracerProvider trace.TracerProvider, remoteIP string) *sessionTracer {
+	st := &sessionTracer{remoteIP: remoteIP}
+	if tracerProvider != nil {
+		st.tracer = tracerProvider.Tracer(tracerName)
+	}
+	return st
+}
+
+func (st *sessionTracer) enabled() bool {
+	return st != nil && st.tracer != nil
+}
+
+// wrapConn notes the time of the first byte of every message
+func (st *sessionTracer) wrapConn(conn net.Conn) net.Conn {
+	if !st.enabled() {
+		return conn
+	}
+	return &tracedConn{Conn: conn, tracer: st}
+}
+
+// observe adds the events of the protocol to the spans
+func (st *sessionTracer) observe(lowLevelProtocol protocol.Implementation) {
+	if !st.enabled() {
+		return
+	}
+	if source, ok := lowLevelProtocol.(protocol.EventSource); ok {
+		source.AddEventReporter(st)
+	}
+}
+
+func (st *sessionTracer) ProtocolEvent(remoteAddr string, event protocol.ProtocolEvent) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.sendSpan != nil {
+		st.sendSpan.AddEvent(string(event))
+		return
+	}
+	st.pendingEvents = append(st.pendingEvents, pendingEvent{timestamp: time.Now(), event: event})
+}
+
+func (st *sessionTracer) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("net.peer.ip", st.remoteIP)}
+}
+
+// startHandling ends the receive span of the message and starts the handle span
+func (st *sessionTracer) startHandling(size int) {
+	if !st.enabled() {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	now := time.Now()
+	start := st.firstByte
+	if start.IsZero() {
+		start = now
+	}
+	ctx, receiveSpan := st.tracer.Start(context.Background(), "bloodlabnet.receive",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithTimestamp(start),
+		trace.WithAttributes(append(st.attributes(), attribute.Int("message.size", size))...))
+	for _, pending := range st.pendingEvents {
+		receiveSpan.AddEvent(string(pending.event), trace.WithTimestamp(pending.timestamp))
+	}
+	receiveSpan.End(trace.WithTimestamp(now))
+	st.firstByte = time.Time{}
+	st.pendingEvents = nil
+
+	st.handleContext, _ = st.tracer.Start(ctx, "bloodlabnet.handle", trace.WithAttributes(st.attributes()...))
+}
+
+func (st *sessionTracer) endHandling(err error) {
+	if !st.enabled() {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	span := trace.SpanFromContext(st.handleContext)
+	setSpanError(span, err)
+	span.End()
+	st.handleContext = nil
+}
+
+// startSend starts the send span, as child of the handle span when sending from DataReceived
+func (st *sessionTracer) startSend(size int) {
+	if !st.enabled() {
+		return
+	}
+	ctx := st.context()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, st.sendSpan = st.tracer.Start(ctx, "bloodlabnet.send", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(st.attributes(), attribute.Int("message.size", size))...))
+}
+
+func (st *sessionTracer) endSend(err error) {
+	if !st.enabled() {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	setSpanError(st.sendSpan, err)
+	st.sendSpan.End()
+	st.sendSpan = nil
+	// the answers of the receiver are no data of the next message
+	st.firstByte = time.Time{}
+}
+
+// context is the context of the handle span during DataReceived, otherwise context.Background
+func (st *sessionTracer) context() context.Context {
+	if st == nil {
+		return context.Background()
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.handleContext != nil {
+		return st.handleContext
+	}
+	return context.Background()
+}
+
+func (st *sessionTracer) markFirstByte() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.firstByte.IsZero() && st.sendSpan == nil {
+		st.firstByte = time.Now()
+	}
+}
+
+func setSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+type tracedConn struct {
+	net.Conn
+	tracer *sessionTracer
+}
+
+func (tc *tracedConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	if n > 0 {
+		tc.tracer.markFirstByte()
+	}
+	return n, err
+}
@@ -1,7 +1,12 @@
 package bloodlabnet
 
 import (
+	"fmt"
+	"net"
 	"time"
+
+	"github.com/blutspende/go-bloodlab-net/protocol"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TCPClientConfiguration struct {
@@ -12,6 +17,24 @@ type TCPClientConfiguration struct {
 	SessionAfterFirstByte   bool
 	SessionInitationTimeout time.Duration
 	SourceIP                string
+	// KeepAlive enables the TCP keepalive of the operating system
+	KeepAlive KeepAliveConfiguration
+	// EnableHeartbeat probes the server every PollInterval without traffic with the heartbeat of the protocol
+	// (see protocol.Heartbeater) and closes the connection if it does not answer within HeartbeatTimeout
+	EnableHeartbeat  bool
+	HeartbeatTimeout time.Duration
+	// IdleTimeout closes the connection after the time without messages, MaxSessionLifetime after the time
+	// since connecting. The connection is closed between transfers and connected again. 0 for no limit
+	IdleTimeout        time.Duration
+	MaxSessionLifetime time.Duration
+	// SendQueueCapacity is the number of messages Enqueue holds, by default 100. SendQueueFullPolicy decides
+	// about messages for a full queue
+	SendQueueCapacity   int
+	SendQueueFullPolicy SendQueueFullPolicy
+	// Metrics receives the measurements of the connection, e.g. a metrics.Collector
+	Metrics MetricsRecorder
+	// TracerProvider enables OpenTelemetry spans for receiving, handling and sending messages
+	TracerProvider trace.TracerProvider
 }
 
 func (s TCPClientConfiguration) SetSourceIP(sourceIP string) TCPClientConfiguration {
@@ -27,6 +50,7 @@ var DefaultTCPClientSettings = TCPClientConfiguration{
 	SessionAfterFirstByte:   true,            // Sessions are initiated after reading the first bytes (avoids disconnects)
 	SessionInitationTimeout: time.Second * 0, // Waiting forever by default
 	SourceIP:                "",
+	HeartbeatTimeout:        defaultHeartbeatTimeout,
 }
 
 type TCPServerConfiguration struct {
@@ -36,7 +60,51 @@ type TCPServerConfiguration struct {
 	PollInterval             time.Duration
 	SessionAfterFirstByte    bool
 	SessionInitiationTimeout time.Duration
-	BlackListedIPAddresses   []string
+	// BlackListedIPAddresses are added to the denylist of the IPFilter, addresses or networks in CIDR notation
+	BlackListedIPAddresses []string
+	// IPFilter decides which remote addresses are accepted, it can be changed while the server is running
+	IPFilter *IPFilter
+	// MaxConnectionsPerIP limits the concurrent sessions of a remote address, 0 for no limit
+	MaxConnectionsPerIP int
+	// PerIPLimitPolicy decides about new connections of a remote address that reached MaxConnectionsPerIP
+	PerIPLimitPolicy PerIPLimitPolicy
+	// ConnectionRatePerIP is the number of connections per second a remote address may open, 0 for no limit
+	ConnectionRatePerIP float64
+	// ConnectionBurstPerIP is the number of connections a remote address may open at once within the rate
+	ConnectionBurstPerIP int
+	// SingleSessionPerPeer closes the session of a peer when it connects again, e.g. after a power-cycle
+	// without closing the old connection
+	SingleSessionPerPeer bool
+	// PeerIdentity identifies the peers for SingleSessionPerPeer, by default the remote IP address
+	PeerIdentity PeerIdentity
+	// KeepAlive enables the TCP keepalive of the operating system for every accepted connection
+	KeepAlive KeepAliveConfiguration
+	// EnableHeartbeat probes the peers every PollInterval without traffic with the heartbeat of the protocol
+	// (see protocol.Heartbeater) and closes the session if the peer does not answer within HeartbeatTimeout
+	EnableHeartbeat  bool
+	HeartbeatTimeout time.Duration
+	// IdleTimeout closes sessions after the time without messages, MaxSessionLifetime after the time since
+	// connecting. Sessions are closed between transfers. 0 for no limit
+	IdleTimeout        time.Duration
+	MaxSessionLifetime time.Duration
+	// BroadcastParallelism is the number of sessions Broadcast sends to at once, by default 8
+	BroadcastParallelism int
+	// SendQueueCapacity is the number of messages Enqueue holds per session, by default 100.
+	// SendQueueFullPolicy decides about messages for a full queue
+	SendQueueCapacity   int
+	SendQueueFullPolicy SendQueueFullPolicy
+	// Outbox delivers the stored messages of a peer through the send queue when it connects, see OpenOutbox.
+	// The peer is identified by PeerIdentity
+	Outbox *Outbox
+	// InboundJournal records the messages of the protocols that acknowledge before DataReceived, e.g. Lis1A1 and
+	// AU6XX, and passes the unhandled ones to the handler again when the server starts, see OpenInboundJournal
+	InboundJournal *InboundJournal
+	// CaptureSink records the traffic of every accepted connection, e.g. a protocol.PcapngWriter
+	CaptureSink protocol.CaptureSink
+	// Metrics receives the measurements of the server and its sessions, e.g. a metrics.Collector
+	Metrics MetricsRecorder
+	// TracerProvider enables OpenTelemetry spans for receiving, handling and sending messages
+	TracerProvider trace.TracerProvider
 }
 
 type SecureConnectionOptions struct {
@@ -50,6 +118,7 @@ var DefaultTCPServerSettings = TCPServerConfiguration{
 	PollInterval:             time.Second * 60,
 	SessionAfterFirstByte:    true,             // Sessions are initiated after reading the first bytes (avoids disconnects)
 	SessionInitiationTimeout: time.Second * 30, // Waiting 30 sec by default
+	HeartbeatTimeout:         defaultHeartbeatTimeout,
 }
 
 type ConnectionType int
@@ -59,6 +128,39 @@ const (
 	HAProxySendProxyV2 ConnectionType = 2
 )
 
+// PeerIdentity identifies the instrument of a connection for SingleSessionPerPeer, e.g. by the
+// address and the local port it connected to. The default is the remote IP address.
+type PeerIdentity func(remoteIP string, conn net.Conn) string
+
+// DisconnectReason tells why a session ended, see DisconnectReasonHandler
+type DisconnectReason string
+
+const (
+	DisconnectRemote        DisconnectReason = "remote"         // the peer closed the connection
+	DisconnectClosed        DisconnectReason = "closed"         // Session.Close was called
+	DisconnectReplaced      DisconnectReason = "replaced"       // a new connection of the same peer took over
+	DisconnectAdmin         DisconnectReason = "admin"          // closed with the AdminHandler
+	DisconnectServerStopped DisconnectReason = "server_stopped" // the server was stopped
+	DisconnectNotResponding DisconnectReason = "not_responding" // the peer did not answer the heartbeat
+	DisconnectIdleTimeout   DisconnectReason = "idle_timeout"   // no messages within IdleTimeout
+	DisconnectMaxLifetime   DisconnectReason = "max_lifetime"   // the session reached MaxSessionLifetime
+)
+
+type PerIPLimitPolicy int
+
+const (
+	RejectNewConnection PerIPLimitPolicy = 1 // default
+	CloseOldestSession  PerIPLimitPolicy = 2 // for instruments that reconnect without closing the old socket
+)
+
+type SendQueueFullPolicy int
+
+const (
+	BlockWhenFull      SendQueueFullPolicy = 1 // default, Enqueue waits for space
+	RejectWhenFull     SendQueueFullPolicy = 2 // Enqueue returns ErrSendQueueFull
+	DropOldestWhenFull SendQueueFullPolicy = 3 // the oldest queued message is dropped with ErrSendQueueFull
+)
+
 type FileNameGeneration int
 
 const (
@@ -88,4 +190,42 @@ const (
 	ErrorCreateSession   ErrorType = 9  // server only
 	ErrorConfiguration   ErrorType = 10 // Error in configuration
 	ErrorLogin           ErrorType = 11
+	ErrorIPFiltered      ErrorType = 12 // server only, connection rejected by the IPFilter
+	ErrorConnectionRate  ErrorType = 13 // server only, ConnectionRatePerIP exceeded
+	ErrorDataReceived    ErrorType = 14 // DataReceived failed and the protocol can not refuse the message
 )
+
+func (errorType ErrorType) String() string {
+	switch errorType {
+	case ErrorConnect:
+		return "connect"
+	case ErrorSend:
+		return "send"
+	case ErrorReceive:
+		return "receive"
+	case ErrorDisconnect:
+		return "disconnect"
+	case ErrorInternal:
+		return "internal"
+	case ErrorConnectionLimit:
+		return "connection_limit"
+	case ErrorAccept:
+		return "accept"
+	case ErrorMaxConnections:
+		return "max_connections"
+	case ErrorCreateSession:
+		return "create_session"
+	case ErrorConfiguration:
+		return "configuration"
+	case ErrorLogin:
+		return "login"
+	case ErrorIPFiltered:
+		return "ip_filtered"
+	case ErrorConnectionRate:
+		return "connection_rate"
+	case ErrorDataReceived:
+		return "data_received"
+	default:
+		return fmt.Sprintf("error_%d", int(errorType))
+	}
+}